@@ -0,0 +1,278 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// Returned when entries of a zip archive are encrypted, the other entries are still expanded
+var ErrEncrypted = errors.New("password protected")
+
+// Returned when an archive exceeds the Limits, no file of the archive is kept
+var ErrLimit = errors.New("expansion limit exceeded")
+
+// Bounds of an expansion, guarding against zip bombs
+// Entries and Size are shared by an archive and the archives nested in it
+type Limits struct {
+	// Levels of archives expanded, 1 leaves archives found in the archive as files
+	Depth int
+	// Number of files
+	Entries int
+	// Decompressed bytes
+	Size int64
+}
+
+// Limits used when none are configured
+var DefaultLimits = Limits{Depth: 2, Entries: 1000, Size: 100 << 20}
+
+// Kinds of archives
+const (
+	kindZip = iota + 1
+	kindTar
+	kindTarGz
+)
+
+// Content types mapped to archive kinds
+var types = map[string]int{
+	"application/zip":              kindZip,
+	"application/x-zip-compressed": kindZip,
+	"application/x-zip":            kindZip,
+	"application/x-tar":            kindTar,
+	"application/x-gtar":           kindTarGz,
+	"application/x-compressed-tar": kindTarGz,
+}
+
+// Returns true if the attachment is an archive Expand can read
+func Supported(name, ctype string) bool {
+	return kind(name, ctype) != 0
+}
+
+// Reads the files of a zip, tar or tar.gz attachment into att.Children
+// Archives found inside are expanded into the Children of their file, up to lim.Depth levels
+// Returns ErrLimit, with no Children kept, when the archive exceeds lim
+// Returns ErrEncrypted when some entries are password protected, the readable ones are kept
+func Expand(att *mail.Attachment, lim Limits) error {
+	if lim.Depth < 1 {
+		return nil
+	}
+	children, err := expand(att.Name, att.Type, att.Buf.Bytes(), lim.Depth, &lim)
+	if errors.Is(err, ErrLimit) {
+		return err
+	}
+	att.Children = children
+	return err
+}
+
+// Expands an archive, lim holds the entries and bytes left
+func expand(name, ctype string, b []byte, depth int, lim *Limits) ([]mail.Attachment, error) {
+	var (
+		files []mail.Attachment
+		err   error
+	)
+	switch kind(name, ctype) {
+	case kindZip:
+		files, err = unzip(b, lim)
+	case kindTar:
+		files, err = untar(bytes.NewReader(b), lim)
+	case kindTarGz:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(b)); err != nil {
+			return nil, fmt.Errorf("unable to read %v. err: %s", name, err.Error())
+		}
+		files, err = untar(zr, lim)
+	default:
+		return nil, nil
+	}
+	if errors.Is(err, ErrLimit) {
+		return nil, err
+	}
+	// Entries sharing a path, eg: appended twice to a tar, would share an s3 key
+	mail.UniqueNames(files)
+
+	// Nested archives, a password protected one is kept as a file
+	for i := range files {
+		f := &files[i]
+		if depth <= 1 || !Supported(f.Name, f.Type) {
+			continue
+		}
+		children, cerr := expand(f.Name, f.Type, f.Buf.Bytes(), depth-1, lim)
+		if errors.Is(cerr, ErrLimit) {
+			return nil, cerr
+		}
+		f.Children = children
+		f.ArchiveError = cerr
+	}
+	return files, err
+}
+
+// Reads the files of a zip archive
+func unzip(b []byte, lim *Limits) ([]mail.Attachment, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read zip. err: %s", err.Error())
+	}
+
+	var files []mail.Attachment
+	encrypted := 0
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || skip(zf.Name) {
+			continue
+		}
+		// Bit 0 of the general purpose flags marks encrypted entries
+		if zf.Flags&0x1 != 0 {
+			encrypted++
+			continue
+		}
+		if err := lim.take(int64(zf.UncompressedSize64)); err != nil {
+			return nil, err
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return files, fmt.Errorf("unable to read %v. err: %s", zf.Name, err.Error())
+		}
+		f, err := file(zf.Name, rc, lim, int64(zf.UncompressedSize64))
+		rc.Close()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+
+	if encrypted > 0 {
+		return files, fmt.Errorf("%w, %d of %d files not expanded", ErrEncrypted, encrypted, encrypted+len(files))
+	}
+	return files, nil
+}
+
+// Reads the regular files of a tar archive
+// Every header counts as an entry, so a stream of empty or skipped entries hits the limits too
+func untar(r io.Reader, lim *Limits) ([]mail.Attachment, error) {
+	cr := &countReader{r: r}
+	tr := tar.NewReader(cr)
+	var files []mail.Attachment
+	for {
+		read := cr.n
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return files, fmt.Errorf("unable to read tar. err: %s", err.Error())
+		}
+		// Next reads the header blocks, extended headers included, and the data of the
+		// previous entry that was not read, eg: of skipped entries
+		if lim.Size -= cr.n - read; lim.Size < 0 {
+			return nil, errTooLarge
+		}
+		if h.Typeflag != tar.TypeReg || skip(h.Name) {
+			if lim.Entries--; lim.Entries < 0 {
+				return nil, errTooMany
+			}
+			continue
+		}
+		if err := lim.take(h.Size); err != nil {
+			return nil, err
+		}
+		f, err := file(h.Name, tr, lim, h.Size)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+}
+
+// Reads a file of an archive, size is the size declared by the archive
+// Declared sizes can not be trusted, the bytes read past size are taken from the limits too
+func file(name string, r io.Reader, lim *Limits, size int64) (mail.Attachment, error) {
+	var f mail.Attachment
+	f.Name = clean(name)
+	f.Type = mime.TypeByExtension(strings.ToLower(path.Ext(f.Name)))
+	if mt, _, err := mime.ParseMediaType(f.Type); err == nil {
+		f.Type = mt
+	} else {
+		f.Type = "application/octet-stream"
+	}
+
+	// size was taken from the limits already, read at most one byte past the bytes left
+	n, err := f.Buf.ReadFrom(io.LimitReader(r, size+lim.Size+1))
+	if err != nil {
+		return f, fmt.Errorf("unable to read %v. err: %s", name, err.Error())
+	}
+	if n > size {
+		lim.Size -= n - size
+		if lim.Size < 0 {
+			return f, errTooLarge
+		}
+	}
+	return f, nil
+}
+
+var (
+	errTooMany  = fmt.Errorf("%w: too many files", ErrLimit)
+	errTooLarge = fmt.Errorf("%w: too large once decompressed", ErrLimit)
+)
+
+// Counts the bytes read from r
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Takes a file of size bytes from the limits
+func (lim *Limits) take(size int64) error {
+	lim.Entries--
+	lim.Size -= size
+	if lim.Entries < 0 {
+		return errTooMany
+	}
+	if lim.Size < 0 || size < 0 {
+		return errTooLarge
+	}
+	return nil
+}
+
+// Returns the path of an archive entry without leading slashes and .. elements
+// so it stays under the key of the archive
+func clean(name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	return strings.TrimPrefix(name, "/")
+}
+
+// Returns true for metadata entries added by archivers, eg: __MACOSX/ of macOS
+func skip(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX/") || base == ".DS_Store" || base == "Thumbs.db"
+}
+
+// Returns the archive kind or 0 if not supported
+func kind(name, ctype string) int {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return kindTarGz
+	case strings.HasSuffix(lower, ".tar"):
+		return kindTar
+	case strings.HasSuffix(lower, ".zip"):
+		return kindZip
+	case path.Ext(lower) != "":
+		// Documents stored as zip files, eg: .docx or .jar, are not expanded
+		return 0
+	}
+	return types[strings.ToLower(ctype)]
+}
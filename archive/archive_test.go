@@ -0,0 +1,188 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// An entry of a test archive
+type entry struct {
+	name      string
+	data      string
+	encrypted bool
+}
+
+func zipFile(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.encrypted {
+			h.Flags |= 0x1
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarGz(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(e.name, "/") {
+			h.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func attachment(name, ctype string, b []byte) *mail.Attachment {
+	att := &mail.Attachment{Name: name, Type: ctype}
+	att.Buf.Write(b)
+	return att
+}
+
+// Returns the children of an attachment as path=content, nested files are named after their archive
+func tree(atts []mail.Attachment, parent string) []string {
+	var out []string
+	for _, a := range atts {
+		if len(a.Children) > 0 {
+			out = append(out, tree(a.Children, parent+a.Name+"/")...)
+			continue
+		}
+		out = append(out, parent+a.Name+"="+a.Buf.String())
+	}
+	return out
+}
+
+func TestExpand(t *testing.T) {
+	inner := zipFile(t, entry{name: "inner.txt", data: "inner"})
+	tests := []struct {
+		name  string
+		att   *mail.Attachment
+		lim   Limits
+		want  string
+		err   error
+		types string
+	}{
+		{
+			name:  "zip",
+			att:   attachment("invoices.zip", "application/zip", zipFile(t, entry{name: "march.pdf", data: "m"}, entry{name: "docs/april.csv", data: "a"}, entry{name: "docs/", data: ""})),
+			lim:   DefaultLimits,
+			want:  "march.pdf=m, docs/april.csv=a",
+			types: "application/pdf, text/csv",
+		},
+		{
+			name:  "tar.gz with a generic type",
+			att:   attachment("bundle.tgz", "application/octet-stream", tarGz(t, entry{name: "./a.txt", data: "a"}, entry{name: "__MACOSX/._a.txt", data: "x"})),
+			lim:   DefaultLimits,
+			want:  "a.txt=a",
+			types: "text/plain",
+		},
+		{
+			name: "entries sharing a path",
+			att:  attachment("logs.tar.gz", "", tarGz(t, entry{name: "app.log", data: "1"}, entry{name: "app.log", data: "2"})),
+			lim:  DefaultLimits,
+			want: "app.log=1, app-2.log=2",
+		},
+		{
+			name: "nested archive",
+			att:  attachment("outer.zip", "", zipFile(t, entry{name: "inner.zip", data: string(inner)}, entry{name: "b.txt", data: "b"})),
+			lim:  DefaultLimits,
+			want: "inner.zip/inner.txt=inner, b.txt=b",
+		},
+		{
+			name: "nested archive beyond the depth",
+			att:  attachment("outer.zip", "", zipFile(t, entry{name: "inner.zip", data: string(inner)})),
+			lim:  Limits{Depth: 1, Entries: 10, Size: 1 << 20},
+			want: "inner.zip=" + string(inner),
+		},
+		{
+			name: "paths stay under the archive",
+			att:  attachment("evil.zip", "", zipFile(t, entry{name: "../../etc/passwd", data: "p"}, entry{name: "/abs.txt", data: "x"})),
+			lim:  DefaultLimits,
+			want: "etc/passwd=p, abs.txt=x",
+		},
+		{
+			name: "too many files",
+			att:  attachment("many.zip", "", zipFile(t, entry{name: "1", data: "1"}, entry{name: "2", data: "2"}, entry{name: "3", data: "3"})),
+			lim:  Limits{Depth: 1, Entries: 2, Size: 1 << 20},
+			err:  ErrLimit,
+		},
+		{
+			name: "zip bomb",
+			att:  attachment("bomb.zip", "", zipFile(t, entry{name: "zeros", data: strings.Repeat("0", 1<<20)})),
+			lim:  Limits{Depth: 1, Entries: 10, Size: 1 << 10},
+			err:  ErrLimit,
+		},
+		{
+			name: "tar of directories",
+			att:  attachment("dirs.tar.gz", "", tarGz(t, entry{name: "a/"}, entry{name: "b/"}, entry{name: "c/"}, entry{name: "c/d.txt", data: "d"})),
+			lim:  Limits{Depth: 1, Entries: 2, Size: 1 << 20},
+			err:  ErrLimit,
+		},
+		{
+			name: "tar headers count against the size",
+			att:  attachment("empty.tar.gz", "", tarGz(t, entry{name: "1"}, entry{name: "2"}, entry{name: "3"})),
+			lim:  Limits{Depth: 1, Entries: 10, Size: 1 << 10},
+			err:  ErrLimit,
+		},
+		{
+			name: "password protected",
+			att:  attachment("secret.zip", "", zipFile(t, entry{name: "secret.txt", data: "s", encrypted: true}, entry{name: "readme.txt", data: "r"})),
+			lim:  DefaultLimits,
+			want: "readme.txt=r",
+			err:  ErrEncrypted,
+		},
+		{
+			name: "document stored as a zip",
+			att:  attachment("report.docx", "application/zip", zipFile(t, entry{name: "word/document.xml", data: "<w/>"})),
+			lim:  DefaultLimits,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Expand(tt.att, tt.lim)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("Expand = %v, want %v", err, tt.err)
+			}
+			if got := strings.Join(tree(tt.att.Children, ""), ", "); got != tt.want {
+				t.Errorf("children = %q, want %q", got, tt.want)
+			}
+			if tt.types != "" {
+				var types []string
+				for _, c := range tt.att.Children {
+					types = append(types, c.Type)
+				}
+				if got := strings.Join(types, ", "); got != tt.types {
+					t.Errorf("types = %v, want %v", got, tt.types)
+				}
+			}
+		})
+	}
+}
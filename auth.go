@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/tars47/go-read-mail/auth"
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// Issued token and when it expires
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expiresIn"`
+}
+
+// Logs the user in to prove ownership of the account and issues a token for the user endpoints
+// The imap server of the first token is pinned, later tokens must be requested through it
+func createToken(w http.ResponseWriter, r *http.Request) {
+	var u mail.Mail
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil || u.Addr == "" || u.Pass == "" {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+	user := r.PathValue("user")
+	if u.User == "" {
+		u.User = user
+	}
+	if u.User != user {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+
+	ctx := requestContext(w, r, user)
+	first, err := auth.Check(ctx, user, u.Addr)
+	if err != nil {
+		if errors.Is(err, auth.ErrServer) {
+			send(w, response{Status: http.StatusForbidden, Message: err.Error()})
+			return
+		}
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	if err := u.Login(ctx); err != nil {
+		send(w, response{Status: http.StatusUnauthorized, Message: err.Error()})
+		return
+	}
+	u.Logout()
+	if first {
+		if err := auth.Save(ctx, user, auth.Account{Addr: u.Addr}); err != nil {
+			send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+			return
+		}
+	}
+
+	send(w, response{Status: http.StatusCreated, Message: "Success", Data: tokenResponse{
+		Token:     auth.Issue(user, auth.DefaultTTL),
+		ExpiresIn: int(auth.DefaultTTL.Seconds()),
+	}})
+}
+
+// Requires a token issued to the user of the path, sent as Authorization: Bearer <token>
+func authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || auth.Verify(token, r.PathValue("user")) != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			send(w, response{Status: http.StatusUnauthorized, Message: "Unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Checks that the caller may use the saved state of the user, eg: rules or webhooks
+// A token of the user is enough, otherwise addr must be the pinned imap server, or none pinned yet,
+// logging in to it then proves ownership of the account as for createToken
+// Sends the error response and returns false otherwise
+func owner(ctx context.Context, w http.ResponseWriter, r *http.Request, user, addr string) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && auth.Verify(token, user) == nil {
+		return true
+	}
+	if _, err := auth.Check(ctx, user, addr); err != nil {
+		if errors.Is(err, auth.ErrServer) {
+			send(w, response{Status: http.StatusForbidden, Message: err.Error()})
+			return false
+		}
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return false
+	}
+	return true
+}
+
+// Token of the admin endpoints, read from ADMIN_TOKEN
+var adminToken string
+
+// Requires the admin token, sent as Authorization: Bearer <token>
+// Refuses every request when no admin token is set
+func admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			send(w, response{Status: http.StatusUnauthorized, Message: "Unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tars47/go-read-mail/awss3"
+)
+
+// Name of the account file stored in the user folder
+const DefaultAccount = "account.json"
+
+// Returned when a token is requested through another imap server than the pinned one
+var ErrServer = errors.New("account is registered with another imap server")
+
+// Imap server the user proved ownership with, pinned by the first token
+// Stops anyone running their own imap server from getting a token for the user
+type Account struct {
+	Addr string `json:"addr"`
+}
+
+// Loads the user account from s3, nil if no token was issued yet
+func Load(ctx context.Context, user string) (*Account, error) {
+	buf, err := awss3.DownloadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultAccount))
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var a Account
+	if err := json.NewDecoder(buf).Decode(&a); err != nil {
+		return nil, fmt.Errorf("unable to read account. err: %v", err)
+	}
+	return &a, nil
+}
+
+// Saves the user account to s3
+func Save(ctx context.Context, user string, a Account) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if _, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultAccount), bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("unable to save account. err: %v", err)
+	}
+	return nil
+}
+
+// Checks addr against the imap server pinned for the user
+// Returns true if no server is pinned yet
+func Check(ctx context.Context, user, addr string) (bool, error) {
+	a, err := Load(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	if a == nil {
+		return true, nil
+	}
+	if !strings.EqualFold(a.Addr, addr) {
+		return false, ErrServer
+	}
+	return false, nil
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long an issued token is accepted
+const DefaultTTL = 24 * time.Hour
+
+// Returned for a token that is malformed, forged, expired or issued to another user
+var ErrInvalid = errors.New("invalid or expired token")
+
+// Key signing the tokens, set with SetSecret
+// Defaults to a random key, tokens are then invalid after a restart
+var secret = randomKey()
+
+func randomKey() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Sets the key signing the tokens, shared by every instance behind a load balancer
+func SetSecret(s string) {
+	secret = []byte(s)
+}
+
+// Returns a token proving ownership of the user account until ttl has passed
+// format: base64(user|expiry).base64(hmac)
+func Issue(user string, ttl time.Duration) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user + "|" + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(payload))
+}
+
+// Checks that the token was issued by Issue for the user and has not expired
+func Verify(token, user string) error {
+	payload, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil || !hmac.Equal(got, sign(payload)) {
+		return ErrInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ErrInvalid
+	}
+	// The user may contain | but the expiry never does
+	i := strings.LastIndexByte(string(b), '|')
+	if i < 0 || string(b[:i]) != user {
+		return ErrInvalid
+	}
+	exp, err := strconv.ParseInt(string(b[i+1:]), 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func sign(payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
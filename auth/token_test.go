@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	good := Issue("a|b@example.org", time.Hour)
+	payload, _, _ := strings.Cut(good, ".")
+	_, forged, _ := strings.Cut(Issue("other@example.org", time.Hour), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		user  string
+		ok    bool
+	}{
+		{"issued to the user", good, "a|b@example.org", true},
+		{"issued to another user", good, "b@example.org", false},
+		{"expired", Issue("a|b@example.org", -time.Second), "a|b@example.org", false},
+		{"signature of another token", payload + "." + forged, "a|b@example.org", false},
+		{"no signature", payload, "a|b@example.org", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.token, tt.user); (err == nil) != tt.ok {
+				t.Errorf("Verify = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	// Tokens signed with another secret are rejected
+	defer SetSecret(string(secret))
+	SetSecret("rotated")
+	if err := Verify(good, "a|b@example.org"); err == nil {
+		t.Error("token of the old secret accepted")
+	}
+}
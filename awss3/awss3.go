@@ -3,91 +3,222 @@ package awss3
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/metrics"
+	"github.com/tars47/go-read-mail/retry"
+	"github.com/tars47/go-read-mail/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Used when s3 returns NOSuchKey error
 const NotFound = "NoSuchKey"
 
-// S3 client
-var c *s3.Client
-
-// S3 presign client
-var pc *s3.PresignClient
-
 // S3 default bucket used for all users
 var bucket = "go-read-mail"
 
-// On app startup init aws config and init s3 clients
-func init() {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		log.Fatalf("[s3 init] err loading aws config: %v\n", err)
-	}
+// Expiry of the presigned urls
+const LinkExpires = time.Hour * 168
+
+// Stores the objects, see SetBackend
+// Errors of missing objects must contain NotFound
+type Backend interface {
+	// Stores the object under key, ctype is the Content-Type, the backend default if empty
+	Put(ctx context.Context, key, ctype string, body io.ReadSeeker) error
+	// Opens the object stored under key, caller must close it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Returns the ETag of the object stored under key, the quoted MD5 of its content
+	Head(ctx context.Context, key string) (string, error)
+	// Returns a url to download the object stored under key, valid for expires
+	Link(ctx context.Context, key string, expires time.Duration) (string, error)
+	// Checks that the storage is reachable
+	Ping(ctx context.Context) error
+}
 
-	c = s3.NewFromConfig(cfg)
-	pc = s3.NewPresignClient(c)
+var (
+	mu      sync.Mutex
+	backend Backend
+)
+
+// Sets the backend storing the objects and returns the previous one
+// The s3 bucket is used when no backend is set, eg: tests set an in-memory one, see awss3test
+func SetBackend(b Backend) Backend {
+	mu.Lock()
+	defer mu.Unlock()
+	prev := backend
+	backend = b
+	return prev
+}
+
+// Returns the backend, the aws config is loaded on first use
+func store() Backend {
+	mu.Lock()
+	defer mu.Unlock()
+	if backend == nil {
+		backend = newS3(bucket)
+	}
+	return backend
 }
 
 // Uploads file to s3
-func UploadFile(key string, r io.Reader) (string, error) {
-	_, err := c.PutObject(
-		context.TODO(),
-		&s3.PutObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-			Body:   r,
-		})
+func UploadFile(ctx context.Context, key string, r io.Reader) (string, error) {
+	return UploadFileType(ctx, key, "", r)
+}
+
+// Uploads file to s3 with the given Content-Type, s3 default is used if empty
+// Transient failures are retried, see retry.Storage
+func UploadFileType(ctx context.Context, key, ctype string, r io.Reader) (string, error) {
+	// The body is read again on every attempt
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("couldn't read file %v. err: %w", key, err)
+		}
+		body = bytes.NewReader(b)
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return "", fmt.Errorf("couldn't upload file %v. err: %v", key, err)
+		return "", fmt.Errorf("couldn't read file %v. err: %w", key, err)
+	}
+	end, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read file %v. err: %w", key, err)
+	}
+
+	ctx, span := tracing.Start(ctx, "s3.upload", keyAttr(key), attribute.Int64("bytes", end-start))
+	begin := time.Now()
+	err = retry.Do(ctx, "upload "+key, retry.Storage, func() error {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		return store().Put(ctx, key, ctype, body)
+	})
+	metrics.ObserveStorage("upload", begin, err)
+	tracing.End(span, err)
+	if err != nil {
+		return "", fmt.Errorf("couldn't upload file %v. err: %w", key, err)
 	}
 
 	// Get pre signed url and return the url
-	return GetFileLink(key)
+	return GetFileLink(ctx, key)
+}
+
+// Uploads file to s3 unless the object stored under key has the same content
+// Objects are compared using their ETag, the MD5 of single part uploads
+// Returns the presigned url and true if the upload was skipped
+func UploadFileOnce(ctx context.Context, key string, r io.Reader) (string, bool, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", false, fmt.Errorf("couldn't read file %v. err: %w", key, err)
+	}
+	sum := md5.Sum(b)
+
+	ctx, span := tracing.Start(ctx, "s3.upload_once", keyAttr(key), attribute.Int("bytes", len(b)))
+	begin := time.Now()
+	etag, err := store().Head(ctx, key)
+	// A missing object is the common case, not an error
+	metrics.ObserveStorage("head", begin, nil)
+	if err == nil && strings.Trim(etag, `"`) == hex.EncodeToString(sum[:]) {
+		url, err := GetFileLink(ctx, key)
+		span.SetAttributes(attribute.Bool("deduped", err == nil))
+		tracing.End(span, err)
+		return url, err == nil, err
+	}
+
+	url, err := UploadFile(ctx, key, bytes.NewReader(b))
+	span.SetAttributes(attribute.Bool("deduped", false))
+	tracing.End(span, err)
+	return url, false, err
 }
 
 // DOwnload file from s3, return pointer to bytes.Buffer
-func DownloadFile(key string) (*bytes.Buffer, error) {
+func DownloadFile(ctx context.Context, key string) (*bytes.Buffer, error) {
 	var buf bytes.Buffer
-	// Get the object
-	result, err := c.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+	ctx, span := tracing.Start(ctx, "s3.download", keyAttr(key))
+	begin := time.Now()
+	err := retry.Do(ctx, "download "+key, retry.Storage, func() error {
+		buf.Reset()
+		// Get the object
+		body, err := store().Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		// Read the body into the buffer
+		if _, err := buf.ReadFrom(body); err != nil {
+			logging.From(ctx).Warn("couldn't read file body", "op", "download", "key", key, "err", err)
+			return err
+		}
+		return nil
 	})
+	metrics.ObserveStorage("download", begin, notFound(err))
+	span.SetAttributes(attribute.Int("bytes", buf.Len()))
+	tracing.End(span, notFound(err))
 	if err != nil {
 		return nil, err
 	}
-	defer result.Body.Close()
-	// Read the body
-	body, err := io.ReadAll(result.Body)
+	// Return address of that buffer
+	return &buf, nil
+}
+
+// Download file from s3 without buffering it, caller must close the returned body
+// Only opening the object is retried
+func DownloadStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	ctx, span := tracing.Start(ctx, "s3.download_stream", keyAttr(key))
+	begin := time.Now()
+	err := retry.Do(ctx, "download "+key, retry.Storage, func() error {
+		var err error
+		body, err = store().Get(ctx, key)
+		return err
+	})
+	metrics.ObserveStorage("download", begin, notFound(err))
+	tracing.End(span, notFound(err))
 	if err != nil {
-		log.Printf("[DownloadFile] Couldn't read file body %v. err: %v\n", key, err)
 		return nil, err
 	}
-	// Write to a buffer
-	buf.Write(body)
-	// Return address of that buffer
-	return &buf, nil
+	return body, nil
 }
 
 // Returns pre signed url
-func GetFileLink(key string) (string, error) {
-	purl, err := pc.PresignGetObject(
-		context.Background(),
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		},
-		s3.WithPresignExpires(time.Hour*168))
+func GetFileLink(ctx context.Context, key string) (string, error) {
+	begin := time.Now()
+	url, err := store().Link(ctx, key, LinkExpires)
+	metrics.ObserveStorage("link", begin, err)
 	if err != nil {
 		return "", fmt.Errorf("couldn't get file url %v. err: %v", key, err)
 	}
-	return purl.URL, nil
+	return url, nil
+}
+
+// Checks that the bucket is reachable with the configured credentials
+func Ping(ctx context.Context) error {
+	begin := time.Now()
+	err := store().Ping(ctx)
+	metrics.ObserveStorage("head", begin, err)
+	if err != nil {
+		return fmt.Errorf("couldn't reach bucket %v. err: %v", bucket, err)
+	}
+	return nil
+}
+
+// Span attribute of an object key, user addresses are replaced with their account hash
+func keyAttr(key string) attribute.KeyValue {
+	return attribute.String("s3.key", logging.Scrub(key))
+}
+
+// Returns nil for missing objects, they are expected and not counted as storage errors
+func notFound(err error) error {
+	if err != nil && strings.Contains(err.Error(), NotFound) {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,142 @@
+package awss3test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tars47/go-read-mail/awss3"
+)
+
+// Prefix of the links returned by Bucket
+const LinkPrefix = "https://storage.test/"
+
+// A stored object
+type Object struct {
+	Data        []byte
+	ContentType string
+}
+
+// In-memory awss3.Backend
+type Bucket struct {
+	mu      sync.Mutex
+	objects map[string]Object
+
+	// Called before every operation when set, a returned error fails the operation
+	// op is one of put, get, head, link, ping
+	Fail func(op, key string) error
+}
+
+// Returns an empty bucket
+func New() *Bucket {
+	return &Bucket{objects: make(map[string]Object)}
+}
+
+// Installs a new bucket as the awss3 backend until the test ends
+func Use(t testing.TB) *Bucket {
+	b := New()
+	prev := awss3.SetBackend(b)
+	t.Cleanup(func() { awss3.SetBackend(prev) })
+	return b
+}
+
+// Returns the link of an object, as returned by Link
+func Link(key string) string {
+	return LinkPrefix + url.PathEscape(key)
+}
+
+// Returns the object stored under key, false if missing
+func (b *Bucket) Object(key string) (Object, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[key]
+	return o, ok
+}
+
+// Stores an object, eg: to seed a test
+func (b *Bucket) Set(key string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = Object{Data: data}
+}
+
+// Returns the sorted keys of the stored objects
+func (b *Bucket) Keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.objects))
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *Bucket) Put(ctx context.Context, key, ctype string, body io.ReadSeeker) error {
+	if err := b.fail("put", key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = Object{Data: data, ContentType: ctype}
+	return nil
+}
+
+func (b *Bucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := b.fail("get", key); err != nil {
+		return nil, err
+	}
+	o, ok := b.Object(key)
+	if !ok {
+		return nil, notFound(key)
+	}
+	return io.NopCloser(bytes.NewReader(o.Data)), nil
+}
+
+func (b *Bucket) Head(ctx context.Context, key string) (string, error) {
+	if err := b.fail("head", key); err != nil {
+		return "", err
+	}
+	o, ok := b.Object(key)
+	if !ok {
+		return "", notFound(key)
+	}
+	sum := md5.Sum(o.Data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
+func (b *Bucket) Link(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if err := b.fail("link", key); err != nil {
+		return "", err
+	}
+	return Link(key), nil
+}
+
+func (b *Bucket) Ping(ctx context.Context) error {
+	return b.fail("ping", "")
+}
+
+// Calls Fail if set
+func (b *Bucket) fail(op, key string) error {
+	if b.Fail == nil {
+		return nil
+	}
+	return b.Fail(op, key)
+}
+
+// Error of a missing object, matched by callers on awss3.NotFound
+func notFound(key string) error {
+	return fmt.Errorf("%s: %s", awss3.NotFound, key)
+}
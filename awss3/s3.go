@@ -0,0 +1,103 @@
+package awss3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Backend storing the objects in an s3 bucket
+type s3Backend struct {
+	bucket string
+	// S3 client
+	c *s3.Client
+	// S3 presign client
+	pc *s3.PresignClient
+	// Set when the aws config could not be loaded, returned by every call
+	err error
+}
+
+// Loads the default aws config and inits the s3 clients
+func newS3(bucket string) *s3Backend {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return &s3Backend{bucket: bucket, err: fmt.Errorf("unable to load aws config. err: %v", err)}
+	}
+
+	c := s3.NewFromConfig(cfg)
+	return &s3Backend{bucket: bucket, c: c, pc: s3.NewPresignClient(c)}
+}
+
+func (b *s3Backend) Put(ctx context.Context, key, ctype string, body io.ReadSeeker) error {
+	if b.err != nil {
+		return b.err
+	}
+	in := &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if ctype != "" {
+		in.ContentType = aws.String(ctype)
+	}
+	_, err := b.c.PutObject(ctx, in)
+	return err
+}
+
+func (b *s3Backend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	result, err := b.c.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+func (b *s3Backend) Head(ctx context.Context, key string) (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	head, err := b.c.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(head.ETag), nil
+}
+
+func (b *s3Backend) Link(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	purl, err := b.pc.PresignGetObject(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+		},
+		s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return purl.URL, nil
+}
+
+func (b *s3Backend) Ping(ctx context.Context) error {
+	if b.err != nil {
+		return b.err
+	}
+	_, err := b.c.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.bucket)})
+	return err
+}
@@ -2,86 +2,172 @@ package excel
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/tars47/go-read-mail/logging"
 	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/tracing"
 	"github.com/xuri/excelize/v2"
 )
 
 // Default sheet name
 var s1 = "Sheet1"
 
+// Format of the Date column
+const dateFormat = "2006-01-02 15:04:05 -0700"
+
 // Headers in the excel file
 var headers = []string{"Id", "Date", "From", "Subject", "Cc", "Bcc", "ReplyTo", "Attachments"}
 
 // Creates a new excel file
 // Writes Headers ansd given message rows
 // Writes and returns the data to a bytes.Buffer
-func New(msgs []mail.Message) (*bytes.Buffer, error) {
+// Messages with a Sheet set are written to that sheet instead of the default one
+func New(ctx context.Context, msgs []mail.Message, opt Options) (*bytes.Buffer, error) {
+	ctx, span := tracing.Start(ctx, "excel.New", attribute.Int("messages", len(msgs)))
+	buf, err := newFile(ctx, msgs, opt)
+	if buf != nil {
+		span.SetAttributes(attribute.Int("bytes", buf.Len()))
+	}
+	tracing.End(span, err)
+	return buf, err
+}
+
+// Builds the file returned by New
+func newFile(ctx context.Context, msgs []mail.Message, opt Options) (*bytes.Buffer, error) {
 	f := excelize.NewFile()
 	defer f.Close()
 
-	setHeaders(f)
+	cols := opt.columns()
+	for _, g := range bySheet(opt.rows(msgs)) {
+		if g.sheet != s1 {
+			if _, err := f.NewSheet(g.sheet); err != nil {
+				logging.From(ctx).Error("err creating sheet", "op", "excel.New", "sheet", g.sheet, "err", err)
+				return nil, err
+			}
+		}
+		setHeaders(f, g.sheet, cols)
+
+		setRows(f, g.sheet, g.msgs, cols)
+	}
 
-	setRows(f, msgs)
+	if err := setMeetings(f, opt.rows(msgs), nil); err != nil {
+		logging.From(ctx).Error("err writing meetings", "op", "excel.New", "err", err)
+		return nil, err
+	}
 
-	return save(f)
+	return save(ctx, f)
 }
 
 // Reads the excel data from the given reader
-// Grabs the B2 cell value (recent message date)
-// Parses date and returns time.Time
-func GetRecentMsgDate(r io.Reader) time.Time {
+// Grabs the B2 cell value (recent message date) of every sheet
+// Parses dates and returns the latest time.Time
+func GetRecentMsgDate(ctx context.Context, r io.Reader) time.Time {
 	// Read from r
 	f, err := excelize.OpenReader(r)
 	if err != nil {
-		log.Printf("[GetRecentMsgDate] err reading: %v\n", err)
+		logging.From(ctx).Error("err reading", "op", "excel.GetRecentMsgDate", "err", err)
 		return time.Time{}
 	}
 	defer f.Close()
 
-	// Grab the B2 cell value(recent message date)
-	dtstr, err := f.GetCellValue(s1, "B2")
-	if err != nil {
-		log.Printf("[GetRecentMsgDate] err getting B2 cell value: %v\n", err)
-		return time.Time{}
-	}
+	var recent time.Time
+	for _, sheet := range f.GetSheetList() {
+		if sheet == Meetings {
+			continue
+		}
+		// Grab the B2 cell value(recent message date)
+		dtstr, err := f.GetCellValue(sheet, "B2")
+		if err != nil {
+			logging.From(ctx).Error("err getting B2 cell value", "op", "excel.GetRecentMsgDate", "sheet", sheet, "err", err)
+			continue
+		}
+		if dtstr == "" {
+			continue
+		}
 
-	// Parse the time to a format
-	t, err := time.Parse("2006-01-02 15:04:05 -0700", dtstr)
-	if err != nil {
-		log.Printf("[GetRecentMsgDate] err parsing time: %v\n", err)
-		return time.Time{}
+		// Parse the time to a format
+		t, err := time.Parse(dateFormat, dtstr)
+		if err != nil {
+			logging.From(ctx).Error("err parsing time", "op", "excel.GetRecentMsgDate", "err", err)
+			continue
+		}
+		if t.After(recent) {
+			recent = t
+		}
 	}
 	// Returns time.Time
-	return t
+	return recent
 }
 
 // Prepends the messages rows to the data read from r
-func PrependRows(r io.Reader, msgs []mail.Message) (*bytes.Buffer, error) {
+// Optional columns missing in the file are inserted before the Attachments column
+func PrependRows(ctx context.Context, r io.Reader, msgs []mail.Message, opt Options) (*bytes.Buffer, error) {
+	ctx, span := tracing.Start(ctx, "excel.PrependRows", attribute.Int("messages", len(msgs)))
+	buf, err := prependRows(ctx, r, msgs, opt)
+	if buf != nil {
+		span.SetAttributes(attribute.Int("bytes", buf.Len()))
+	}
+	tracing.End(span, err)
+	return buf, err
+}
+
+// Builds the file returned by PrependRows
+func prependRows(ctx context.Context, r io.Reader, msgs []mail.Message, opt Options) (*bytes.Buffer, error) {
 	f, err := excelize.OpenReader(r)
 	if err != nil {
-		log.Printf("[PrependRows] err reading: %v\n", err)
+		logging.From(ctx).Error("err reading", "op", "excel.PrependRows", "err", err)
 		return nil, err
 	}
 	defer f.Close()
 
-	err = f.InsertRows(s1, 2, len(msgs))
-	if err != nil {
-		log.Printf("[PrependRows] err inserting rows: %v\n", err)
-		return nil, err
+	// Rows added above the existing rows of every sheet
+	shift := make(map[string]int)
+	for _, g := range bySheet(opt.rows(msgs)) {
+		// Sheets seen for the first time are created with the option columns
+		if idx, _ := f.GetSheetIndex(g.sheet); idx == -1 {
+			if _, err := f.NewSheet(g.sheet); err != nil {
+				logging.From(ctx).Error("err creating sheet", "op", "excel.PrependRows", "sheet", g.sheet, "err", err)
+				return nil, err
+			}
+			cols := opt.columns()
+			setHeaders(f, g.sheet, cols)
+			setRows(f, g.sheet, g.msgs, cols)
+			continue
+		}
+
+		cols, err := addColumns(f, g.sheet, opt)
+		if err != nil {
+			logging.From(ctx).Error("err adding columns", "op", "excel.PrependRows", "err", err)
+			return nil, err
+		}
+
+		err = f.InsertRows(g.sheet, 2, len(g.msgs))
+		if err != nil {
+			logging.From(ctx).Error("err inserting rows", "op", "excel.PrependRows", "err", err)
+			return nil, err
+		}
+		shift[g.sheet] = len(g.msgs)
+
+		setRows(f, g.sheet, g.msgs, cols)
 	}
 
-	setRows(f, msgs)
+	if err := setMeetings(f, opt.rows(msgs), shift); err != nil {
+		logging.From(ctx).Error("err writing meetings", "op", "excel.PrependRows", "err", err)
+		return nil, err
+	}
 
-	return save(f)
+	return save(ctx, f)
 }
 
-// Writes the default headers
-func setHeaders(f *excelize.File) {
+// Writes the given headers to the sheet
+func setHeaders(f *excelize.File, sheet string, cols []string) {
 	// Header style
 	style, _ := f.NewStyle(
 		&excelize.Style{
@@ -89,30 +175,32 @@ func setHeaders(f *excelize.File) {
 			Font:      &excelize.Font{Bold: true, Color: "#000080"},
 		})
 
-	for i, header := range headers {
-		col := fmt.Sprint(string(rune(65 + i)))
+	for i, header := range cols {
+		col, _ := excelize.ColumnNumberToName(i + 1)
 		cell := fmt.Sprintf("%s%d", col, 1)
 
-		f.SetCellValue(s1, cell, header)
-		f.SetCellStyle(s1, cell, cell, style)
+		f.SetCellValue(sheet, cell, header)
+		f.SetCellStyle(sheet, cell, cell, style)
+		f.SetColWidth(sheet, col, col, colWidth(header))
+	}
+}
 
-		switch header {
-		case "Id":
-			f.SetColWidth(s1, col, col, 100)
-		case "Date":
-			f.SetColWidth(s1, col, col, 30)
-		case "From":
-			f.SetColWidth(s1, col, col, 50)
-		case "Subject":
-			f.SetColWidth(s1, col, col, 100)
-		default:
-			f.SetColWidth(s1, col, col, 50)
-		}
+// Returns the width of a column
+func colWidth(header string) float64 {
+	switch header {
+	case "Id", "Subject", "Snippet", "Warnings":
+		return 100
+	case "Date", "Received":
+		return 30
+	case "Read", "Size":
+		return 15
+	default:
+		return 50
 	}
 }
 
-// Writes the message rows
-func setRows(f *excelize.File, msgs []mail.Message) {
+// Writes the message rows to the sheet in the given column order
+func setRows(f *excelize.File, sheet string, msgs []mail.Message, cols []string) {
 	// default style
 	style, _ := f.NewStyle(
 		&excelize.Style{
@@ -125,57 +213,150 @@ func setRows(f *excelize.File, msgs []mail.Message) {
 		Font:      &excelize.Font{Color: "#1265BE", Underline: "single"},
 	})
 
-	f.SetRowHeight(s1, 1, 15)
+	f.SetRowHeight(sheet, 1, 15)
 
 	for i, msg := range msgs {
 
 		dataRow := i + 2
-		f.SetRowHeight(s1, dataRow, 25)
-
-		for j, h := range headers {
-
-			colRune := rune(65 + j)
-			cell := fmt.Sprintf("%s%d", string(colRune), dataRow)
-			f.SetCellStyle(s1, cell, cell, style)
-
-			switch h {
-			case "Id":
-				f.SetCellValue(s1, cell, msg.Id)
-			case "Date":
-				f.SetCellValue(s1, cell, msg.Date.Format("2006-01-02 15:04:05 -0700"))
-			case "From":
-				f.SetCellValue(s1, cell, mail.ToString(msg.From))
-			case "Subject":
-				f.SetCellValue(s1, cell, msg.Subject)
-			case "Cc":
-				f.SetCellValue(s1, cell, mail.ToString(msg.Cc))
-			case "Bcc":
-				f.SetCellValue(s1, cell, mail.ToString(msg.Bcc))
-			case "ReplyTo":
-				f.SetCellValue(s1, cell, mail.ToString(msg.ReplyTo))
-			case "Attachments":
-				// Loop each attachment and set the hyperlink
-				// If multiple attachments are present,
-				// I am storing each attachment in new cells statting from H column
-				// As I could not figure out a way to write comma seperated links in one cell
-				for k, att := range msg.Attachment {
-					acell := fmt.Sprintf("%s%d", string(rune(65+j+k)), dataRow)
-					f.SetCellHyperLink(s1, acell, att.Url, "External")
-					f.SetCellValue(s1, acell, att.Name)
-					f.SetCellStyle(s1, acell, acell, linkStyle)
-				}
+		f.SetRowHeight(sheet, dataRow, 25)
 
+		// Each attachment is stored in a new cell starting from H column
+		// As I could not figure out a way to write comma seperated links in one cell
+		for j, c := range rowCells(msg, cols) {
+			cell, _ := excelize.CoordinatesToCellName(j+1, dataRow)
+			if c.Link == "" {
+				f.SetCellValue(sheet, cell, c.Value)
+				f.SetCellStyle(sheet, cell, cell, style)
+				continue
+			}
+			f.SetCellHyperLink(sheet, cell, c.Link, "External")
+			f.SetCellValue(sheet, cell, c.Value)
+			f.SetCellStyle(sheet, cell, cell, linkStyle)
+		}
+	}
+}
+
+// Returns the cells of a message row in the given column order
+// Attachments are appended as linked cells after the other columns
+func rowCells(msg mail.Message, cols []string) []Cell {
+	cells := make([]Cell, 0, len(cols)+len(msg.Attachment))
+	for _, h := range cols {
+		switch h {
+		case "Id":
+			cells = append(cells, Cell{Value: msg.Id})
+		case "Date":
+			cells = append(cells, Cell{Value: msg.Date.Format(dateFormat)})
+		case "From":
+			cells = append(cells, Cell{Value: mail.ToString(msg.From)})
+		case "Subject":
+			cells = append(cells, Cell{Value: msg.Subject})
+		case "Cc":
+			cells = append(cells, Cell{Value: mail.ToString(msg.Cc)})
+		case "Bcc":
+			cells = append(cells, Cell{Value: mail.ToString(msg.Bcc)})
+		case "ReplyTo":
+			cells = append(cells, Cell{Value: mail.ToString(msg.ReplyTo)})
+		case "Snippet":
+			cells = append(cells, Cell{Value: snippet(msg)})
+		case "Tag":
+			cells = append(cells, Cell{Value: msg.Tag})
+		case "Parent":
+			cells = append(cells, Cell{Value: msg.Parent})
+		case "Read", "Flags", "Received", "Size", "Labels", "Thread":
+			cells = append(cells, Cell{Value: imapCell(msg, h)})
+		case "DKIM":
+			cells = append(cells, Cell{Value: msg.Auth.Dkim})
+		case "SPF":
+			cells = append(cells, Cell{Value: msg.Auth.Spf})
+		case "DMARC":
+			cells = append(cells, Cell{Value: msg.Auth.Dmarc})
+		case "S/MIME":
+			cells = append(cells, Cell{Value: msg.Auth.Smime})
+		case "Warnings":
+			cells = append(cells, Cell{Value: strings.Join(msg.Warnings, "; ")})
+		case "Body":
+			if msg.BodyUrl == "" {
+				cells = append(cells, Cell{Value: failed("body.html", msg.BodyError)})
+				continue
+			}
+			cells = append(cells, Cell{Value: "body.html", Link: msg.BodyUrl})
+		case "Attachments":
+			for _, att := range msg.Attachment {
+				cells = attachmentCells(cells, att.Name, att)
 			}
 		}
 	}
+	return cells
+}
+
+// Appends the cell of an attachment and the cells of the files expanded from it
+// Expanded files are named after their archive, eg: invoices.zip/march.pdf
+// Archives that could not be fully expanded are marked with the reason
+func attachmentCells(cells []Cell, name string, att mail.Attachment) []Cell {
+	value := name
+	if att.ArchiveError != nil {
+		value = fmt.Sprintf("%s (%v)", name, att.ArchiveError)
+	}
+	if att.Filtered != "" {
+		value = fmt.Sprintf("%s (not uploaded: %s)", name, att.Filtered)
+	}
+	if att.Threat != "" {
+		value = fmt.Sprintf("%s (infected: %s, quarantined)", name, att.Threat)
+	}
+	if att.Url == "" {
+		cells = append(cells, Cell{Value: failed(value, att.Error)})
+	} else {
+		cells = append(cells, Cell{Value: value, Link: att.Url})
+	}
+	for _, c := range att.Children {
+		cells = attachmentCells(cells, name+"/"+c.Name, c)
+	}
+	return cells
+}
+
+// Returns the cell value of a file that has no link
+// Files that failed to upload are marked so the cell is not mistaken for a skipped upload
+func failed(name string, err error) string {
+	if err == nil {
+		return name
+	}
+	return name + " (upload failed)"
+}
+
+// Messages of a single sheet
+type sheetMsgs struct {
+	sheet string
+	msgs  []mail.Message
+}
+
+// Groups messages by their Sheet, keeping their order
+// Messages without a Sheet go to the default sheet
+func bySheet(msgs []mail.Message) []sheetMsgs {
+	// The default sheet always exists, even without messages
+	groups := []sheetMsgs{{sheet: s1}}
+	idx := map[string]int{s1: 0}
+	for _, msg := range msgs {
+		sheet := msg.Sheet
+		if sheet == "" {
+			sheet = s1
+		}
+		i, ok := idx[sheet]
+		if !ok {
+			i = len(groups)
+			idx[sheet] = i
+			groups = append(groups, sheetMsgs{sheet: sheet})
+		}
+		groups[i].msgs = append(groups[i].msgs, msg)
+	}
+	return groups
 }
 
 // Writes to buffer and returns pointer to bytes buffer
-func save(f *excelize.File) (*bytes.Buffer, error) {
+func save(ctx context.Context, f *excelize.File) (*bytes.Buffer, error) {
 	// Write to a buffer
 	buf, err := f.WriteToBuffer()
 	if err != nil {
-		log.Printf("[save] err writing to buffer: %v\n", err)
+		logging.From(ctx).Error("err writing to buffer", "op", "excel.save", "err", err)
 		return nil, err
 	}
 
@@ -0,0 +1,196 @@
+package excel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/tracing"
+	"github.com/xuri/excelize/v2"
+)
+
+// Headers of the imap attribute columns
+var imapHeaders = []string{"Read", "Flags", "Received", "Size", "Labels", "Thread"}
+
+// Columns rewritten when the flags of an exported message change
+var flagHeaders = []string{"Read", "Flags", "Labels"}
+
+// Returns the value of an imap attribute column
+// Embedded messages have no imap attributes, their cells are left empty
+func imapCell(msg mail.Message, header string) string {
+	if msg.Uid == 0 {
+		return ""
+	}
+	switch header {
+	case "Read":
+		if msg.Seen() {
+			return "Yes"
+		}
+		return "No"
+	case "Flags":
+		return strings.Join(msg.Flags, " ")
+	case "Received":
+		if msg.InternalDate.IsZero() {
+			return ""
+		}
+		return msg.InternalDate.Format(dateFormat)
+	case "Size":
+		return strconv.FormatUint(uint64(msg.Size), 10)
+	case "Labels":
+		return strings.Join(msg.Labels, ", ")
+	case "Thread":
+		return msg.ThreadId
+	}
+	return ""
+}
+
+// Rewrites the Read, Flags and Labels cells of the rows of the changed messages
+// Rows are matched on the Id column, sheets without flag columns are left as is
+// Returns the updated file and the number of rows updated
+func UpdateFlags(ctx context.Context, r io.Reader, changes []mail.Message) (*bytes.Buffer, int, error) {
+	ctx, span := tracing.Start(ctx, "excel.UpdateFlags", attribute.Int("changes", len(changes)))
+	buf, n, err := updateFlags(ctx, r, changes)
+	span.SetAttributes(attribute.Int("rows", n))
+	tracing.End(span, err)
+	return buf, n, err
+}
+
+// Rewrites the file for UpdateFlags
+func updateFlags(ctx context.Context, r io.Reader, changes []mail.Message) (*bytes.Buffer, int, error) {
+	f, err := excelize.OpenReader(r)
+	if err != nil {
+		logging.From(ctx).Error("err reading", "op", "excel.UpdateFlags", "err", err)
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	byId := changesById(changes)
+	n := 0
+	for _, sheet := range f.GetSheetList() {
+		if sheet == Meetings {
+			continue
+		}
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			logging.From(ctx).Error("err reading rows", "op", "excel.UpdateFlags", "sheet", sheet, "err", err)
+			return nil, 0, err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		id := slices.Index(rows[0], "Id")
+		if id < 0 {
+			continue
+		}
+
+		for i, row := range rows[1:] {
+			if id >= len(row) {
+				continue
+			}
+			msg, ok := byId[row[id]]
+			if !ok {
+				continue
+			}
+			for _, h := range flagHeaders {
+				col := slices.Index(rows[0], h)
+				if col < 0 {
+					continue
+				}
+				cell, _ := excelize.CoordinatesToCellName(col+1, i+2)
+				f.SetCellValue(sheet, cell, imapCell(msg, h))
+			}
+			n++
+		}
+	}
+
+	buf, err := save(ctx, f)
+	return buf, n, err
+}
+
+// Copies the manifest read from r to w
+// Rewrites the Read, Flags and Labels cells of the rows of the changed messages
+// Returns the number of rows updated
+func UpdateManifest(ctx context.Context, r io.Reader, w io.Writer, changes []mail.Message) (int, error) {
+	ctx, span := tracing.Start(ctx, "excel.UpdateManifest", attribute.Int("changes", len(changes)))
+	n, err := updateManifest(ctx, r, w, changes)
+	span.SetAttributes(attribute.Int("rows", n))
+	tracing.End(span, err)
+	return n, err
+}
+
+// Copies the manifest for UpdateManifest
+func updateManifest(ctx context.Context, r io.Reader, w io.Writer, changes []mail.Message) (int, error) {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+
+	cols, first, err := readManifestHeaders(dec)
+	if err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		logging.From(ctx).Error("err reading manifest", "op", "excel.UpdateManifest", "err", err)
+		return 0, err
+	}
+	if err := enc.Encode(cols); err != nil {
+		return 0, err
+	}
+
+	byId := changesById(changes)
+	id := slices.Index(cols, "Id")
+	n := 0
+	update := func(cells []Cell) []Cell {
+		if id < 0 || id >= len(cells) {
+			return cells
+		}
+		msg, ok := byId[cells[id].Value]
+		if !ok {
+			return cells
+		}
+		for _, h := range flagHeaders {
+			// Attachments are the last header, the cells after it are attachments too
+			if col := slices.Index(cols, h); col >= 0 && col < len(cells) {
+				cells[col] = Cell{Value: imapCell(msg, h)}
+			}
+		}
+		n++
+		return cells
+	}
+
+	if first != nil {
+		if err := enc.Encode(update(first)); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		var cells []Cell
+		err := dec.Decode(&cells)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logging.From(ctx).Error("err reading manifest", "op", "excel.UpdateManifest", "err", err)
+			return 0, err
+		}
+		if err := enc.Encode(update(cells)); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Indexes the changed messages by Id
+func changesById(changes []mail.Message) map[string]mail.Message {
+	byId := make(map[string]mail.Message, len(changes))
+	for _, msg := range changes {
+		if msg.Id != "" {
+			byId[msg.Id] = msg
+		}
+	}
+	return byId
+}
@@ -0,0 +1,161 @@
+package excel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/xuri/excelize/v2"
+)
+
+// Sheet listing the calendar events of the messages
+const Meetings = "Meetings"
+
+// Headers of the Meetings sheet
+var meetingHeaders = []string{
+	"Message", "Method", "Uid", "Summary", "Organizer", "Attendees",
+	"Start", "End", "Timezone", "Location", "Recurrence",
+}
+
+// A row of the Meetings sheet of a large workbook, the meetings file holds one per line
+type MeetingRow struct {
+	// Id of the message
+	Id string `json:"id"`
+	// Position of the message row among all message rows, 0 is the latest
+	Row int `json:"row"`
+	// Values of the row without the Message column
+	Cells []string `json:"c"`
+}
+
+// Format of the Start and End columns of all day events
+const dayFormat = "2006-01-02"
+
+// Writes the events of the messages to the Meetings sheet, newest first
+// msgs are the message rows in the order written to their sheets
+// Rows already in the sheet are moved down, their links are moved by shift, the rows added above each sheet
+// The sheet is only created when there are events
+func setMeetings(f *excelize.File, msgs []mail.Message, shift map[string]int) error {
+	n := 0
+	for _, msg := range msgs {
+		n += len(msg.Events)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	if idx, _ := f.GetSheetIndex(Meetings); idx == -1 {
+		if _, err := f.NewSheet(Meetings); err != nil {
+			return err
+		}
+		setHeaders(f, Meetings, meetingHeaders)
+	} else {
+		if err := f.InsertRows(Meetings, 2, n); err != nil {
+			return err
+		}
+		if err := relink(f, n+2, shift); err != nil {
+			return err
+		}
+	}
+
+	style, _ := f.NewStyle(
+		&excelize.Style{
+			Alignment: &excelize.Alignment{Horizontal: "center", WrapText: true},
+		},
+	)
+	linkStyle, _ := f.NewStyle(&excelize.Style{
+		Alignment: &excelize.Alignment{Horizontal: "center"},
+		Font:      &excelize.Font{Color: "#1265BE", Underline: "single"},
+	})
+
+	row := 2
+	// Rows written so far in every sheet
+	written := make(map[string]int)
+	for _, msg := range msgs {
+		sheet := msg.Sheet
+		if sheet == "" {
+			sheet = s1
+		}
+		written[sheet]++
+		for _, e := range msg.Events {
+			f.SetRowHeight(Meetings, row, 25)
+			for j, v := range meetingCells(e) {
+				cell, _ := excelize.CoordinatesToCellName(j+2, row)
+				f.SetCellValue(Meetings, cell, v)
+				f.SetCellStyle(Meetings, cell, cell, style)
+			}
+
+			// Links to the message row, the first row holds the headers
+			cell, _ := excelize.CoordinatesToCellName(1, row)
+			f.SetCellValue(Meetings, cell, msg.Id)
+			f.SetCellHyperLink(Meetings, cell, location(sheet, written[sheet]+1), "Location")
+			f.SetCellStyle(Meetings, cell, cell, linkStyle)
+			row++
+		}
+	}
+	return nil
+}
+
+// Moves the links of the Meetings rows starting at row from
+// by the number of rows added above the linked message in its sheet
+func relink(f *excelize.File, from int, shift map[string]int) error {
+	rows, err := f.GetRows(Meetings)
+	if err != nil {
+		return err
+	}
+	for r := from; r <= len(rows); r++ {
+		cell, _ := excelize.CoordinatesToCellName(1, r)
+		ok, link, err := f.GetCellHyperLink(Meetings, cell)
+		if err != nil || !ok {
+			continue
+		}
+		sheet, row, ok := parseLocation(link)
+		if !ok || shift[sheet] == 0 {
+			continue
+		}
+		f.SetCellHyperLink(Meetings, cell, location(sheet, row+shift[sheet]), "Location")
+	}
+	return nil
+}
+
+// Returns the location of the first cell of a row eg: 'Sheet1'!A5
+func location(sheet string, row int) string {
+	return fmt.Sprintf("'%s'!A%d", strings.ReplaceAll(sheet, "'", "''"), row)
+}
+
+// Parses a location written by location
+func parseLocation(loc string) (string, int, bool) {
+	i := strings.LastIndex(loc, "!A")
+	if i < 0 {
+		return "", 0, false
+	}
+	row, err := strconv.Atoi(loc[i+2:])
+	if err != nil {
+		return "", 0, false
+	}
+	sheet := loc[:i]
+	if len(sheet) >= 2 && sheet[0] == '\'' && sheet[len(sheet)-1] == '\'' {
+		sheet = strings.ReplaceAll(sheet[1:len(sheet)-1], "''", "'")
+	}
+	return sheet, row, true
+}
+
+// Returns the values of an event row, without the Message column
+func meetingCells(e mail.Event) []string {
+	format := dateFormat
+	if e.AllDay {
+		format = dayFormat
+	}
+
+	start, end := "", ""
+	if !e.Start.IsZero() {
+		start = e.Start.Format(format)
+	}
+	if !e.End.IsZero() {
+		end = e.End.Format(format)
+	}
+	return []string{
+		e.Method, e.Uid, e.Summary, e.Organizer, strings.Join(e.Attendees, ", "),
+		start, end, e.Timezone, e.Location, e.Rrule,
+	}
+}
@@ -0,0 +1,173 @@
+package excel
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/xuri/excelize/v2"
+)
+
+// Number of characters kept in the Snippet column
+const snippetLen = 200
+
+// Optional columns of the excel file
+type Options struct {
+	// Adds a Snippet column with the beginning of the attachments text
+	Snippet bool
+	// Adds a Tag column with the label set by rules
+	Tag bool
+	// Adds a Body column linking the sanitized html body
+	Body bool
+	// Writes embedded messages as child rows below their parent
+	// Adds a Parent column holding the Id of the parent message
+	Embedded bool
+	// Adds Read, Flags, Received, Size, Labels and Thread columns with the imap attributes
+	Imap bool
+	// Adds DKIM, SPF, DMARC and S/MIME columns with the authenticity checks
+	Auth bool
+	// Adds a Warnings column listing the decoding fallbacks used while parsing
+	Warnings bool
+}
+
+// Headers of the authenticity check columns
+var authHeaders = []string{"DKIM", "SPF", "DMARC", "S/MIME"}
+
+// Returns the headers for the given options
+// Optional columns are placed before Attachments, which is always the last column
+func (o Options) columns() []string {
+	cols := slices.Clone(headers[:len(headers)-1])
+	if o.Imap {
+		cols = append(cols, imapHeaders...)
+	}
+	if o.Embedded {
+		cols = append(cols, "Parent")
+	}
+	if o.Body {
+		cols = append(cols, "Body")
+	}
+	if o.Auth {
+		cols = append(cols, authHeaders...)
+	}
+	if o.Snippet {
+		cols = append(cols, "Snippet")
+	}
+	if o.Tag {
+		cols = append(cols, "Tag")
+	}
+	if o.Warnings {
+		cols = append(cols, "Warnings")
+	}
+	return append(cols, "Attachments")
+}
+
+// Reads the headers of an existing sheet
+// Inserts the optional columns it is missing before the Attachments column
+// Returns the resulting headers
+func addColumns(f *excelize.File, sheet string, opt Options) ([]string, error) {
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		return nil, err
+	}
+	var cols []string
+	if rows.Next() {
+		cols, err = rows.Columns()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Files without headers are assumed to have the default ones
+	if len(cols) == 0 || cols[len(cols)-1] != "Attachments" {
+		cols = slices.Clone(headers)
+	}
+
+	style, _ := f.NewStyle(
+		&excelize.Style{
+			Alignment: &excelize.Alignment{Horizontal: "center"},
+			Font:      &excelize.Font{Bold: true, Color: "#000080"},
+		})
+
+	for _, c := range opt.columns() {
+		if slices.Contains(cols, c) {
+			continue
+		}
+		at := len(cols) - 1
+		name, _ := excelize.ColumnNumberToName(at + 1)
+		if err := f.InsertCols(sheet, name, 1); err != nil {
+			return nil, err
+		}
+		f.SetCellValue(sheet, name+"1", c)
+		f.SetCellStyle(sheet, name+"1", name+"1", style)
+		f.SetColWidth(sheet, name, name, colWidth(c))
+		cols = slices.Insert(cols, at, c)
+	}
+	return cols, nil
+}
+
+// Moves the cells of a row written with the from headers to the to headers
+// Columns missing in from are left empty, attachments are kept at the end
+func remap(cells []Cell, from, to []string) []Cell {
+	if slices.Equal(from, to) {
+		return cells
+	}
+
+	idx := make(map[string]int, len(from))
+	for i, h := range from {
+		idx[h] = i
+	}
+
+	out := make([]Cell, 0, len(to)+len(cells)-len(from))
+	for _, h := range to[:len(to)-1] {
+		if i, ok := idx[h]; ok && i < len(cells) {
+			out = append(out, cells[i])
+			continue
+		}
+		out = append(out, Cell{})
+	}
+	if at := len(from) - 1; at < len(cells) {
+		out = append(out, cells[at:]...)
+	}
+	return out
+}
+
+// Returns the messages to write, in row order
+// With Embedded set, embedded messages follow their parent with Parent and Sheet set
+func (o Options) rows(msgs []mail.Message) []mail.Message {
+	if !o.Embedded {
+		return msgs
+	}
+
+	var out []mail.Message
+	var add func(msg mail.Message, parent, sheet string)
+	add = func(msg mail.Message, parent, sheet string) {
+		msg.Parent = parent
+		if parent != "" {
+			msg.Sheet = sheet
+		}
+		out = append(out, msg)
+		for _, e := range msg.Embedded {
+			add(e, msg.Id, msg.Sheet)
+		}
+	}
+	for _, msg := range msgs {
+		add(msg, "", "")
+	}
+	return out
+}
+
+// Returns the beginning of the text of all attachments
+func snippet(msg mail.Message) string {
+	texts := make([]string, 0, len(msg.Attachment))
+	for _, att := range msg.Attachment {
+		if t := strings.Join(strings.Fields(att.Text), " "); t != "" {
+			texts = append(texts, t)
+		}
+	}
+
+	r := []rune(strings.Join(texts, " | "))
+	if len(r) > snippetLen {
+		return string(r[:snippetLen]) + "..."
+	}
+	return string(r)
+}
@@ -0,0 +1,529 @@
+package excel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/tracing"
+	"github.com/xuri/excelize/v2"
+)
+
+// Maximum number of rows allowed in a single excel sheet
+const MaxRows = 1048576
+
+// Excel formulas do not allow string literals longer than 255 characters
+const maxFormulaStr = 255
+
+// A single cell of a message row
+// The first line of the manifest holds the json encoded headers,
+// each following line is a json encoded []Cell
+type Cell struct {
+	Value string `json:"v"`
+	Link  string `json:"l,omitempty"`
+}
+
+// Rebuilds the excel file using excelize StreamWriter
+// Writes the given messages first followed by the rows read from the old manifest,
+// so rows stay in date order, latest first
+// Rolls over to a new sheet when a sheet reaches MaxRows
+// Rows of the old manifest are moved to the columns of the given options
+// Message Sheet is ignored, every row goes to the numbered sheets
+// The Meetings sheet gets the events of the given messages followed by the rows of the old meetings file
+// Writes the excel file to xw, the new manifest to mw and the new meetings file to ew
+// manifest and meetings can be nil, so can mw and ew
+// Returns the total number of message rows written
+func Rebuild(ctx context.Context, xw, mw, ew io.Writer, msgs []mail.Message, manifest, meetings io.Reader, opt Options) (int, error) {
+	ctx, span := tracing.Start(ctx, "excel.Rebuild", attribute.Int("messages", len(msgs)))
+	n, err := rebuild(ctx, xw, mw, ew, msgs, manifest, meetings, opt)
+	span.SetAttributes(attribute.Int("rows", n))
+	tracing.End(span, err)
+	return n, err
+}
+
+// Writes the files for Rebuild
+func rebuild(ctx context.Context, xw, mw, ew io.Writer, msgs []mail.Message, manifest, meetings io.Reader, opt Options) (int, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	cols := opt.columns()
+	sw := &streamSheets{f: f, cols: cols}
+	if mw == nil {
+		mw = io.Discard
+	}
+	enc := json.NewEncoder(mw)
+	if err := enc.Encode(cols); err != nil {
+		return 0, err
+	}
+
+	write := func(cells []Cell) error {
+		if err := sw.setRow(cells); err != nil {
+			return err
+		}
+		return enc.Encode(cells)
+	}
+
+	// New messages go on top
+	rows := opt.rows(msgs)
+	for _, msg := range rows {
+		if err := write(rowCells(msg, cols)); err != nil {
+			logging.From(ctx).Error("err writing row", "op", "excel.Rebuild", "err", err)
+			return 0, err
+		}
+	}
+
+	// Followed by the rows that were already exported
+	if manifest != nil {
+		dec := json.NewDecoder(manifest)
+		old, first, err := readManifestHeaders(dec)
+		if err != nil && err != io.EOF {
+			logging.From(ctx).Error("err reading manifest", "op", "excel.Rebuild", "err", err)
+			return 0, err
+		}
+		if first != nil {
+			if err := write(remap(first, old, cols)); err != nil {
+				logging.From(ctx).Error("err writing row", "op", "excel.Rebuild", "err", err)
+				return 0, err
+			}
+		}
+		for err == nil {
+			var cells []Cell
+			err = dec.Decode(&cells)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				logging.From(ctx).Error("err reading manifest", "op", "excel.Rebuild", "err", err)
+				return 0, err
+			}
+			if err := write(remap(cells, old, cols)); err != nil {
+				logging.From(ctx).Error("err writing row", "op", "excel.Rebuild", "err", err)
+				return 0, err
+			}
+		}
+	}
+
+	if err := sw.flush(); err != nil {
+		logging.From(ctx).Error("err flushing sheet", "op", "excel.Rebuild", "err", err)
+		return 0, err
+	}
+
+	// Rows of the old meetings move down by the message rows added above them
+	if err := sw.meetings(ew, rows, meetings, len(rows)); err != nil {
+		logging.From(ctx).Error("err writing meetings", "op", "excel.Rebuild", "err", err)
+		return 0, err
+	}
+
+	if err := f.Write(xw); err != nil {
+		logging.From(ctx).Error("err writing excel", "op", "excel.Rebuild", "err", err)
+		return 0, err
+	}
+
+	return sw.total, nil
+}
+
+// Reads the first row of the manifest
+// Parses the Date column and returns time.Time
+func ManifestRecentDate(ctx context.Context, r io.Reader) time.Time {
+	dec := json.NewDecoder(r)
+	cols, cells, err := readManifestHeaders(dec)
+	if err == nil && cells == nil {
+		err = dec.Decode(&cells)
+	}
+	if err != nil {
+		logging.From(ctx).Error("err reading manifest", "op", "excel.ManifestRecentDate", "err", err)
+		return time.Time{}
+	}
+
+	for i, h := range cols {
+		if h != "Date" || i >= len(cells) {
+			continue
+		}
+		t, err := time.Parse(dateFormat, cells[i].Value)
+		if err != nil {
+			logging.From(ctx).Error("err parsing time", "op", "excel.ManifestRecentDate", "err", err)
+			return time.Time{}
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Reads an excel file created by New or PrependRows
+// Writes all its rows to w in the manifest format and the rows of its Meetings sheet to ew
+// Used once to move an existing user to the streaming writer
+func WriteManifest(ctx context.Context, r io.Reader, w, ew io.Writer) error {
+	ctx, span := tracing.Start(ctx, "excel.WriteManifest")
+	err := writeManifest(ctx, r, w, ew)
+	tracing.End(span, err)
+	return err
+}
+
+// Writes the manifest for WriteManifest
+func writeManifest(ctx context.Context, r io.Reader, w, ew io.Writer) error {
+	f, err := excelize.OpenReader(r)
+	if err != nil {
+		logging.From(ctx).Error("err reading", "op", "excel.WriteManifest", "err", err)
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(w)
+	var cols []string
+	// Message rows written before each sheet, used to place the meetings
+	offset := make(map[string]int)
+	n := 0
+	for _, sheet := range f.GetSheetList() {
+		if sheet == Meetings {
+			continue
+		}
+		offset[sheet] = n
+		rows, err := f.Rows(sheet)
+		if err != nil {
+			logging.From(ctx).Error("err reading rows", "op", "excel.WriteManifest", "sheet", sheet, "err", err)
+			return err
+		}
+
+		rowNum := 0
+		for rows.Next() {
+			rowNum++
+			vals, err := rows.Columns()
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			// Headers are written once, taken from the first sheet
+			if rowNum == 1 {
+				if cols == nil {
+					cols = vals
+					if len(cols) == 0 || cols[len(cols)-1] != "Attachments" {
+						cols = headers
+					}
+					if err := enc.Encode(cols); err != nil {
+						rows.Close()
+						return err
+					}
+				}
+				continue
+			}
+
+			cells := make([]Cell, len(vals))
+			for i, v := range vals {
+				cells[i].Value = v
+				// Only attachment and body cells carry links
+				if (i < len(cols)-1 && cols[i] != "Body") || v == "" {
+					continue
+				}
+				cell, _ := excelize.CoordinatesToCellName(i+1, rowNum)
+				if ok, link, _ := f.GetCellHyperLink(sheet, cell); ok {
+					cells[i].Link = link
+				}
+			}
+			if err := enc.Encode(cells); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+	}
+	return writeMeetings(f, ew, offset)
+}
+
+// Writes the rows of the Meetings sheet to w, one MeetingRow per line
+// Links are turned into row positions using offset, the message rows before each sheet
+func writeMeetings(f *excelize.File, w io.Writer, offset map[string]int) error {
+	if idx, _ := f.GetSheetIndex(Meetings); idx == -1 || w == nil {
+		return nil
+	}
+	rows, err := f.GetRows(Meetings)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for r := 1; r < len(rows); r++ {
+		if len(rows[r]) == 0 {
+			continue
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, r+1)
+		ok, link, _ := f.GetCellHyperLink(Meetings, cell)
+		if !ok {
+			continue
+		}
+		sheet, row, ok := parseLocation(link)
+		if _, found := offset[sheet]; !ok || !found {
+			continue
+		}
+		cells := make([]string, len(meetingHeaders)-1)
+		copy(cells, rows[r][1:])
+		m := MeetingRow{Id: rows[r][0], Row: offset[sheet] + row - 2, Cells: cells}
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the headers line of a manifest
+// Manifests without one use the default headers, their first row is returned instead
+func readManifestHeaders(dec *json.Decoder) ([]string, []Cell, error) {
+	var line json.RawMessage
+	if err := dec.Decode(&line); err != nil {
+		return nil, nil, err
+	}
+
+	var cols []string
+	if err := json.Unmarshal(line, &cols); err == nil {
+		return cols, nil, nil
+	}
+
+	var cells []Cell
+	if err := json.Unmarshal(line, &cells); err != nil {
+		return nil, nil, err
+	}
+	return headers, cells, nil
+}
+
+// Writes rows across as many sheets as needed
+type streamSheets struct {
+	f *excelize.File
+	// Headers written on every sheet
+	cols []string
+	// Current sheet writer
+	sw *excelize.StreamWriter
+	// Number of the current sheet, starting from 1
+	sheet int
+	// Last row written in the current sheet
+	row int
+	// Total message rows written
+	total int
+
+	style       int
+	linkStyle   int
+	headerStyle int
+}
+
+// Writes a message row, opening a new sheet if required
+func (s *streamSheets) setRow(cells []Cell) error {
+	if s.sw == nil || s.row >= MaxRows {
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+
+	s.row++
+	s.total++
+	vals := make([]interface{}, len(cells))
+	for i, c := range cells {
+		if c.Link == "" {
+			vals[i] = excelize.Cell{StyleID: s.style, Value: c.Value}
+			continue
+		}
+		vals[i] = s.link(i+1, c)
+	}
+
+	cell, _ := excelize.CoordinatesToCellName(1, s.row)
+	return s.sw.SetRow(cell, vals, excelize.RowOpts{Height: 25})
+}
+
+// Returns the cell of a link in the given column of the current row
+// StreamWriter has no hyperlink support, the HYPERLINK formula is used while the link fits in it,
+// Excel caps its target at 255 characters. Longer links, eg: presigned urls, are set as cell
+// hyperlinks held by the sheet until it is flushed, past the hyperlinks a sheet can hold
+// the cell keeps only its value
+func (s *streamSheets) link(col int, c Cell) excelize.Cell {
+	if utf8.RuneCountInString(c.Link) <= maxFormulaStr {
+		return excelize.Cell{
+			StyleID: s.linkStyle,
+			Formula: fmt.Sprintf("HYPERLINK(%s,%s)", formulaStr(c.Link), formulaStr(c.Value)),
+			Value:   c.Value,
+		}
+	}
+	cell, _ := excelize.CoordinatesToCellName(col, s.row)
+	if err := s.f.SetCellHyperLink(s.sw.Sheet, cell, c.Link, "External"); err != nil {
+		return excelize.Cell{StyleID: s.style, Value: c.Value}
+	}
+	return excelize.Cell{StyleID: s.linkStyle, Value: c.Value}
+}
+
+// Flushes the current sheet and starts the next one with the default headers
+func (s *streamSheets) next() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	s.sheet++
+	name := fmt.Sprintf("Sheet%d", s.sheet)
+	if s.sheet > 1 {
+		if _, err := s.f.NewSheet(name); err != nil {
+			return err
+		}
+	} else {
+		// Styles are shared by all sheets
+		s.style, _ = s.f.NewStyle(&excelize.Style{
+			Alignment: &excelize.Alignment{Horizontal: "center", WrapText: true},
+		})
+		s.linkStyle, _ = s.f.NewStyle(&excelize.Style{
+			Alignment: &excelize.Alignment{Horizontal: "center"},
+			Font:      &excelize.Font{Color: "#1265BE", Underline: "single"},
+		})
+		s.headerStyle, _ = s.f.NewStyle(&excelize.Style{
+			Alignment: &excelize.Alignment{Horizontal: "center"},
+			Font:      &excelize.Font{Bold: true, Color: "#000080"},
+		})
+	}
+
+	sw, err := s.f.NewStreamWriter(name)
+	if err != nil {
+		return err
+	}
+
+	// Column widths must be set before any row is written
+	for i, header := range s.cols {
+		if err := sw.SetColWidth(i+1, i+1, colWidth(header)); err != nil {
+			return err
+		}
+	}
+
+	vals := make([]interface{}, len(s.cols))
+	for i, header := range s.cols {
+		vals[i] = excelize.Cell{StyleID: s.headerStyle, Value: header}
+	}
+	if err := sw.SetRow("A1", vals, excelize.RowOpts{Height: 15}); err != nil {
+		return err
+	}
+
+	s.sw = sw
+	s.row = 1
+	return nil
+}
+
+// Flushes the current sheet writer if any
+func (s *streamSheets) flush() error {
+	if s.sw == nil {
+		return nil
+	}
+	err := s.sw.Flush()
+	s.sw = nil
+	return err
+}
+
+// Writes the Meetings sheet, the events of msgs first followed by the rows of old
+// Rows of old are moved down by shift, the message rows written above them
+// Every row is also written to ew, the sheet is only created when there are events
+func (s *streamSheets) meetings(ew io.Writer, msgs []mail.Message, old io.Reader, shift int) error {
+	if ew == nil {
+		ew = io.Discard
+	}
+	enc := json.NewEncoder(ew)
+	var sw *excelize.StreamWriter
+	row := 1
+
+	write := func(m MeetingRow) error {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		if sw == nil {
+			var err error
+			if sw, err = s.meetingsSheet(); err != nil {
+				return err
+			}
+		}
+		// Rows past the sheet limit are only kept in the meetings file
+		if row >= MaxRows {
+			return nil
+		}
+		row++
+		vals := make([]interface{}, 0, len(meetingHeaders))
+		vals = append(vals, excelize.Cell{
+			StyleID: s.linkStyle,
+			Formula: fmt.Sprintf("HYPERLINK(%s,%s)", formulaStr("#"+streamLocation(m.Row)), formulaStr(m.Id)),
+			Value:   m.Id,
+		})
+		for _, v := range m.Cells {
+			vals = append(vals, excelize.Cell{StyleID: s.style, Value: v})
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, row)
+		return sw.SetRow(cell, vals, excelize.RowOpts{Height: 25})
+	}
+
+	for i, msg := range msgs {
+		for _, e := range msg.Events {
+			if err := write(MeetingRow{Id: msg.Id, Row: i, Cells: meetingCells(e)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if old != nil {
+		dec := json.NewDecoder(old)
+		for {
+			var m MeetingRow
+			err := dec.Decode(&m)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			m.Row += shift
+			if err := write(m); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sw == nil {
+		return nil
+	}
+	return sw.Flush()
+}
+
+// Creates the Meetings sheet and writes its headers
+func (s *streamSheets) meetingsSheet() (*excelize.StreamWriter, error) {
+	if _, err := s.f.NewSheet(Meetings); err != nil {
+		return nil, err
+	}
+	sw, err := s.f.NewStreamWriter(Meetings)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]interface{}, len(meetingHeaders))
+	for i, header := range meetingHeaders {
+		if err := sw.SetColWidth(i+1, i+1, colWidth(header)); err != nil {
+			return nil, err
+		}
+		vals[i] = excelize.Cell{StyleID: s.headerStyle, Value: header}
+	}
+	if err := sw.SetRow("A1", vals, excelize.RowOpts{Height: 15}); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Returns the location of the n-th message row written by streamSheets, 0 is the first
+func streamLocation(n int) string {
+	return location(fmt.Sprintf("Sheet%d", n/(MaxRows-1)+1), n%(MaxRows-1)+2)
+}
+
+// Quotes s as an excel formula string
+// Long strings are split and joined with & to stay under the literal limit
+func formulaStr(s string) string {
+	var parts []string
+	r := []rune(s)
+	for len(r) > maxFormulaStr {
+		parts = append(parts, `"`+strings.ReplaceAll(string(r[:maxFormulaStr]), `"`, `""`)+`"`)
+		r = r[maxFormulaStr:]
+	}
+	parts = append(parts, `"`+strings.ReplaceAll(string(r), `"`, `""`)+`"`)
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,126 @@
+package excel
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/xuri/excelize/v2"
+)
+
+func TestRebuildMeetings(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	invite := mail.Message{Id: "invite", Date: day, Events: []mail.Event{{Method: "REQUEST", Summary: "Review", Start: day}}}
+
+	// The first build writes the event, linked to the first message row
+	var xw, mw, ew bytes.Buffer
+	if _, err := Rebuild(ctx, &xw, &mw, &ew, []mail.Message{invite}, nil, nil, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two newer messages move the invite down, its meeting follows the new one
+	newer := []mail.Message{
+		{Id: "new", Date: day.Add(2 * time.Hour), Events: []mail.Event{{Method: "CANCEL", Summary: "Standup"}}},
+		{Id: "plain", Date: day.Add(time.Hour)},
+	}
+	var xw2 bytes.Buffer
+	n, err := Rebuild(ctx, &xw2, nil, nil, newer, &mw, &ew, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("rows = %d, want 3", n)
+	}
+
+	f, err := excelize.OpenReader(&xw2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows(Meetings)
+	if err != nil {
+		t.Fatalf("no %v sheet. err: %v", Meetings, err)
+	}
+	if len(rows) != 3 || rows[1][0] != "new" || rows[2][0] != "invite" || rows[2][3] != "Review" {
+		t.Fatalf("meetings = %q", rows)
+	}
+	for row, want := range map[string]string{"A2": "'Sheet1'!A2", "A3": "'Sheet1'!A4"} {
+		formula, _ := f.GetCellFormula(Meetings, row)
+		if !strings.Contains(formula, want) {
+			t.Errorf("%v = %v, want a link to %v", row, formula, want)
+		}
+	}
+}
+
+func TestStreamLocation(t *testing.T) {
+	for n, want := range map[int]string{0: "'Sheet1'!A2", MaxRows - 2: "'Sheet1'!A1048576", MaxRows - 1: "'Sheet2'!A2"} {
+		if got := streamLocation(n); got != want {
+			t.Errorf("streamLocation(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestWriteManifestMeetings(t *testing.T) {
+	ctx := context.Background()
+	msgs := []mail.Message{
+		{Id: "a", Sheet: "Invoices"},
+		{Id: "b", Events: []mail.Event{{Summary: "Sync"}}},
+		{Id: "c", Sheet: "Invoices", Events: []mail.Event{{Summary: "Budget"}}},
+	}
+	buf, err := New(ctx, msgs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sheet1 holds b, Invoices holds a and c
+	var mw, ew bytes.Buffer
+	if err := WriteManifest(ctx, buf, &mw, &ew); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.TrimSpace(ew.String())
+	want := `{"id":"b","row":0,"c":["","","Sync","","","","","","",""]}` + "\n" +
+		`{"id":"c","row":2,"c":["","","Budget","","","","","","",""]}`
+	if got != want {
+		t.Errorf("meetings =\n%v\nwant\n%v", got, want)
+	}
+}
+
+// Links too long for the HYPERLINK formula are written as cell hyperlinks
+func TestRebuildLongLinks(t *testing.T) {
+	short := "https://bucket.test/u/m/a.pdf"
+	long := short + "?X-Amz-Signature=" + strings.Repeat("0", 300)
+	msg := mail.Message{Id: "m", Attachment: []mail.Attachment{{Name: "a.pdf", Url: short}, {Name: "b.pdf", Url: long}}}
+
+	var xw bytes.Buffer
+	if _, err := Rebuild(context.Background(), &xw, nil, nil, []mail.Message{msg}, nil, nil, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := excelize.OpenReader(&xw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows("Sheet1")
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("rows = %q, err: %v", rows, err)
+	}
+	first, _ := excelize.CoordinatesToCellName(len(rows[1])-1, 2)
+	second, _ := excelize.CoordinatesToCellName(len(rows[1]), 2)
+	if formula, _ := f.GetCellFormula("Sheet1", first); !strings.Contains(formula, short) {
+		t.Errorf("%v formula = %q, want a HYPERLINK to %v", first, formula, short)
+	}
+	if formula, _ := f.GetCellFormula("Sheet1", second); formula != "" {
+		t.Errorf("%v formula = %q, want none", second, formula)
+	}
+	if ok, link, _ := f.GetCellHyperLink("Sheet1", second); !ok || link != long {
+		t.Errorf("%v hyperlink = %v %q, want %q", second, ok, link, long)
+	}
+	if v, _ := f.GetCellValue("Sheet1", second); v != "b.pdf" {
+		t.Errorf("%v = %q, want b.pdf", second, v)
+	}
+}
@@ -0,0 +1,176 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// Maximum number of bytes of text kept per attachment
+const MaxText = 1 << 20
+
+// Returned when no extractor exists for the attachment type
+var ErrUnsupported = errors.New("unsupported attachment type")
+
+// Kinds of documents text can be extracted from
+const (
+	kindText = iota + 1
+	kindCsv
+	kindHtml
+	kindDocx
+	kindXlsx
+	kindPptx
+	kindPdf
+	kindRtf
+)
+
+// Content types mapped to document kinds
+var types = map[string]int{
+	"text/plain":                  kindText,
+	"text/csv":                    kindCsv,
+	"text/comma-separated-values": kindCsv,
+	"text/html":                   kindHtml,
+	"application/pdf":             kindPdf,
+	"application/rtf":             kindRtf,
+	"text/rtf":                    kindRtf,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   kindDocx,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         kindXlsx,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": kindPptx,
+}
+
+// File extensions mapped to document kinds
+// Used when the content type is missing or generic eg: application/octet-stream
+var extensions = map[string]int{
+	".txt":  kindText,
+	".log":  kindText,
+	".csv":  kindCsv,
+	".htm":  kindHtml,
+	".html": kindHtml,
+	".docx": kindDocx,
+	".xlsx": kindXlsx,
+	".pptx": kindPptx,
+	".pdf":  kindPdf,
+	".rtf":  kindRtf,
+}
+
+// Returns true if text can be extracted from an attachment with given name and content type
+func Supported(name, ctype string) bool {
+	return kind(name, ctype) != 0
+}
+
+// Extracts plain text from the attachment bytes
+// The document kind is picked from the content type, falling back to the file extension
+// Returns ErrUnsupported for any other kind of attachment
+func Text(name, ctype string, b []byte) (string, error) {
+	var (
+		s   string
+		err error
+	)
+
+	switch kind(name, ctype) {
+	case kindText:
+		s = string(b)
+	case kindCsv:
+		s, err = csvText(b)
+	case kindHtml:
+		s = mail.HtmlToText(string(b))
+	case kindDocx:
+		s, err = docxText(b)
+	case kindXlsx:
+		s, err = xlsxText(b)
+	case kindPptx:
+		s, err = pptxText(b)
+	case kindPdf:
+		s, err = pdfText(b)
+	case kindRtf:
+		s = rtfText(b)
+	default:
+		return "", ErrUnsupported
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return truncate(clean(s), MaxText), nil
+}
+
+// Returns the document kind or 0 if not supported
+func kind(name, ctype string) int {
+	if k, ok := types[strings.ToLower(ctype)]; ok {
+		return k
+	}
+	return extensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Joins csv records, cells separated by tabs
+// Rows with a different number of fields are allowed
+func csvText(b []byte) (string, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	var sb strings.Builder
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		sb.WriteString(strings.Join(rec, "\t"))
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// Drops invalid utf8 and control characters
+// Collapses runs of blank lines and trims trailing spaces
+func clean(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r == '\r' || r == ' ' {
+			return ' '
+		}
+		if r < 32 || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, s)
+
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	blank := false
+	for _, l := range lines {
+		l = strings.TrimRight(l, " \t")
+		if l == "" {
+			if blank {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		out = append(out, l)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// Cuts s to at most n bytes without splitting a utf8 character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,182 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"strings"
+	"testing"
+)
+
+// Returns a zip package holding the given parts
+func ooxml(t testing.TB, parts map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Returns a pdf holding a flate compressed content stream, an uncompressed one and an image
+func pdf(t testing.TB) []byte {
+	t.Helper()
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte("BT /F1 12 Tf 72 712 Td (Invoice 1001) Tj 0 -14 Td [(To)-300(tal)] TJ ( 250) Tj ET"))
+	zw.Close()
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	b.WriteString("4 0 obj\n<< /Length 10 /Filter /FlateDecode >>\nstream\n")
+	b.Write(z.Bytes())
+	b.WriteString("\nendstream\nendobj\n")
+	b.WriteString("5 0 obj\n<< /Length 10 >>\nstream\nBT <FEFF00C900740061007400200050> Tj ET\nendstream\nendobj\n")
+	b.WriteString("6 0 obj\n<< /Subtype /Image /Length 4 >>\nstream\nBT (hidden) Tj ET\nendstream\nendobj\n")
+	b.WriteString("%%EOF\n")
+	return b.Bytes()
+}
+
+const rtf = `{\rtf1\ansi\deff0{\fonttbl{\f0 Arial;}}{\colortbl;\red0\green0\blue0;}` +
+	`{\*\generator Writer;}\pard Caf\'e9 menu\par Price\tab 5\u8364?\par {\*\unknown skipped}Done}`
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		ctype string
+		data  []byte
+		want  string
+		err   string
+	}{
+		{
+			name: "docx",
+			file: "letter.docx",
+			data: ooxml(t, map[string]string{"word/document.xml": `<w:document xmlns:w="w"><w:body>` +
+				`<w:p><w:r><w:t>Dear</w:t></w:r><w:r><w:t xml:space="preserve"> Bob,</w:t></w:r></w:p>` +
+				`<w:p><w:r><w:t>Total</w:t><w:tab/><w:t>250</w:t></w:r></w:p></w:body></w:document>`}),
+			want: "Dear Bob,\nTotal\t250",
+		},
+		{
+			name: "xlsx",
+			file: "sheet.xlsx",
+			data: ooxml(t, map[string]string{
+				"xl/sharedStrings.xml":     `<sst><si><t>Name</t></si><si><t>Amount</t></si></sst>`,
+				"xl/worksheets/sheet2.xml": `<worksheet><sheetData><row><c t="inlineStr"><is><t>second</t></is></c></row></sheetData></worksheet>`,
+				"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row><c t="inlineStr"><is><t>first</t></is></c></row></sheetData></worksheet>`,
+			}),
+			want: "Name\nAmount\n\nfirst\n\nsecond",
+		},
+		{
+			name: "pptx slides in order",
+			file: "deck.pptx",
+			data: ooxml(t, map[string]string{
+				"ppt/slides/slide10.xml": `<p:sld xmlns:p="p" xmlns:a="a"><a:p><a:r><a:t>Ten</a:t></a:r></a:p></p:sld>`,
+				"ppt/slides/slide2.xml":  `<p:sld xmlns:p="p" xmlns:a="a"><a:p><a:r><a:t>Two</a:t></a:r></a:p></p:sld>`,
+			}),
+			want: "Two\n\nTen",
+		},
+		{
+			name: "zip that is not a document",
+			file: "a.docx",
+			data: ooxml(t, map[string]string{"a.txt": "a"}),
+			err:  "not an office document",
+		},
+		{
+			name: "malformed xml",
+			file: "a.docx",
+			data: ooxml(t, map[string]string{"word/document.xml": `<w:p><w:t>open`}),
+			err:  "unable to read word/document.xml",
+		},
+		{
+			name: "pdf",
+			file: "invoice.pdf",
+			data: pdf(t),
+			want: "Invoice 1001\nTo tal 250\nÉtat P",
+		},
+		{
+			name: "not a pdf",
+			file: "a.pdf",
+			data: []byte("hello"),
+			err:  "not a pdf document",
+		},
+		{
+			name:  "rtf",
+			file:  "menu",
+			ctype: "application/rtf",
+			data:  []byte(rtf),
+			want:  "Café menu\nPrice\t5€\nDone",
+		},
+		{
+			name: "csv",
+			file: "report.csv",
+			data: []byte("name,amount\n\"Smith, J\",10\nshort\n"),
+			want: "name\tamount\nSmith, J\t10\nshort",
+		},
+		{
+			name: "unsupported",
+			file: "a.bin",
+			err:  ErrUnsupported.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Text(tt.file, tt.ctype, tt.data)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Text = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextTruncated(t *testing.T) {
+	got, err := Text("a.txt", "", []byte(strings.Repeat("é", MaxText)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > MaxText || !strings.HasSuffix(got, "é") {
+		t.Errorf("len = %d, suffix %q", len(got), got[len(got)-2:])
+	}
+}
+
+// Malformed attachments must not panic the sync
+// go test ./extract -run '^$' -fuzz FuzzText -fuzztime 1m
+func FuzzText(f *testing.F) {
+	for _, seed := range [][]byte{
+		ooxml(f, map[string]string{"word/document.xml": `<w:p><w:t>a</w:t><w:tab/><w:br/></w:p>`}),
+		ooxml(f, map[string]string{"xl/sharedStrings.xml": `<si><t>a</t></si>`, "xl/worksheets/sheet1.xml": `<row/>`}),
+		pdf(f),
+		[]byte("%PDF-1.4\nstream\nBT (a\\(b\\) \\101) Tj [<00410042> -300 (c)] TJ BI ID xx EI ET\nendstream"),
+		[]byte(rtf),
+		[]byte(`{\rtf1\uc2\u-3913??\'zz\'\`),
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, name := range []string{"a.docx", "a.xlsx", "a.pptx", "a.pdf", "a.rtf", "a.csv", "a.html"} {
+			s, err := Text(name, "", b)
+			if err == nil && len(s) > MaxText {
+				t.Errorf("%v: %d bytes of text", name, len(s))
+			}
+		}
+	})
+}
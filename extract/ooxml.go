@@ -0,0 +1,142 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of bytes read from a single part of the zip package
+const maxPart = 64 << 20
+
+// Returns the text of word/document.xml
+func docxText(b []byte) (string, error) {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", err
+	}
+	return partsText(z, []string{"word/document.xml"}, map[string]bool{"p": true, "tr": true})
+}
+
+// Returns the shared strings followed by the inline strings of every sheet
+func xlsxText(b []byte) (string, error) {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", err
+	}
+	parts := append([]string{"xl/sharedStrings.xml"}, numbered(z, "xl/worksheets/sheet")...)
+	return partsText(z, parts, map[string]bool{"si": true, "row": true})
+}
+
+// Returns the text of every slide in order
+func pptxText(b []byte) (string, error) {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", err
+	}
+	return partsText(z, numbered(z, "ppt/slides/slide"), map[string]bool{"p": true})
+}
+
+// Returns names of files like prefix1.xml, prefix2.xml... sorted by their number
+func numbered(z *zip.Reader, prefix string) []string {
+	type part struct {
+		name string
+		n    int
+	}
+	var parts []part
+	for _, f := range z.File {
+		if !strings.HasPrefix(f.Name, prefix) || path.Ext(f.Name) != ".xml" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(f.Name, prefix), ".xml"))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, part{f.Name, n})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].n < parts[j].n })
+
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = p.name
+	}
+	return names
+}
+
+// Concatenates the text of the given xml parts, missing parts are skipped
+func partsText(z *zip.Reader, names []string, breaks map[string]bool) (string, error) {
+	files := make(map[string]*zip.File, len(z.File))
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+
+	var sb strings.Builder
+	found := false
+	for _, name := range names {
+		f, ok := files[name]
+		if !ok {
+			continue
+		}
+		found = true
+
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		err = xmlText(io.LimitReader(rc, maxPart), &sb, breaks)
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("unable to read %v. err: %v", name, err)
+		}
+		sb.WriteString("\n")
+	}
+	if !found {
+		return "", fmt.Errorf("not an office document")
+	}
+	return sb.String(), nil
+}
+
+// Writes the character data of every <t> element to sb
+// Elements in breaks are followed by a new line, <tab> elements by a tab
+// Namespaces are ignored so w:t, a:t and t are treated alike
+func xmlText(r io.Reader, sb *strings.Builder, breaks map[string]bool) error {
+	dec := xml.NewDecoder(r)
+	inText := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText++
+			case "tab":
+				sb.WriteString("\t")
+			case "br":
+				sb.WriteString("\n")
+			}
+		case xml.EndElement:
+			if t.Name.Local == "t" && inText > 0 {
+				inText--
+			}
+			if breaks[t.Name.Local] {
+				sb.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText > 0 {
+				sb.Write(t)
+			}
+		}
+	}
+}
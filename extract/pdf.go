@@ -0,0 +1,339 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Maximum number of bytes inflated from a single pdf stream
+const maxStream = 32 << 20
+
+// Returns the text layer of a pdf document
+// Reads every content stream and collects the strings shown by the text operators
+// Fonts with custom encodings are not mapped, their text comes out as is
+func pdfText(b []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(b, " \r\n\t"), []byte("%PDF")) {
+		return "", fmt.Errorf("not a pdf document")
+	}
+
+	var sb bytes.Buffer
+	rest := b
+	for {
+		i := bytes.Index(rest, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		// Skip "endstream" and words merely ending with stream
+		if i >= 3 && string(rest[i-3:i]) == "end" {
+			rest = rest[i+6:]
+			continue
+		}
+
+		// The stream dictionary sits between the object header and the stream keyword
+		dict := rest[:i]
+		if o := bytes.LastIndex(dict, []byte("obj")); o >= 0 {
+			dict = dict[o:]
+		}
+
+		start := i + 6
+		if start < len(rest) && rest[start] == '\r' {
+			start++
+		}
+		if start < len(rest) && rest[start] == '\n' {
+			start++
+		}
+		end := bytes.Index(rest[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		data := rest[start : start+end]
+		rest = rest[start+end+9:]
+
+		// Images, fonts and cross reference streams carry no text
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/XRef")) ||
+			bytes.Contains(dict, []byte("/ObjStm")) || bytes.Contains(dict, []byte("/Length1")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			// Keep whatever was inflated, streams are often cut short by trailing bytes
+			data, _ = io.ReadAll(io.LimitReader(zr, maxStream))
+			zr.Close()
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// Other filters are not supported
+			continue
+		}
+
+		if bytes.Contains(data, []byte("BT")) {
+			contentText(data, &sb)
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// Runs the text operators of a content stream and writes the shown strings to sb
+func contentText(data []byte, sb *bytes.Buffer) {
+	lx := &pdfLexer{b: data}
+	var operands []pdfToken
+
+	for {
+		tok, ok := lx.next()
+		if !ok {
+			break
+		}
+		if tok.kind != tokOp {
+			operands = append(operands, tok)
+			continue
+		}
+
+		switch tok.text {
+		case "Tj":
+			if n := len(operands); n > 0 {
+				sb.WriteString(operands[n-1].text)
+			}
+		case "'", "\"":
+			sb.WriteString("\n")
+			if n := len(operands); n > 0 {
+				sb.WriteString(operands[n-1].text)
+			}
+		case "TJ":
+			for _, o := range operands {
+				switch o.kind {
+				case tokString:
+					sb.WriteString(o.text)
+				case tokNumber:
+					// Large negative kerning is used as a word gap
+					if n, err := strconv.ParseFloat(o.text, 64); err == nil && n < -200 {
+						sb.WriteString(" ")
+					}
+				}
+			}
+		case "T*", "ET":
+			sb.WriteString("\n")
+		case "Td", "TD":
+			// A vertical move starts a new line
+			if n := len(operands); n > 0 && operands[n-1].text != "0" {
+				sb.WriteString("\n")
+			} else {
+				sb.WriteString(" ")
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+// Kinds of content stream tokens
+const (
+	tokOp = iota
+	tokNumber
+	tokString
+	tokOther
+)
+
+type pdfToken struct {
+	kind int
+	text string
+}
+
+// Minimal tokenizer for pdf content streams
+// Arrays are flattened, their elements are returned as plain operands
+type pdfLexer struct {
+	b   []byte
+	pos int
+}
+
+// Returns the next token, false at the end of the stream
+func (l *pdfLexer) next() (pdfToken, bool) {
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		switch {
+		case isPdfSpace(c), c == '[', c == ']':
+			l.pos++
+		case c == '%':
+			// Comment until end of line
+			for l.pos < len(l.b) && l.b[l.pos] != '\n' && l.b[l.pos] != '\r' {
+				l.pos++
+			}
+		case c == '(':
+			return pdfToken{tokString, decodePdfString(l.literal())}, true
+		case c == '<' && l.pos+1 < len(l.b) && l.b[l.pos+1] == '<':
+			l.pos += 2
+			return pdfToken{tokOther, "<<"}, true
+		case c == '>' && l.pos+1 < len(l.b) && l.b[l.pos+1] == '>':
+			l.pos += 2
+			return pdfToken{tokOther, ">>"}, true
+		case c == '<':
+			return pdfToken{tokString, decodePdfString(l.hex())}, true
+		case c == '/':
+			start := l.pos
+			l.pos++
+			for l.pos < len(l.b) && !isPdfSpace(l.b[l.pos]) && !isPdfDelim(l.b[l.pos]) {
+				l.pos++
+			}
+			return pdfToken{tokOther, string(l.b[start:l.pos])}, true
+		default:
+			start := l.pos
+			for l.pos < len(l.b) && !isPdfSpace(l.b[l.pos]) && !isPdfDelim(l.b[l.pos]) {
+				l.pos++
+			}
+			if l.pos == start {
+				// Stray delimiter
+				l.pos++
+				continue
+			}
+			word := string(l.b[start:l.pos])
+			if _, err := strconv.ParseFloat(word, 64); err == nil {
+				return pdfToken{tokNumber, word}, true
+			}
+			if word == "BI" {
+				l.skipImage()
+				continue
+			}
+			return pdfToken{tokOp, word}, true
+		}
+	}
+	return pdfToken{}, false
+}
+
+// Reads a literal string, handling escapes and balanced parentheses
+func (l *pdfLexer) literal() []byte {
+	var out []byte
+	depth := 0
+	l.pos++
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+			out = append(out, c)
+		case ')':
+			if depth == 0 {
+				return out
+			}
+			depth--
+			out = append(out, c)
+		case '\\':
+			if l.pos >= len(l.b) {
+				return out
+			}
+			e := l.b[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for k := 0; k < 2 && l.pos < len(l.b) && l.b[l.pos] >= '0' && l.b[l.pos] <= '7'; k++ {
+						v = v*8 + int(l.b[l.pos]-'0')
+						l.pos++
+					}
+					out = append(out, byte(v))
+				} else {
+					out = append(out, e)
+				}
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Reads a hex string
+func (l *pdfLexer) hex() []byte {
+	var out []byte
+	var digits []byte
+	l.pos++
+	for l.pos < len(l.b) && l.b[l.pos] != '>' {
+		if c := l.b[l.pos]; !isPdfSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	for i := 0; i+1 < len(digits); i += 2 {
+		v, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			continue
+		}
+		out = append(out, byte(v))
+	}
+	return out
+}
+
+// Skips inline image data up to the EI operator
+func (l *pdfLexer) skipImage() {
+	i := bytes.Index(l.b[l.pos:], []byte("EI"))
+	if i < 0 {
+		l.pos = len(l.b)
+		return
+	}
+	l.pos += i + 2
+}
+
+// Decodes a pdf string
+// UTF-16 strings start with a byte order mark, two byte glyph ids are guessed
+// from a high share of zero bytes, anything else is read as latin1
+func decodePdfString(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		return decodeUtf16(b[2:])
+	}
+	if len(b) >= 4 && len(b)%2 == 0 {
+		zeros := 0
+		for i := 0; i < len(b); i += 2 {
+			if b[i] == 0 {
+				zeros++
+			}
+		}
+		if zeros*2 >= len(b)/2 {
+			return decodeUtf16(b)
+		}
+	}
+
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// Decodes big endian utf16
+func decodeUtf16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+func isPdfSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPdfDelim(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
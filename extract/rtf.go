@@ -0,0 +1,165 @@
+package extract
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Destinations that hold no document text
+var rtfSkip = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true,
+	"pict": true, "object": true, "header": true, "footer": true,
+	"headerl": true, "headerr": true, "footerl": true, "footerr": true,
+	"themedata": true, "colorschememapping": true, "datastore": true,
+	"latentstyles": true, "listtable": true, "listoverridetable": true,
+	"rsidtbl": true, "generator": true, "xmlnstbl": true, "mmathPr": true,
+	"fldinst": true, "filetbl": true, "revtbl": true,
+}
+
+// Returns the text of a rtf document
+// Control words are dropped, paragraphs and tabs are kept
+// \'hh escapes are read as windows-1252 and \u escapes as unicode
+func rtfText(b []byte) string {
+	type group struct {
+		skip bool
+		// Number of characters following a \u escape
+		uc int
+	}
+
+	var sb strings.Builder
+	stack := []group{{uc: 1}}
+	// Characters still to be skipped after a \u escape
+	pending := 0
+
+	for i := 0; i < len(b); i++ {
+		cur := &stack[len(stack)-1]
+		c := b[i]
+
+		switch c {
+		case '{':
+			stack = append(stack, *cur)
+			continue
+		case '}':
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		case '\r', '\n':
+			continue
+		case '\\':
+		default:
+			if pending > 0 {
+				pending--
+				continue
+			}
+			if !cur.skip {
+				sb.WriteByte(c)
+			}
+			continue
+		}
+
+		// Control symbol or control word
+		if i+1 >= len(b) {
+			break
+		}
+		i++
+		c = b[i]
+
+		if !isLetter(c) {
+			switch c {
+			case '\'':
+				if i+2 < len(b) {
+					v, err := strconv.ParseUint(string(b[i+1:i+3]), 16, 8)
+					i += 2
+					if err != nil {
+						continue
+					}
+					if pending > 0 {
+						pending--
+						continue
+					}
+					if !cur.skip {
+						sb.WriteRune(charmap.Windows1252.DecodeByte(byte(v)))
+					}
+				}
+			case '*':
+				// Unknown destinations are ignored
+				cur.skip = true
+			case '~':
+				if !cur.skip {
+					sb.WriteString(" ")
+				}
+			case '\\', '{', '}':
+				if !cur.skip {
+					sb.WriteByte(c)
+				}
+			case '\r', '\n':
+				if !cur.skip {
+					sb.WriteString("\n")
+				}
+			}
+			continue
+		}
+
+		// Read the control word and its optional numeric parameter
+		start := i
+		for i < len(b) && isLetter(b[i]) {
+			i++
+		}
+		word := string(b[start:i])
+		pstart := i
+		if i < len(b) && b[i] == '-' {
+			i++
+		}
+		for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+			i++
+		}
+		param, hasParam := 0, i > pstart
+		if hasParam {
+			param, _ = strconv.Atoi(string(b[pstart:i]))
+		}
+		// A single space delimits the control word, any other character is processed next
+		if i >= len(b) || b[i] != ' ' {
+			i--
+		}
+
+		if rtfSkip[word] {
+			cur.skip = true
+			continue
+		}
+		if cur.skip {
+			continue
+		}
+
+		switch word {
+		case "par", "line", "row", "sect", "page":
+			sb.WriteString("\n")
+		case "tab", "cell":
+			sb.WriteString("\t")
+		case "emdash":
+			sb.WriteString("—")
+		case "endash":
+			sb.WriteString("–")
+		case "bullet":
+			sb.WriteString("•")
+		case "uc":
+			if hasParam {
+				cur.uc = param
+			}
+		case "u":
+			if param < 0 {
+				param += 65536
+			}
+			sb.WriteRune(rune(param))
+			pending = cur.uc
+		}
+	}
+
+	return sb.String()
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
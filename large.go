@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tars47/go-read-mail/awss3"
+	"github.com/tars47/go-read-mail/excel"
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/metrics"
+)
+
+// Downloads the user manifest to a temp file
+// Returns nil if the user has no manifest yet
+// Caller must close and remove the returned file
+func downloadManifest(ctx context.Context, user string) (*os.File, error) {
+	return downloadTemp(ctx, fmt.Sprintf("%s/%s", user, DefaultManifest), "manifest")
+}
+
+// Downloads the user meetings file, the rows of the Meetings sheet, to a temp file
+// Returns nil if the user has none yet
+// Caller must close and remove the returned file
+func downloadMeetings(ctx context.Context, user string) (*os.File, error) {
+	return downloadTemp(ctx, fmt.Sprintf("%s/%s", user, DefaultMeetings), "meetings")
+}
+
+// Downloads an s3 object to a temp file positioned at its start, name is used in errors
+// Returns nil if the object does not exist
+func downloadTemp(ctx context.Context, key, name string) (*os.File, error) {
+	body, err := awss3.DownloadStream(ctx, key)
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp("", name+"-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s file. err: %s", name, err.Error())
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		removeTemp(f)
+		return nil, fmt.Errorf("unable to download %s file. err: %s", name, err.Error())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		removeTemp(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// Keeps very large workbooks up to date using excel.Rebuild
+// The manifest holds every exported row, latest first, and is kept on disk
+// so memory use does not grow with the history size
+// Existing users without a manifest are migrated from their current excel file
+// The flags of the changed messages are rewritten in the manifest before rebuilding
+// Returns the presigned s3 url
+func syncLargeExcel(ctx context.Context, u *mail.Mail, st *syncState, manifest *os.File, opt excel.Options, changes []mail.Message) (string, error) {
+	// Migrate an existing excel file, if any
+	var meetings *os.File
+	if manifest == nil {
+		var err error
+		if manifest, meetings, err = migrateManifest(ctx, u.User); err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		if meetings, err = downloadMeetings(ctx, u.User); err != nil {
+			return "", err
+		}
+	}
+	if meetings != nil {
+		defer removeTemp(meetings)
+	}
+
+	var msgs []mail.Message
+	if manifest == nil {
+		// New user, fetch recent 25 messages
+		to := u.NumMsgs()
+		from := to - 25
+		if to <= 25 {
+			from = uint32(1)
+		}
+		var err error
+		if msgs, err = u.Fetch(ctx, from, to); err != nil {
+			return "", err
+		}
+	} else {
+		defer removeTemp(manifest)
+
+		// Reads the recent message date from the first manifest row
+		if _, err := manifest.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		t := excel.ManifestRecentDate(ctx, manifest)
+
+		var err error
+		if msgs, err = u.FetchAfter(ctx, t, st.exportedAt(t)); err != nil {
+			return "", err
+		}
+		// If no messages found and no flags changed generate the presigned url and return
+		if len(msgs) == 0 && len(changes) == 0 {
+			return awss3.GetFileLink(ctx, fmt.Sprintf("%s/%s", u.User, DefaultExcel))
+		}
+		if _, err := manifest.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+
+		if len(changes) > 0 {
+			updated, err := updateManifest(ctx, manifest, changes)
+			if err != nil {
+				return "", err
+			}
+			defer removeTemp(updated)
+			manifest = updated
+		}
+	}
+
+	// Applies the rules and uploads all the attachments to s3
+	msgs, err := processMsgs(ctx, u, st, msgs, &opt)
+	if err != nil {
+		return "", err
+	}
+	// All new messages skipped by rules and no flags changed
+	if manifest != nil && len(msgs) == 0 && len(changes) == 0 {
+		return awss3.GetFileLink(ctx, fmt.Sprintf("%s/%s", u.User, DefaultExcel))
+	}
+
+	xf, err := os.CreateTemp("", "excel-*.xlsx")
+	if err != nil {
+		return "", fmt.Errorf("unable to create excel file. err: %s", err.Error())
+	}
+	defer removeTemp(xf)
+
+	mf, err := os.CreateTemp("", "manifest-*.jsonl")
+	if err != nil {
+		return "", fmt.Errorf("unable to create manifest file. err: %s", err.Error())
+	}
+	defer removeTemp(mf)
+
+	ef, err := os.CreateTemp("", "meetings-*.jsonl")
+	if err != nil {
+		return "", fmt.Errorf("unable to create meetings file. err: %s", err.Error())
+	}
+	defer removeTemp(ef)
+
+	// Avoid passing a typed nil *os.File as io.Reader
+	var old, oldMeetings io.Reader
+	if manifest != nil {
+		old = manifest
+	}
+	if meetings != nil {
+		oldMeetings = meetings
+	}
+	start := time.Now()
+	rows, err := excel.Rebuild(ctx, xf, mf, ef, msgs, old, oldMeetings, opt)
+	if err != nil {
+		return "", fmt.Errorf("unable to build excel file. err: %s", err.Error())
+	}
+	metrics.ObserveExcel("large", start, rows)
+
+	// Upload the manifest and meetings first, a stale excel file is rebuilt on the next sync
+	// The meetings follow the manifest, its rows are placed by message row position
+	if _, err := mf.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", u.User, DefaultManifest), mf); err != nil {
+		return "", fmt.Errorf("unable to upload manifest file. err: %s", err.Error())
+	}
+	if _, err := ef.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", u.User, DefaultMeetings), ef); err != nil {
+		return "", fmt.Errorf("unable to upload meetings file. err: %s", err.Error())
+	}
+
+	if _, err := xf.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	url, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", u.User, DefaultExcel), xf)
+	if err != nil {
+		return "", fmt.Errorf("unable to upload excel file. err: %s", err.Error())
+	}
+	return url, nil
+}
+
+// Writes the manifest with the flags of the changed messages rewritten to a temp file
+// Returns the new manifest positioned at its start
+func updateManifest(ctx context.Context, manifest *os.File, changes []mail.Message) (*os.File, error) {
+	f, err := os.CreateTemp("", "manifest-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create manifest file. err: %s", err.Error())
+	}
+	if _, err := excel.UpdateManifest(ctx, manifest, f, changes); err != nil {
+		removeTemp(f)
+		return nil, fmt.Errorf("unable to update manifest file. err: %s", err.Error())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		removeTemp(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// Writes the manifest and the meetings file of the user's current excel file to temp files
+// Returns nil files if the user has no excel file yet
+func migrateManifest(ctx context.Context, user string) (*os.File, *os.File, error) {
+	buf, err := awss3.DownloadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultExcel))
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	f, err := os.CreateTemp("", "manifest-*.jsonl")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create manifest file. err: %s", err.Error())
+	}
+	ef, err := os.CreateTemp("", "meetings-*.jsonl")
+	if err != nil {
+		removeTemp(f)
+		return nil, nil, fmt.Errorf("unable to create meetings file. err: %s", err.Error())
+	}
+	if err := excel.WriteManifest(ctx, buf, f, ef); err != nil {
+		removeTemp(f)
+		removeTemp(ef)
+		return nil, nil, fmt.Errorf("unable to read excel file. err: %s", err.Error())
+	}
+	if _, err := ef.Seek(0, io.SeekStart); err != nil {
+		removeTemp(f)
+		removeTemp(ef)
+		return nil, nil, err
+	}
+	return f, ef, nil
+}
+
+// Closes and removes a temp file
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
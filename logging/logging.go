@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Value written in place of redacted attributes
+const Redacted = "[REDACTED]"
+
+// Keys whose values are never logged, compared case insensitive
+var redactKeys = map[string]bool{
+	"pass": true, "password": true, "secret": true, "token": true, "authorization": true,
+	"body": true, "bodytext": true, "bodyhtml": true, "text": true, "sync": true,
+}
+
+// Keys holding an email address, logged as the account hash
+var accountKeys = map[string]bool{"user": true, "email": true}
+
+type ctxKey struct{}
+
+// Sets the default logger writing to w
+// level is one of debug, info, warn, error and format json or text
+// Credentials and message bodies are redacted and user addresses hashed, see Account
+func Setup(w io.Writer, level, format string) error {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, expected json or text", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// Email addresses in free text, eg: s3 keys and error messages
+var emailRe = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// Redacts credentials and bodies, hashes user addresses
+// Addresses found in string and error values are replaced with their account hash
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case redactKeys[key]:
+		return slog.String(a.Key, Redacted)
+	case accountKeys[key]:
+		return slog.String("account", Account(a.Value.String()))
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Scrub(err.Error()))
+		}
+	}
+	return a
+}
+
+// Replaces the email addresses of a text with their account hash
+func Scrub(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return emailRe.ReplaceAllStringFunc(s, Account)
+}
+
+// Returns the logger of ctx, the default logger if none was set
+func From(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+// Returns a context whose logger adds the given attributes to every record
+// eg: logging.With(ctx, "request_id", id, "account", logging.Account(user))
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, ctxKey{}, From(ctx).With(args...))
+}
+
+// Returns the identifier of an account in logs, a hash of the address
+// The same address always gives the same identifier so records can be correlated
+func Account(user string) string {
+	if user == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(user))))
+	return "acct-" + hex.EncodeToString(h[:6])
+}
+
+// Returns a random request or job id
+func NewId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,120 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Changes applied to the exported messages once the excel file is uploaded
+type Actions struct {
+	// Flags added to the messages eg: \Seen, \Flagged, $Exported
+	Flags []string `json:"flags,omitempty"`
+	// Gmail labels added to the messages
+	Labels []string `json:"labels,omitempty"`
+	// Folder the messages are copied to
+	Copy string `json:"copy,omitempty"`
+	// Folder the messages are moved to, needs the MOVE or UIDPLUS extension
+	Move string `json:"move,omitempty"`
+}
+
+// Kinds of steps in the order they run
+// Move runs last as the message leaves the INBOX
+var stepKinds = []string{"flag", "label", "copy", "move"}
+
+// Returns the steps of the actions in the order they run, eg: "flag:\Seen", "move:Exported"
+// Every flag and label is a step of its own so steps already done are not repeated
+func (a Actions) Steps() []string {
+	var steps []string
+	for _, f := range a.Flags {
+		if f = strings.TrimSpace(f); f != "" {
+			steps = append(steps, "flag:"+f)
+		}
+	}
+	for _, l := range a.Labels {
+		if l = strings.TrimSpace(l); l != "" {
+			steps = append(steps, "label:"+l)
+		}
+	}
+	if a.Copy != "" {
+		steps = append(steps, "copy:"+a.Copy)
+	}
+	if a.Move != "" {
+		steps = append(steps, "move:"+a.Move)
+	}
+	return steps
+}
+
+// Returns the position of a step in the run order
+func StepOrder(step string) int {
+	kind, _, _ := strings.Cut(step, ":")
+	for i, k := range stepKinds {
+		if k == kind {
+			return i
+		}
+	}
+	return len(stepKinds)
+}
+
+// Runs a step returned by Actions.Steps on the INBOX messages with the given uids
+func (m *Mail) RunStep(step string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	kind, arg, _ := strings.Cut(step, ":")
+	var err error
+	switch kind {
+	case "flag":
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		err = m.con.UidStore(seqset, item, []interface{}{arg}, nil)
+	case "label":
+		if !m.Support(capGmail) {
+			return fmt.Errorf("labels are not supported by %v", m.Addr)
+		}
+		// Labels are mailbox names, sent quoted in modified utf-7
+		label, _ := utf7.Encoding.NewEncoder().String(arg)
+		quoted := `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(label) + `"`
+		err = m.con.UidStore(seqset, imap.StoreItem("+X-GM-LABELS.SILENT"), []interface{}{imap.RawString(quoted)}, nil)
+	case "copy":
+		err = m.con.UidCopy(seqset, arg)
+	case "move":
+		err = m.uidMove(seqset, arg)
+	default:
+		return fmt.Errorf("unknown step %q", step)
+	}
+	if err != nil {
+		m.failed = true
+		return fmt.Errorf("unable to run %v. err: %v", step, err)
+	}
+	return nil
+}
+
+// Moves the messages with MOVE, or COPY, STORE \Deleted and UID EXPUNGE with UIDPLUS
+// A plain EXPUNGE would also remove the other messages the user marked \Deleted, so it is never used
+func (m *Mail) uidMove(seqset *imap.SeqSet, dest string) error {
+	if m.Support("MOVE") {
+		return m.con.UidMove(seqset, dest)
+	}
+	if !m.Support("UIDPLUS") {
+		return fmt.Errorf("move is not supported by %v, it needs the MOVE or UIDPLUS extension", m.Addr)
+	}
+	if err := m.con.UidCopy(seqset, dest); err != nil {
+		return err
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := m.con.UidStore(seqset, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	expunge := &commands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{seqset}}}
+	status, err := m.con.Execute(expunge, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
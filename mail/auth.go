@@ -0,0 +1,328 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"go.mozilla.org/pkcs7"
+)
+
+// Outcome of the authenticity checks of a message
+// Every value starts with the result eg: pass, fail, none, followed by details
+type Auth struct {
+	// DKIM signatures verified using LookupTXT, eg: "pass example.com"
+	Dkim string
+	// DKIM result reported by the receiving server in Authentication-Results
+	ReportedDkim string
+	// SPF result reported in Authentication-Results, or Received-SPF
+	Spf string
+	// DMARC result reported in Authentication-Results
+	Dmarc string
+	// Detached S/MIME signature verified against TrustStore, eg: "pass John Doe <john@example.com>"
+	Smime string
+}
+
+// Returns the TXT records of a domain, used to fetch DKIM public keys
+// Replace it to stub DNS, eg: in tests
+var LookupTXT = func(ctx context.Context, domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return net.DefaultResolver.LookupTXT(ctx, domain)
+}
+
+// Roots trusted for S/MIME signatures, the system roots are used if nil
+var TrustStore *x509.CertPool
+
+// Maximum number of DKIM signatures verified per message
+const maxDkim = 5
+
+// Maximum time Verify spends on the messages of a fetch, DKIM keys are looked up over DNS
+const VerifyTimeout = 30 * time.Second
+
+// Number of messages Verify checks at once
+const verifyWorkers = 8
+
+// Inputs of the authenticity checks, kept by parse until Verify runs
+type authInput struct {
+	// Message as fetched
+	raw []byte
+	h   mail.Header
+	// Detached S/MIME signature, if any
+	sig []byte
+}
+
+// Reads the pem certificates of a file into TrustStore
+func LoadTrustStore(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read trust store. err: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no certificates found in %v", path)
+	}
+	TrustStore = pool
+	return nil
+}
+
+// Runs the DKIM, SPF, DMARC and S/MIME checks of parsed messages and the messages embedded in them
+// Checks run concurrently after the fetch, so DNS lookups never hold up the FETCH stream
+// Lookups still running when ctx is done or VerifyTimeout has passed are reported as temperror
+func Verify(ctx context.Context, msgs []Message) {
+	ctx, cancel := context.WithTimeout(ctx, VerifyTimeout)
+	defer cancel()
+
+	var pending []*Message
+	var add func(msgs []Message)
+	add = func(msgs []Message) {
+		for i := range msgs {
+			if msgs[i].pending != nil {
+				pending = append(pending, &msgs[i])
+			}
+			add(msgs[i].Embedded)
+		}
+	}
+	add(msgs)
+
+	sem := make(chan struct{}, verifyWorkers)
+	var wg sync.WaitGroup
+	for _, m := range pending {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			m.verify(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// Runs the authenticity checks of a message and drops their inputs
+func (m *Message) verify(ctx context.Context) {
+	in := m.pending
+	m.pending = nil
+
+	a := &m.Auth
+	a.Dkim = verifyDkim(ctx, in.raw)
+	a.ReportedDkim, a.Spf, a.Dmarc = authResults(in.h)
+	if a.Spf == "" {
+		a.Spf = receivedSpf(in.h)
+	}
+	a.Smime = verifySmime(in.raw, in.h, in.sig)
+
+	// Results are written to single line cells
+	for _, v := range []*string{&a.Dkim, &a.ReportedDkim, &a.Spf, &a.Dmarc, &a.Smime} {
+		*v = strings.Join(strings.Fields(*v), " ")
+		if *v == "" {
+			*v = "none"
+		}
+	}
+}
+
+// Verifies the DKIM signatures of a raw message, key lookups fail once ctx is done
+func verifyDkim(ctx context.Context, raw []byte) string {
+	vs, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			txts, err := LookupTXT(ctx, domain)
+			// Lookups cut short by the deadline are a temperror, not a missing key
+			if err != nil && ctx.Err() != nil {
+				return nil, &net.DNSError{Err: ctx.Err().Error(), Name: domain, IsTimeout: true, IsTemporary: true}
+			}
+			return txts, err
+		},
+		MaxVerifications: maxDkim,
+	})
+	if err != nil && len(vs) == 0 {
+		return fmt.Sprintf("permerror: %v", err)
+	}
+	if len(vs) == 0 {
+		return "none"
+	}
+
+	out := make([]string, 0, len(vs))
+	for _, v := range vs {
+		switch {
+		case v.Err == nil:
+			out = append(out, "pass "+v.Domain)
+		case dkim.IsTempFail(v.Err):
+			out = append(out, fmt.Sprintf("temperror %v: %v", v.Domain, v.Err))
+		case dkim.IsPermFail(v.Err):
+			out = append(out, fmt.Sprintf("permerror %v: %v", v.Domain, v.Err))
+		default:
+			out = append(out, fmt.Sprintf("fail %v: %v", v.Domain, v.Err))
+		}
+	}
+	return strings.Join(out, "; ")
+}
+
+// Reads the DKIM, SPF and DMARC results of the topmost Authentication-Results header,
+// the one added by the receiving server
+func authResults(h mail.Header) (dkimRes, spf, dmarc string) {
+	v := h.Get("Authentication-Results")
+	if v == "" {
+		return "", "", ""
+	}
+	_, results, err := authres.Parse(v)
+	if err != nil {
+		return "", "", ""
+	}
+
+	var dkims []string
+	for _, r := range results {
+		switch r := r.(type) {
+		case *authres.DKIMResult:
+			dkims = append(dkims, result(string(r.Value), r.Domain, r.Reason))
+		case *authres.SPFResult:
+			if spf == "" {
+				spf = result(string(r.Value), r.From, r.Reason)
+			}
+		case *authres.DMARCResult:
+			if dmarc == "" {
+				dmarc = result(string(r.Value), r.From, r.Reason)
+			}
+		}
+	}
+	return strings.Join(dkims, "; "), spf, dmarc
+}
+
+// Reads the result of the topmost Received-SPF header
+// eg: pass (domain of a@example.com designates 1.2.3.4 as permitted sender) client-ip=1.2.3.4;
+func receivedSpf(h mail.Header) string {
+	v := strings.TrimSpace(h.Get("Received-SPF"))
+	if v == "" {
+		return ""
+	}
+	res, rest, _ := strings.Cut(v, " ")
+	rest = strings.TrimSpace(rest)
+
+	reason := ""
+	if strings.HasPrefix(rest, "(") {
+		if i := strings.Index(rest, ")"); i > 0 {
+			reason = rest[1:i]
+		}
+	}
+	return result(strings.ToLower(res), "", reason)
+}
+
+// Formats a check result as "value detail: reason"
+func result(value, detail, reason string) string {
+	out := value
+	if detail != "" {
+		out += " " + detail
+	}
+	if reason != "" {
+		out += ": " + reason
+	}
+	return out
+}
+
+// Verifies the detached S/MIME signature of a multipart/signed message
+// The signed content is the raw first part, read with CRLF line endings
+func verifySmime(raw []byte, h mail.Header, sig []byte) string {
+	ctype, params, _ := h.ContentType()
+	if ctype != "multipart/signed" || !strings.Contains(strings.ToLower(params["protocol"]), "pkcs7-signature") {
+		return "none"
+	}
+	if len(sig) == 0 {
+		return "fail: signature part not found"
+	}
+
+	content, ok := signedPart(raw, params["boundary"])
+	if !ok {
+		return "fail: signed part not found"
+	}
+
+	p7, err := pkcs7.Parse(sig)
+	if err != nil {
+		return fmt.Sprintf("fail: %v", err)
+	}
+	p7.Content = content
+
+	roots := TrustStore
+	if roots == nil {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			roots = x509.NewCertPool()
+		}
+	}
+	signer := ""
+	if c := p7.GetOnlySigner(); c != nil {
+		signer = " " + certName(c)
+	}
+	if err := p7.VerifyWithChain(roots); err != nil {
+		return fmt.Sprintf("fail%s: %v", signer, err)
+	}
+	return "pass" + signer
+}
+
+// Returns the raw bytes of the first part of a multipart body with CRLF line endings
+func signedPart(raw []byte, boundary string) ([]byte, bool) {
+	if boundary == "" {
+		return nil, false
+	}
+	raw = crlf(raw)
+	delim := []byte("\r\n--" + boundary)
+
+	// The header ends with an empty line
+	i := bytes.Index(raw, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, false
+	}
+	body := raw[i+2:]
+
+	start := bytes.Index(body, delim)
+	if start < 0 {
+		return nil, false
+	}
+	// Skip the rest of the delimiter line
+	rest := body[start+len(delim):]
+	nl := bytes.Index(rest, []byte("\r\n"))
+	if nl < 0 {
+		return nil, false
+	}
+	rest = rest[nl+2:]
+
+	end := bytes.Index(rest, delim)
+	if end < 0 {
+		return nil, false
+	}
+	return rest[:end], true
+}
+
+// Converts bare LF line endings to CRLF
+func crlf(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) || bytes.Count(b, []byte("\r\n")) == bytes.Count(b, []byte("\n")) {
+		return b
+	}
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// Returns the name and email address of a certificate
+func certName(c *x509.Certificate) string {
+	name := c.Subject.CommonName
+	if len(c.EmailAddresses) == 0 {
+		return name
+	}
+	if name == "" {
+		return "<" + c.EmailAddresses[0] + ">"
+	}
+	return fmt.Sprintf("%s <%s>", name, c.EmailAddresses[0])
+}
+
+// Returns true for content types of detached S/MIME signatures
+func isSignature(ctype string) bool {
+	return ctype == "application/pkcs7-signature" || ctype == "application/x-pkcs7-signature"
+}
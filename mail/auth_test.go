@@ -0,0 +1,197 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"go.mozilla.org/pkcs7"
+)
+
+const unsigned = "From: alice@example.org\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Invoice\r\n" +
+	"Date: Fri, 01 Mar 2024 09:00:00 +0000\r\n" +
+	"Message-Id: <dkim@example.org>\r\n" +
+	"\r\n" +
+	"Total: 250\r\n"
+
+// Returns the message signed for example.org with selector s1, and the TXT record of its key
+func dkimSigned(t *testing.T) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := dkim.Sign(&b, strings.NewReader(unsigned), &dkim.SignOptions{Domain: "example.org", Selector: "s1", Signer: priv}); err != nil {
+		t.Fatal(err)
+	}
+	return b.String(), "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// Parses and verifies a raw message
+func verified(ctx context.Context, raw string) Auth {
+	msgs := []Message{{Id: "m", keepAuth: true}}
+	msgs[0].parse(strings.NewReader(raw), 0, discard)
+	Verify(ctx, msgs)
+	return msgs[0].Auth
+}
+
+func TestVerifyDkim(t *testing.T) {
+	signed, record := dkimSigned(t)
+	dns := func(ctx context.Context, domain string) ([]string, error) {
+		if domain != "s1._domainkey.example.org" {
+			return nil, errors.New("no such host")
+		}
+		return []string{record}, nil
+	}
+	hang := func(ctx context.Context, domain string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		raw    string
+		lookup func(context.Context, string) ([]string, error)
+		ctx    context.Context
+		want   string
+	}{
+		{"pass", signed, dns, context.Background(), "pass example.org"},
+		{"body changed", strings.Replace(signed, "250", "950", 1), dns, context.Background(), "fail example.org: dkim: body hash did not verify"},
+		{"no key", signed, func(context.Context, string) ([]string, error) { return nil, nil }, context.Background(), "permerror example.org: dkim: no valid key found"},
+		{"lookup past the deadline", signed, hang, cancelled, "temperror example.org: dkim: key unavailable"},
+		{"unsigned", unsigned, dns, context.Background(), "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := LookupTXT
+			LookupTXT = tt.lookup
+			defer func() { LookupTXT = prev }()
+
+			if got := verified(tt.ctx, tt.raw).Dkim; !strings.HasPrefix(got, tt.want) {
+				t.Errorf("Dkim = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Returns a certificate signed by parent, self signed if parent is nil
+func certificate(t *testing.T, name string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: name},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		EmailAddresses: []string{strings.ToLower(strings.ReplaceAll(name, " ", ".")) + "@example.org"},
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, key
+}
+
+// Returns a multipart/signed message with a detached signature of the signer
+func smimeSigned(t *testing.T, signer *x509.Certificate, key *rsa.PrivateKey, ca *x509.Certificate) string {
+	content := "Content-Type: text/plain\r\n\r\nSigned text\r\n"
+	sd, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSignerChain(signer, key, []*x509.Certificate{ca}, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	sig, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("From: john.doe@example.org\r\nSubject: Signed\r\nMIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=\"b1\"\r\n\r\n")
+	fmt.Fprintf(&b, "--b1\r\n%s\r\n--b1\r\n", content)
+	b.WriteString("Content-Type: application/pkcs7-signature; name=smime.p7s\r\nContent-Transfer-Encoding: base64\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=smime.p7s\r\n\r\n")
+	b.WriteString(base64.StdEncoding.EncodeToString(sig) + "\r\n--b1--\r\n")
+	return b.String()
+}
+
+func TestVerifySmime(t *testing.T) {
+	noDns(t)
+	ca, caKey := certificate(t, "Test CA", nil, nil)
+	leaf, leafKey := certificate(t, "John Doe", ca, caKey)
+	raw := smimeSigned(t, leaf, leafKey, ca)
+	other, _ := certificate(t, "Other CA", nil, nil)
+
+	prev := TrustStore
+	defer func() { TrustStore = prev }()
+	tests := []struct {
+		name  string
+		roots *x509.Certificate
+		raw   string
+		want  string
+	}{
+		{"signer trusted", ca, raw, "pass John Doe <john.doe@example.org>"},
+		{"signer not trusted", other, raw, "fail John Doe <john.doe@example.org>"},
+		{"content changed", ca, strings.Replace(raw, "Signed text", "Signed test", 1), "fail"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			TrustStore = x509.NewCertPool()
+			TrustStore.AddCert(tt.roots)
+			if got := verified(context.Background(), tt.raw).Smime; !strings.HasPrefix(got, tt.want) {
+				t.Errorf("Smime = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The raw message is only kept when signatures are checked, and dropped once they are
+func TestVerifyInputs(t *testing.T) {
+	noDns(t)
+	var m Message
+	m.parse(strings.NewReader(unsigned), 0, discard)
+	if m.pending != nil {
+		t.Error("inputs kept without keepAuth")
+	}
+
+	msgs := []Message{{keepAuth: true}}
+	msgs[0].parse(strings.NewReader(unsigned), 0, discard)
+	if msgs[0].pending == nil || len(msgs[0].pending.raw) == 0 {
+		t.Fatal("inputs not kept with keepAuth")
+	}
+	Verify(context.Background(), msgs)
+	if msgs[0].pending != nil {
+		t.Error("inputs kept after Verify")
+	}
+}
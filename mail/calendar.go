@@ -0,0 +1,397 @@
+package mail
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// Timezones of invites are resolved even without zoneinfo on the host
+	_ "time/tzdata"
+)
+
+// A VEVENT read from a text/calendar part
+type Event struct {
+	// METHOD of the calendar eg: REQUEST, CANCEL, REPLY
+	Method    string
+	Uid       string
+	Summary   string
+	Organizer string
+	// Attendees as "Name <address>"
+	Attendees []string
+	// Start and End in the event timezone
+	Start time.Time
+	End   time.Time
+	// Start and End are dates without a time
+	AllDay bool
+	// TZID of the start, empty for utc and floating times
+	Timezone string
+	Location string
+	// RRULE of recurring events eg: FREQ=WEEKLY;BYDAY=MO
+	Rrule string
+}
+
+// Windows timezone names used by Outlook mapped to IANA names
+var windowsZones = map[string]string{
+	"UTC":                             "UTC",
+	"GMT Standard Time":               "Europe/London",
+	"Greenwich Standard Time":         "Atlantic/Reykjavik",
+	"W. Europe Standard Time":         "Europe/Berlin",
+	"Central Europe Standard Time":    "Europe/Budapest",
+	"Romance Standard Time":           "Europe/Paris",
+	"Central European Standard Time":  "Europe/Warsaw",
+	"E. Europe Standard Time":         "Europe/Chisinau",
+	"FLE Standard Time":               "Europe/Kiev",
+	"GTB Standard Time":               "Europe/Bucharest",
+	"Russian Standard Time":           "Europe/Moscow",
+	"Turkey Standard Time":            "Europe/Istanbul",
+	"Israel Standard Time":            "Asia/Jerusalem",
+	"Arabian Standard Time":           "Asia/Dubai",
+	"Pakistan Standard Time":          "Asia/Karachi",
+	"India Standard Time":             "Asia/Kolkata",
+	"SE Asia Standard Time":           "Asia/Bangkok",
+	"China Standard Time":             "Asia/Shanghai",
+	"Singapore Standard Time":         "Asia/Singapore",
+	"Tokyo Standard Time":             "Asia/Tokyo",
+	"Korea Standard Time":             "Asia/Seoul",
+	"AUS Eastern Standard Time":       "Australia/Sydney",
+	"New Zealand Standard Time":       "Pacific/Auckland",
+	"Eastern Standard Time":           "America/New_York",
+	"Central Standard Time":           "America/Chicago",
+	"Mountain Standard Time":          "America/Denver",
+	"US Mountain Standard Time":       "America/Phoenix",
+	"Pacific Standard Time":           "America/Los_Angeles",
+	"Alaskan Standard Time":           "America/Anchorage",
+	"Hawaiian Standard Time":          "Pacific/Honolulu",
+	"Atlantic Standard Time":          "America/Halifax",
+	"E. South America Standard Time":  "America/Sao_Paulo",
+	"Argentina Standard Time":         "America/Buenos_Aires",
+	"South Africa Standard Time":      "Africa/Johannesburg",
+	"Egypt Standard Time":             "Africa/Cairo",
+	"W. Central Africa Standard Time": "Africa/Lagos",
+}
+
+// A content line of an iCalendar object eg: DTSTART;TZID=Europe/Paris:20240101T100000
+type icsLine struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// A component of an iCalendar object eg: VEVENT or VTIMEZONE
+type icsComponent struct {
+	name     string
+	props    []icsLine
+	children []*icsComponent
+}
+
+// Returns the first property with the given name
+func (c *icsComponent) prop(name string) (icsLine, bool) {
+	for _, p := range c.props {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return icsLine{}, false
+}
+
+// Returns the value of the first property with the given name
+func (c *icsComponent) value(name string) string {
+	p, _ := c.prop(name)
+	return p.value
+}
+
+// Parses the VEVENTs of an iCalendar object
+// Lines that can not be read are skipped, the error describes the first one
+func ParseCalendar(b []byte) ([]Event, error) {
+	var firstErr error
+	root := &icsComponent{}
+	stack := []*icsComponent{root}
+
+	for _, raw := range unfold(string(b)) {
+		l, err := parseLine(raw)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		cur := stack[len(stack)-1]
+		switch l.name {
+		case "BEGIN":
+			c := &icsComponent{name: strings.ToUpper(l.value)}
+			cur.children = append(cur.children, c)
+			stack = append(stack, c)
+		case "END":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			cur.props = append(cur.props, l)
+		}
+	}
+
+	var events []Event
+	for _, cal := range root.children {
+		if cal.name != "VCALENDAR" {
+			continue
+		}
+		zones := make(map[string]*time.Location)
+		for _, c := range cal.children {
+			if c.name == "VTIMEZONE" {
+				zones[c.value("TZID")] = vtimezone(c)
+			}
+		}
+		method := strings.ToUpper(cal.value("METHOD"))
+		for _, c := range cal.children {
+			if c.name != "VEVENT" {
+				continue
+			}
+			e, err := event(c, method, zones)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			events = append(events, e)
+		}
+	}
+
+	if len(events) == 0 && firstErr == nil {
+		firstErr = fmt.Errorf("no VEVENT found")
+	}
+	return events, firstErr
+}
+
+// Reads a VEVENT component
+func event(c *icsComponent, method string, zones map[string]*time.Location) (Event, error) {
+	e := Event{
+		Method:   method,
+		Uid:      c.value("UID"),
+		Summary:  icsText(c.value("SUMMARY")),
+		Location: icsText(c.value("LOCATION")),
+		Rrule:    c.value("RRULE"),
+	}
+	if p, ok := c.prop("ORGANIZER"); ok {
+		e.Organizer = calAddress(p)
+	}
+	for _, p := range c.props {
+		if p.name == "ATTENDEE" {
+			e.Attendees = append(e.Attendees, calAddress(p))
+		}
+	}
+
+	var err error
+	if p, ok := c.prop("DTSTART"); ok {
+		e.Start, e.AllDay, err = icsTime(p, zones)
+		if tz := p.params["TZID"]; tz != "" && !e.AllDay {
+			e.Timezone = tz
+		}
+	}
+	if p, ok := c.prop("DTEND"); ok {
+		var perr error
+		e.End, _, perr = icsTime(p, zones)
+		if err == nil {
+			err = perr
+		}
+	} else if d, ok := c.prop("DURATION"); ok && !e.Start.IsZero() {
+		dur, perr := icsDuration(d.value)
+		if err == nil {
+			err = perr
+		}
+		e.End = e.Start.Add(dur)
+	} else if e.AllDay {
+		// All day events without an end last one day
+		e.End = e.Start.AddDate(0, 0, 1)
+	}
+	return e, err
+}
+
+// Joins folded lines, continuation lines start with a space or a tab
+func unfold(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// Parses a content line name *(";" param) ":" value
+// Colons and semicolons inside quoted parameter values are kept
+func parseLine(l string) (icsLine, error) {
+	quoted := false
+	colon := -1
+	for i := 0; i < len(l) && colon < 0; i++ {
+		switch l[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				colon = i
+			}
+		}
+	}
+	if colon < 0 {
+		return icsLine{}, fmt.Errorf("malformed line %q", l)
+	}
+
+	head := l[:colon]
+	out := icsLine{value: l[colon+1:], params: make(map[string]string)}
+	var parts []string
+	quoted = false
+	start := 0
+	for i := 0; i < len(head); i++ {
+		switch head[i] {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				parts = append(parts, head[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, head[start:])
+
+	out.name = strings.ToUpper(strings.TrimSpace(parts[0]))
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		out.params[strings.ToUpper(strings.TrimSpace(k))] = strings.Trim(v, `"`)
+	}
+	return out, nil
+}
+
+// Unescapes a TEXT value
+func icsText(s string) string {
+	return strings.TrimSpace(strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s))
+}
+
+// Formats an ORGANIZER or ATTENDEE property as "Name <address>"
+func calAddress(p icsLine) string {
+	addr := strings.TrimSpace(p.value)
+	if len(addr) > 7 && strings.EqualFold(addr[:7], "mailto:") {
+		addr = addr[7:]
+	}
+	if name := p.params["CN"]; name != "" && name != addr {
+		return fmt.Sprintf("%s <%s>", name, addr)
+	}
+	return addr
+}
+
+// Parses a DATE or DATE-TIME value
+// Times with a TZID are read in that zone, floating times are read as utc
+// Returns true for DATE values
+func icsTime(p icsLine, zones map[string]*time.Location) (time.Time, bool, error) {
+	v := strings.TrimSpace(p.value)
+	if p.params["VALUE"] == "DATE" || len(v) == 8 {
+		t, err := time.Parse("20060102", v)
+		if err != nil {
+			return time.Time{}, true, fmt.Errorf("invalid date %q", v)
+		}
+		return t, true, nil
+	}
+
+	if strings.HasSuffix(v, "Z") {
+		t, err := time.Parse("20060102T150405Z", v)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid date time %q", v)
+		}
+		return t, false, nil
+	}
+
+	loc := time.UTC
+	if tz := p.params["TZID"]; tz != "" {
+		loc = location(tz, zones)
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid date time %q", v)
+	}
+	return t, false, nil
+}
+
+// Resolves a TZID
+// Tries IANA names, then Windows names, then the VTIMEZONE definition, falling back to utc
+func location(tz string, zones map[string]*time.Location) *time.Location {
+	name := strings.Trim(tz, "/ ")
+	if loc, err := time.LoadLocation(name); err == nil {
+		return loc
+	}
+	if iana, ok := windowsZones[name]; ok {
+		if loc, err := time.LoadLocation(iana); err == nil {
+			return loc
+		}
+	}
+	if loc := zones[tz]; loc != nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// Returns a fixed zone from the STANDARD offset of a VTIMEZONE, nil if missing
+// Daylight saving rules are not applied
+func vtimezone(c *icsComponent) *time.Location {
+	for _, s := range c.children {
+		if s.name != "STANDARD" {
+			continue
+		}
+		off, ok := utcOffset(s.value("TZOFFSETTO"))
+		if !ok {
+			return nil
+		}
+		return time.FixedZone(c.value("TZID"), off)
+	}
+	return nil
+}
+
+// Parses an offset like +0530 or -0800 to seconds
+func utcOffset(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) != 5 && len(s) != 7 {
+		return 0, false
+	}
+	sign := 1
+	switch s[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(s[1:3])
+	m, err2 := strconv.Atoi(s[3:5])
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return sign * (h*3600 + m*60), true
+}
+
+// Matches a DURATION value eg: PT1H30M, P1D, P2W
+var durationRe = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Parses a DURATION value
+func icsDuration(s string) (time.Duration, error) {
+	m := durationRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, u := range units {
+		if n, err := strconv.Atoi(m[i+2]); err == nil {
+			d += time.Duration(n) * u
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
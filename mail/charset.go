@@ -0,0 +1,392 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Charsets mislabelled by common mail clients mapped to the charset actually used
+var charsetAliases = map[string]string{
+	"ks_c_5601-1987": "euc-kr",
+	"ks_c_5601":      "euc-kr",
+	"gb2312":         "gb18030",
+	"gbk":            "gb18030",
+	"x-gbk":          "gb18030",
+	"cp936":          "gb18030",
+	"x-sjis":         "shift_jis",
+	"sjis":           "shift_jis",
+	"cp932":          "windows-31j",
+	"x-euc-jp":       "euc-jp",
+	"cp1250":         "windows-1250",
+	"cp1251":         "windows-1251",
+	"cp1252":         "windows-1252",
+	"x-cp1251":       "windows-1251",
+	"iso-8859-8-i":   "iso-8859-8",
+	"utf8":           "utf-8",
+	"x-unknown":      "windows-1252",
+	"unknown-8bit":   "windows-1252",
+}
+
+// Decodes every charset supported by golang.org/x/text
+// Registered with go-message so bodies, headers and addresses are decoded to utf-8
+func charsetReader(cs string, input io.Reader) (io.Reader, error) {
+	cs = strings.ToLower(strings.Trim(cs, `"' `))
+	if a, ok := charsetAliases[cs]; ok {
+		cs = a
+	}
+	if cs == "utf-8" || cs == "us-ascii" || cs == "ascii" {
+		return input, nil
+	}
+	return charset.Reader(cs, input)
+}
+
+func init() {
+	message.CharsetReader = charsetReader
+}
+
+// Converts b from the given charset to utf-8
+// Falls back to windows-1252 if the charset is unknown and b is not valid utf-8
+// Returns a warning describing the fallback, if any
+func toUtf8(cs string, b []byte) (string, string) {
+	r, err := charsetReader(cs, bytes.NewReader(b))
+	if err == nil {
+		if out, err := io.ReadAll(r); err == nil {
+			return string(out), ""
+		}
+	}
+	if utf8.Valid(b) {
+		return string(b), fmt.Sprintf("unknown charset %q, read as utf-8", cs)
+	}
+	return latin(b), fmt.Sprintf("unknown charset %q, read as windows-1252", cs)
+}
+
+// Decodes bytes as windows-1252
+func latin(b []byte) string {
+	out, _ := charmap.Windows1252.NewDecoder().Bytes(b)
+	return string(out)
+}
+
+// Matches an encoded word, tolerating spaces and missing padding in the encoded text
+var encodedWord = regexp.MustCompile(`=\?([^?\s]+)\?([bBqQ])\?([^?]*)\?=`)
+
+// Decodes RFC 2047 encoded words of a header value
+// Tries the standard decoder first, then decodes each word on its own,
+// joining adjacent words of the same charset so split multi byte characters survive
+// Raw 8 bit values that are not utf-8 are read as windows-1252
+// Returns the decoded value and the warnings of every fallback used
+func decodeHeader(s string) (string, []string) {
+	dec := mime.WordDecoder{CharsetReader: charsetReader}
+	if out, err := dec.DecodeHeader(s); err == nil && utf8.ValidString(out) {
+		return out, nil
+	}
+
+	var warns []string
+	if !utf8.ValidString(s) {
+		warns = append(warns, "raw 8 bit header read as windows-1252")
+		s = latin([]byte(s))
+	}
+
+	var sb strings.Builder
+	var pending []byte
+	pendingCs := ""
+	flush := func() {
+		if pending == nil {
+			return
+		}
+		out, warn := toUtf8(pendingCs, pending)
+		if warn != "" {
+			warns = append(warns, warn)
+		}
+		sb.WriteString(out)
+		pending, pendingCs = nil, ""
+	}
+
+	last := 0
+	for _, m := range encodedWord.FindAllStringSubmatchIndex(s, -1) {
+		between := s[last:m[0]]
+		// Whitespace between adjacent encoded words is dropped
+		if strings.TrimSpace(between) != "" || last == 0 {
+			flush()
+			sb.WriteString(between)
+		}
+		last = m[1]
+
+		// Drop the RFC 2231 language suffix eg: utf-8*en
+		cs := strings.ToLower(strings.SplitN(s[m[2]:m[3]], "*", 2)[0])
+		text := s[m[6]:m[7]]
+
+		var b []byte
+		var err error
+		if strings.EqualFold(s[m[4]:m[5]], "b") {
+			b, err = decodeB(text)
+		} else {
+			b, err = decodeQ(text)
+		}
+		if err != nil {
+			warns = append(warns, fmt.Sprintf("malformed encoded word %q", s[m[0]:m[1]]))
+		}
+
+		if cs != pendingCs {
+			flush()
+		}
+		pendingCs = cs
+		pending = append(pending, b...)
+	}
+	flush()
+	sb.WriteString(s[last:])
+
+	return sb.String(), warns
+}
+
+// Decodes base64 tolerating missing padding, spaces and stray characters
+func decodeB(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	s = strings.TrimRight(s, "=")
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err == nil {
+		return b, nil
+	}
+	// Keep whatever decodes before the bad character
+	if e, ok := err.(base64.CorruptInputError); ok {
+		b, _ = base64.RawStdEncoding.DecodeString(s[:int(e)/4*4])
+	}
+	return b, err
+}
+
+// Decodes the Q encoding, invalid escapes are kept as is
+func decodeQ(s string) ([]byte, error) {
+	var err error
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '_':
+			b = append(b, ' ')
+		case c == '=' && i+2 < len(s):
+			v, perr := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if perr != nil {
+				err = perr
+				b = append(b, c)
+				continue
+			}
+			b = append(b, byte(v))
+			i += 2
+		default:
+			b = append(b, c)
+		}
+	}
+	return b, err
+}
+
+// Returns the decoded parameter of a header value like Content-Disposition
+// Handles RFC 2231 extended values in any charset, eg: filename*=iso-8859-1'fr'caf%E9.pdf
+// and continuations, eg: filename*0*=utf-8'en'a; filename*1=b.pdf
+// Plain values are decoded as encoded words, a non standard but common practice
+// Returns the warnings of every fallback used
+func headerParam(v, name string) (string, []string) {
+	params := splitParams(v)
+
+	// Extended single value
+	if ext, ok := params[name+"*"]; ok {
+		return decode2231(ext, true)
+	}
+
+	// Continuations
+	if _, ok := params[name+"*0"]; ok || params[name+"*0*"] != "" {
+		var raw strings.Builder
+		encoded := false
+		for i := 0; ; i++ {
+			k := fmt.Sprintf("%s*%d", name, i)
+			if p, ok := params[k+"*"]; ok {
+				if i == 0 {
+					encoded = true
+				}
+				raw.WriteString(p)
+			} else if p, ok := params[k]; ok {
+				// Plain pieces of an encoded value must be escaped before joining
+				if encoded {
+					p = url.PathEscape(p)
+				}
+				raw.WriteString(p)
+			} else {
+				break
+			}
+		}
+		return decode2231(raw.String(), encoded)
+	}
+
+	if p, ok := params[name]; ok {
+		return decodeHeader(p)
+	}
+	return "", nil
+}
+
+// Decodes an RFC 2231 value charset'language'percent-encoded-text
+func decode2231(v string, encoded bool) (string, []string) {
+	if !encoded {
+		return decodeHeader(v)
+	}
+
+	parts := strings.SplitN(v, "'", 3)
+	if len(parts) != 3 {
+		return decodeHeader(v)
+	}
+
+	var warns []string
+	b, err := url.PathUnescape(parts[2])
+	if err != nil {
+		warns = append(warns, fmt.Sprintf("malformed RFC 2231 value %q", v))
+		b = parts[2]
+	}
+	out, warn := toUtf8(parts[0], []byte(b))
+	if warn != "" {
+		warns = append(warns, warn)
+	}
+	return out, warns
+}
+
+// Splits the parameters of a header value, keys are lower cased
+// Quoted values are unquoted, malformed parameters are skipped
+func splitParams(v string) map[string]string {
+	params := make(map[string]string)
+
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case ';':
+			if !quoted {
+				parts = append(parts, v[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, v[start:])
+
+	// The first part is the value itself
+	for _, p := range parts[1:] {
+		k, val, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(val[1 : len(val)-1])
+		}
+		params[k] = val
+	}
+	return params
+}
+
+// Returns the file name of a part
+// Reads the filename parameter of Content-Disposition, falling back to the name parameter of Content-Type
+func (m *Message) filename(h interface{ Get(string) string }) string {
+	for _, f := range []struct{ header, param string }{
+		{"Content-Disposition", "filename"},
+		{"Content-Type", "name"},
+	} {
+		name, warns := headerParam(h.Get(f.header), f.param)
+		for _, w := range warns {
+			m.warn("%s: %s", f.header, w)
+		}
+		if name != "" {
+			return strings.TrimSpace(name)
+		}
+	}
+	return ""
+}
+
+// Returns the decoded text of a header field
+func (m *Message) headerText(h mail.Header, key string) string {
+	out, warns := decodeHeader(h.Get(key))
+	for _, w := range warns {
+		m.warn("%s: %s", key, w)
+	}
+	return out
+}
+
+// Returns the addresses of a header field
+// Falls back to decoding the field as text and splitting it on commas
+func (m *Message) addressList(h mail.Header, key string) []string {
+	list, err := h.AddressList(key)
+	if err == nil {
+		return formatAddresses(list)
+	}
+
+	text := m.headerText(h, key)
+	if list, err := mail.ParseAddressList(text); err == nil {
+		return formatAddresses(list)
+	}
+
+	m.warn("%s: unable to parse addresses, kept as text: %v", key, err)
+	var si []string
+	for _, a := range strings.Split(text, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			si = append(si, a)
+		}
+	}
+	return si
+}
+
+// Formats addresses as "Name <user@host>"
+// Unlike mail.Address.String names are kept in utf-8 instead of being encoded again
+func formatAddresses(list []*mail.Address) []string {
+	si := make([]string, 0, len(list))
+	for _, v := range list {
+		if v.Name == "" {
+			si = append(si, "<"+v.Address+">")
+			continue
+		}
+		si = append(si, fmt.Sprintf("%s <%s>", v.Name, v.Address))
+	}
+	return si
+}
+
+// Decodes a text body read from a part
+// go-message converts known charsets, anything left that is not utf-8 is read as windows-1252
+func (m *Message) bodyText(b []byte, params map[string]string) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	m.warn("body: invalid %q text read as windows-1252", params["charset"])
+	return latin(b)
+}
+
+// Records a decode fallback, duplicates are dropped
+func (m *Message) warn(format string, args ...interface{}) {
+	w := fmt.Sprintf(format, args...)
+	for _, e := range m.Warnings {
+		if e == w {
+			return
+		}
+	}
+	m.Warnings = append(m.Warnings, w)
+}
@@ -0,0 +1,195 @@
+package mail
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Extension fetch items
+const (
+	fetchModSeq   imap.FetchItem = "MODSEQ"
+	fetchGmLabels imap.FetchItem = "X-GM-LABELS"
+	fetchGmThrid  imap.FetchItem = "X-GM-THRID"
+)
+
+// Capabilities used by the extension items
+const (
+	capCondstore = "CONDSTORE"
+	capGmail     = "X-GM-EXT-1"
+)
+
+// Returns true if the server announces the capability
+func (m *Mail) Support(capability string) bool {
+	ok, err := m.con.Support(capability)
+	return err == nil && ok
+}
+
+// Returns the UIDVALIDITY of the INBOX folder
+// Uids and mod sequences of a previous sync are only valid while it is unchanged
+func (m *Mail) UidValidity() uint32 {
+	return m.ibox.UidValidity
+}
+
+// Returns the highest mod sequence of the INBOX folder, 0 without CONDSTORE
+func (m *Mail) HighestModSeq() uint64 {
+	if !m.Support(capCondstore) {
+		return 0
+	}
+	return m.modSeq
+}
+
+// SELECT response handler that also reads the HIGHESTMODSEQ response code
+type selectResponse struct {
+	responses.Select
+	modSeq uint64
+}
+
+func (r *selectResponse) Handle(resp imap.Resp) error {
+	if s, ok := resp.(*imap.StatusResp); ok && s.Code == "HIGHESTMODSEQ" && len(s.Arguments) > 0 {
+		r.modSeq, _ = parseNumber64(s.Arguments[0])
+		return nil
+	}
+	return r.Select.Handle(resp)
+}
+
+// Returns the messages whose flags or labels changed after the given mod sequence
+// Only the Id, Uid, Flags, Labels and ModSeq fields are set
+// Returns no messages if the server does not support CONDSTORE or modseq is 0
+func (m *Mail) FlagChanges(modseq uint64) ([]Message, error) {
+	if modseq == 0 || !m.Support(capCondstore) {
+		return nil, nil
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchEnvelope, fetchModSeq}
+	if m.Support(capGmail) {
+		items = append(items, fetchGmLabels)
+	}
+
+	seqset, _ := imap.ParseSeqSet("1:*")
+	cmd := &commands.Uid{Cmd: &changedSince{seqset: seqset, items: items, modseq: modseq}}
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		defer close(messages)
+		status, err := m.con.Execute(cmd, &responses.Fetch{Messages: messages, SeqSet: seqset, Uid: true})
+		if err == nil {
+			err = status.Err()
+		}
+		done <- err
+	}()
+
+	var msgs []Message
+	for msg := range messages {
+		var c Message
+		if msg.Envelope != nil {
+			c.Id = msg.Envelope.MessageId
+		}
+		c.setImap(msg)
+		msgs = append(msgs, c)
+	}
+	if err := <-done; err != nil {
+		m.failed = true
+		return nil, fmt.Errorf("unable to fetch flag changes. err: %v", err)
+	}
+	return msgs, nil
+}
+
+// Returns the items fetched with every message
+// Gmail labels and mod sequences are fetched when the server supports them
+func (m *Mail) fetchItems() []imap.FetchItem {
+	items := []imap.FetchItem{
+		imap.FetchItem("BODY.PEEK[]"), imap.FetchEnvelope,
+		imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size,
+	}
+	if m.Support(capGmail) {
+		items = append(items, fetchGmLabels, fetchGmThrid)
+	}
+	if m.Support(capCondstore) {
+		items = append(items, fetchModSeq)
+	}
+	return items
+}
+
+// Sets the imap attributes of a fetched message
+func (m *Message) setImap(msg *imap.Message) {
+	m.Uid = msg.Uid
+	m.Flags = msg.Flags
+	m.InternalDate = msg.InternalDate.UTC()
+	m.Size = msg.Size
+
+	if v, ok := msg.Items[fetchModSeq].([]interface{}); ok && len(v) > 0 {
+		m.ModSeq, _ = parseNumber64(v[0])
+	}
+	if v, ok := msg.Items[fetchGmThrid]; ok && v != nil {
+		n, _ := parseNumber64(v)
+		m.ThreadId = strconv.FormatUint(n, 16)
+	}
+	if v, ok := msg.Items[fetchGmLabels].([]interface{}); ok {
+		m.Labels = make([]string, 0, len(v))
+		for _, l := range v {
+			s, err := imap.ParseString(l)
+			if err != nil {
+				continue
+			}
+			// Labels are mailbox names, encoded in modified utf-7
+			if d, err := utf7.Encoding.NewDecoder().String(s); err == nil {
+				s = d
+			}
+			m.Labels = append(m.Labels, s)
+		}
+	}
+}
+
+// Returns true if the message has the \Seen flag
+func (m *Message) Seen() bool {
+	return m.HasFlag(imap.SeenFlag)
+}
+
+// Returns true if the message has the given flag, case insensitive
+func (m *Message) HasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// UID FETCH with the CHANGEDSINCE modifier, RFC 7162
+type changedSince struct {
+	seqset *imap.SeqSet
+	items  []imap.FetchItem
+	modseq uint64
+}
+
+func (cmd *changedSince) Command() *imap.Command {
+	items := make([]interface{}, len(cmd.items))
+	for i, item := range cmd.items {
+		items[i] = imap.RawString(item)
+	}
+	modifiers := []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(cmd.modseq, 10))}
+	return &imap.Command{
+		Name:      "FETCH",
+		Arguments: []interface{}{cmd.seqset, items, modifiers},
+	}
+}
+
+// Parses a 64 bit number, mod sequences and Gmail ids do not fit imap.ParseNumber
+func parseNumber64(f interface{}) (uint64, error) {
+	switch f := f.(type) {
+	case string:
+		return strconv.ParseUint(f, 10, 64)
+	case imap.RawString:
+		return strconv.ParseUint(string(f), 10, 64)
+	case uint32:
+		return uint64(f), nil
+	}
+	return 0, fmt.Errorf("expected a number, got %T", f)
+}
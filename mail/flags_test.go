@@ -0,0 +1,27 @@
+package mail
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+func TestSelectResponse(t *testing.T) {
+	mbox := &imap.MailboxStatus{Name: "INBOX", Items: make(map[imap.StatusItem]interface{})}
+	res := &selectResponse{Select: responses.Select{Mailbox: mbox}}
+	for _, resp := range []imap.Resp{
+		&imap.StatusResp{Type: imap.StatusRespOk, Code: "HIGHESTMODSEQ", Arguments: []interface{}{"90060115194045000"}},
+		&imap.StatusResp{Type: imap.StatusRespOk, Code: imap.CodeUidValidity, Arguments: []interface{}{uint32(42)}},
+	} {
+		if err := res.Handle(resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res.modSeq != 90060115194045000 {
+		t.Errorf("modSeq = %d, want 90060115194045000", res.modSeq)
+	}
+	if mbox.UidValidity != 42 {
+		t.Errorf("UidValidity = %d, want 42", mbox.UidValidity)
+	}
+}
@@ -0,0 +1,384 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Elements dropped by Sanitize along with their content
+var unsafeTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Iframe: true, atom.Frame: true, atom.Frameset: true,
+	atom.Object: true, atom.Embed: true, atom.Applet: true, atom.Form: true,
+	atom.Input: true, atom.Button: true, atom.Textarea: true, atom.Select: true,
+	atom.Link: true, atom.Meta: true, atom.Base: true, atom.Noscript: true,
+	atom.Svg: true, atom.Math: true, atom.Style: true,
+}
+
+// Attributes holding urls
+var urlAttrs = map[string]bool{"href": true, "src": true, "background": true, "action": true, "poster": true, "lowsrc": true, "dynsrc": true}
+
+// Url attributes loaded by the browser when the body is opened, links are only followed on click
+var loadAttrs = map[string]bool{"src": true, "background": true, "poster": true, "lowsrc": true, "dynsrc": true}
+
+// Url schemes kept by Sanitize, data: only for images. Relative urls have no scheme
+var safeSchemes = map[string]bool{"http": true, "https": true, "mailto": true, "cid": true, "data": true}
+
+// CSS url() references of style attributes
+var cssUrl = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)]*?))\s*\)`)
+
+// Elements never rendered as text
+var skipText = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Head: true, atom.Title: true,
+	atom.Noscript: true, atom.Template: true,
+}
+
+// Elements rendered on their own lines
+var blockText = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true,
+	atom.Header: true, atom.Footer: true, atom.Blockquote: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Ul: true, atom.Ol: true, atom.Table: true, atom.Hr: true, atom.Pre: true,
+}
+
+// Converts a html body to readable plain text
+// Links are written as "text <url>", list items are prefixed with "- " or their number
+// and table cells are separated by " | ", one row per line
+func HtmlToText(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return ""
+	}
+
+	t := &textWriter{}
+	t.node(doc)
+
+	// Collapse blank lines and trailing spaces
+	lines := strings.Split(t.sb.String(), "\n")
+	out := make([]string, 0, len(lines))
+	blank := true
+	for _, l := range lines {
+		l = strings.TrimRight(l, " ")
+		if l == "" {
+			if !blank {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		out = append(out, l)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// Renders html nodes as text
+type textWriter struct {
+	sb strings.Builder
+	// Nesting of lists, each entry is the next item number or 0 for unordered lists
+	lists []int
+	// Inside a pre element, whitespace is kept
+	pre int
+	// Last written character was a space or a line break
+	space bool
+}
+
+func (t *textWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	t.sb.WriteString(s)
+	t.space = strings.HasSuffix(s, " ") || strings.HasSuffix(s, "\n")
+}
+
+// Starts a new line unless already at the start of one
+func (t *textWriter) newline() {
+	if s := t.sb.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		t.sb.WriteString("\n")
+	}
+	t.space = true
+}
+
+// Ends the current line and leaves an empty one
+func (t *textWriter) blankline() {
+	t.newline()
+	if s := t.sb.String(); s != "" && !strings.HasSuffix(s, "\n\n") {
+		t.sb.WriteString("\n")
+	}
+}
+
+func (t *textWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if t.pre > 0 {
+			t.write(n.Data)
+			return
+		}
+		// Collapse whitespace like a browser would
+		words := strings.Fields(n.Data)
+		if len(words) == 0 {
+			if n.Data != "" && !t.space {
+				t.write(" ")
+			}
+			return
+		}
+		if !t.space && strings.TrimLeft(n.Data, " \t\r\n") != n.Data {
+			t.write(" ")
+		}
+		t.write(strings.Join(words, " "))
+		if strings.TrimRight(n.Data, " \t\r\n") != n.Data {
+			t.write(" ")
+		}
+		return
+	case html.ElementNode:
+	default:
+		t.children(n)
+		return
+	}
+
+	if skipText[n.DataAtom] {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		t.sb.WriteString("\n")
+		t.space = true
+		return
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			t.write("[" + alt + "]")
+		}
+		return
+	case atom.A:
+		start := t.sb.Len()
+		t.children(n)
+		href := attr(n, "href")
+		text := strings.TrimSpace(t.sb.String()[start:])
+		// Skip anchors and links whose text already is the url
+		if href != "" && !strings.HasPrefix(href, "#") && safeUrl(strings.ToLower(cleanUrl(href))) &&
+			text != href && "mailto:"+text != href {
+			t.write(" <" + href + ">")
+		}
+		return
+	case atom.Ul, atom.Ol:
+		next := 0
+		if n.DataAtom == atom.Ol {
+			next = 1
+			if v, err := strconv.Atoi(attr(n, "start")); err == nil {
+				next = v
+			}
+		}
+		t.lists = append(t.lists, next)
+		t.newline()
+		t.children(n)
+		t.lists = t.lists[:len(t.lists)-1]
+		t.newline()
+		return
+	case atom.Li:
+		t.newline()
+		depth := len(t.lists)
+		if depth > 0 {
+			t.write(strings.Repeat("  ", depth-1))
+			if next := t.lists[depth-1]; next > 0 {
+				t.write(fmt.Sprintf("%d. ", next))
+				t.lists[depth-1]++
+			} else {
+				t.write("- ")
+			}
+		} else {
+			t.write("- ")
+		}
+		t.children(n)
+		return
+	case atom.Tr:
+		t.newline()
+		first := true
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || (c.DataAtom != atom.Td && c.DataAtom != atom.Th) {
+				continue
+			}
+			if !first {
+				t.write(" | ")
+			}
+			first = false
+			t.children(c)
+		}
+		return
+	case atom.Pre:
+		t.newline()
+		t.pre++
+		t.children(n)
+		t.pre--
+		t.newline()
+		return
+	case atom.Hr:
+		t.newline()
+		t.write("----")
+		t.newline()
+		return
+	}
+
+	if blockText[n.DataAtom] {
+		t.blankline()
+		t.children(n)
+		t.blankline()
+		return
+	}
+	t.children(n)
+}
+
+func (t *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		t.node(c)
+	}
+}
+
+// Returns a safe copy of a html body
+// Drops scripts, frames, forms, event handlers and urls of schemes other than http, https, mailto, cid and data:image
+// Drops style sheets, tracking pixels, images of 1x1 or hidden images
+// Rewrites cid: references using cids, a map of Content-ID to url
+// Drops every other resource loaded on open, remote images and CSS url(), so opening the body
+// tells no sender it was read. Images left without a source are dropped
+func Sanitize(s string, cids map[string]string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return ""
+	}
+	sanitize(doc, cids)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+func sanitize(n *html.Node, cids map[string]string) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode ||
+			(c.Type == html.ElementNode && (unsafeTags[c.DataAtom] || (c.DataAtom == atom.Img && isPixel(c)))) {
+			n.RemoveChild(c)
+			c = next
+			continue
+		}
+		if c.Type == html.ElementNode {
+			c.Attr = safeAttrs(c.Attr, cids)
+			if c.DataAtom == atom.Img && attr(c, "src") == "" {
+				n.RemoveChild(c)
+				c = next
+				continue
+			}
+			sanitize(c, cids)
+		}
+		c = next
+	}
+}
+
+// Drops event handlers, unsafe urls and remote resources, rewrites cid: urls
+func safeAttrs(attrs []html.Attribute, cids map[string]string) []html.Attribute {
+	out := attrs[:0]
+	for _, a := range attrs {
+		key := strings.ToLower(a.Key)
+		if strings.HasPrefix(key, "on") || key == "srcset" || key == "formaction" {
+			continue
+		}
+		if urlAttrs[key] {
+			v := cleanUrl(a.Val)
+			lower := strings.ToLower(v)
+			switch {
+			case !safeUrl(lower):
+				continue
+			case strings.HasPrefix(lower, "cid:"):
+				url, ok := cids[strings.Trim(v[4:], "<>")]
+				if !ok {
+					continue
+				}
+				a.Val = url
+			case loadAttrs[key] && !strings.HasPrefix(lower, "data:image/"):
+				continue
+			}
+		}
+		if key == "style" {
+			lower := strings.ToLower(a.Val)
+			// Escapes could hide url( from safeStyle, image-set() loads urls given as plain strings
+			if strings.Contains(lower, "expression(") || strings.Contains(lower, "@import") ||
+				strings.Contains(lower, "image-set(") || strings.Contains(lower, `\`) {
+				continue
+			}
+			a.Val = safeStyle(a.Val, cids)
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// Returns a url without the spaces, tabs, newlines and control characters browsers ignore,
+// so "java&#x09;script:" is read as the browser reads it
+func cleanUrl(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, v)
+}
+
+// Returns true if a lowercased url from cleanUrl is relative or of a scheme in safeSchemes
+func safeUrl(lower string) bool {
+	i := strings.IndexAny(lower, ":/?#")
+	if i < 0 || lower[i] != ':' {
+		return true
+	}
+	scheme := lower[:i]
+	return safeSchemes[scheme] && (scheme != "data" || strings.HasPrefix(lower, "data:image/"))
+}
+
+// Rewrites cid: references of CSS url() using cids, other urls are replaced with none
+func safeStyle(s string, cids map[string]string) string {
+	return cssUrl.ReplaceAllStringFunc(s, func(m string) string {
+		sub := cssUrl.FindStringSubmatch(m)
+		v := strings.TrimSpace(sub[1] + sub[2] + sub[3])
+		lower := strings.ToLower(v)
+		if strings.HasPrefix(lower, "cid:") {
+			if url, ok := cids[strings.Trim(v[4:], "<>")]; ok {
+				return `url("` + strings.NewReplacer(`"`, "%22", `\`, "%5C").Replace(url) + `")`
+			}
+		}
+		if strings.HasPrefix(lower, "data:image/") {
+			return m
+		}
+		return "none"
+	})
+}
+
+// Returns true if an image looks like a tracking pixel
+func isPixel(n *html.Node) bool {
+	if strings.HasPrefix(strings.ToLower(attr(n, "src")), "cid:") {
+		return false
+	}
+	w, h := attr(n, "width"), attr(n, "height")
+	if (w == "0" || w == "1") && (h == "0" || h == "1") {
+		return true
+	}
+	style := strings.ReplaceAll(strings.ToLower(attr(n, "style")), " ", "")
+	return strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") ||
+		(strings.Contains(style, "width:1px") && strings.Contains(style, "height:1px")) ||
+		(strings.Contains(style, "width:0") && strings.Contains(style, "height:0"))
+}
+
+// Returns the value of the attribute with the given key
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -1,15 +1,22 @@
 package mail
 
 import (
-	"crypto/rand"
-	"crypto/tls"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"slices"
 	"sort"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/metrics"
+	"github.com/tars47/go-read-mail/retry"
+	"github.com/tars47/go-read-mail/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Mail struct {
@@ -21,56 +28,156 @@ type Mail struct {
 	// For gmail it will be app password not regular
 	// For outlook it will be regular password
 	Pass string
+	// Keeps winmail.dat attachments after the files decoded from them
+	KeepTnef bool
+	// Keeps what Verify checks, the raw message among others, until it runs
+	// Left unset the raw bytes of a message are dropped once it is parsed
+	KeepAuth bool `json:"-"`
 	// Connection object to the imap server
 	con *client.Client
+	// Pooled session of con, nil when not pooled
+	sess *session
+	// Logger of the context given to Login
+	log *slog.Logger
 	// Inbox folder connection
 	ibox *imap.MailboxStatus
 	// Total number of messages in the INBOX folder
 	numMsgs uint32
+	// HIGHESTMODSEQ of the INBOX folder sent with the SELECT response
+	modSeq uint64
+	// Set when a command failed, the session may be broken and is not reused
+	failed bool
 }
 
 // Establishes the connection with given imap server
 // Logsin the user with given email and password
+// Reuses an authenticated connection of Sessions when available
 // Selects the INBOX folder
-func (m *Mail) Login() error {
-	log.Println("Connecting to server...")
+func (m *Mail) Login(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "imap.login", attribute.String("imap.host", metrics.Host(m.Addr)))
+	err := m.login(ctx)
+	span.SetAttributes(attribute.Bool("imap.pooled", m.sess != nil), attribute.Int64("inbox.messages", int64(m.numMsgs)))
+	tracing.End(span, err)
+	return err
+}
 
-	conf := &tls.Config{
-		Rand: rand.Reader,
+// Connects, or checks out a pooled session, and selects the INBOX folder
+func (m *Mail) login(ctx context.Context) error {
+	m.log = logging.From(ctx)
+	m.failed = false
+	if Sessions == nil {
+		con, err := dial(ctx, m.Addr, m.User, m.Pass)
+		if err != nil {
+			return err
+		}
+		m.con = con
+		return m.selectInbox()
 	}
 
-	// Connect to server
-	var err error
-	m.con, err = client.DialTLS(m.Addr, conf)
-	if err != nil {
-		return fmt.Errorf("unable to connect to %v. err: %v", m.Addr, err.Error())
+	// A reused connection may fail to SELECT if the server dropped it, retry once with a new one
+	for i := 0; ; i++ {
+		s, err := Sessions.get(ctx, m.Addr, m.User, m.Pass)
+		if err != nil {
+			return err
+		}
+		m.sess, m.con = s, s.con
+		if err = m.selectInbox(); err == nil {
+			return nil
+		}
+		Sessions.put(s, false)
+		m.sess, m.con = nil, nil
+		if i == 1 {
+			return err
+		}
 	}
-	log.Println("Connected")
+}
 
-	// Login
-	if err := m.con.Login(m.User, m.Pass); err != nil {
-		return fmt.Errorf("unable to login to %v. err: %v", m.User, err.Error())
+// Selects the INBOX folder, refreshing the message count and UIDVALIDITY
+// Same as client.Select, but also keeps the HIGHESTMODSEQ response code of CONDSTORE servers
+func (m *Mail) selectInbox() error {
+	mbox := &imap.MailboxStatus{Name: "INBOX", Items: make(map[imap.StatusItem]interface{})}
+	res := &selectResponse{Select: responses.Select{Mailbox: mbox}}
+	// The mailbox is set before the command so that the unilateral EXISTS and RECENT responses update it
+	m.con.SetState(imap.AuthenticatedState, mbox)
+	status, err := m.con.Execute(&commands.Select{Mailbox: "INBOX"}, res)
+	if err == nil {
+		err = status.Err()
 	}
-	log.Println("Logged in")
-
-	// Select Inbox
-	m.ibox, err = m.con.Select("INBOX", false)
 	if err != nil {
+		m.con.SetState(imap.AuthenticatedState, nil)
 		return fmt.Errorf("unable to read INBOX. err: %v", err.Error())
 	}
+	mbox.ReadOnly = status.Code == imap.CodeReadOnly
+	m.con.SetState(imap.SelectedState, mbox)
+	m.ibox, m.modSeq = mbox, res.modSeq
 	m.numMsgs = m.ibox.Messages
 	return nil
 }
 
 // Logs the user out
-// Closes the connection with the imap server
+// Pooled connections are returned to Sessions instead of being closed,
+// unless a command failed on them
+// Does nothing if the last Login failed, eg: when a reconnect could not reach the server
 func (m *Mail) Logout() {
+	if m.sess != nil {
+		Sessions.put(m.sess, !m.failed)
+		m.sess, m.con = nil, nil
+		return
+	}
+	if m.con == nil {
+		return
+	}
 	m.con.Logout()
-	fmt.Println("Loggedout")
+	m.con = nil
+	m.logger().Debug("logged out", "op", "logout")
 }
 
 // Fetches messages for a given range
-func (m *Mail) Fetch(from, to uint32) []Message {
+// Transient failures are retried on a new connection, see retry.Imap
+func (m *Mail) Fetch(ctx context.Context, from, to uint32) ([]Message, error) {
+	ctx, span := tracing.Start(ctx, "imap.fetch", attribute.String("imap.host", metrics.Host(m.Addr)),
+		attribute.Int64("from", int64(from)), attribute.Int64("to", int64(to)))
+	start := time.Now()
+	var msgs []Message
+	attempt := 0
+	err := retry.Do(ctx, "fetch", retry.Imap, func() error {
+		// The connection of a failed FETCH is not reused
+		if attempt++; attempt > 1 {
+			if err := m.reconnect(ctx); err != nil {
+				return err
+			}
+		}
+		var err error
+		msgs, err = m.fetch(ctx, from, to)
+		return err
+	})
+	metrics.ObserveImap(m.Addr, "fetch", start, err)
+	if err != nil {
+		m.failed = true
+		tracing.End(span, err)
+		return nil, fmt.Errorf("unable to fetch messages %d:%d. err: %w", from, to, err)
+	}
+
+	host := metrics.Host(m.Addr)
+	metrics.MessagesFetched.WithLabelValues(host).Add(float64(len(msgs)))
+	var size, atts int
+	for _, msg := range msgs {
+		metrics.BytesFetched.WithLabelValues(host).Add(float64(msg.Size))
+		size += int(msg.Size)
+		atts += len(msg.Attachment)
+	}
+	span.SetAttributes(attribute.Int("messages", len(msgs)), attribute.Int("bytes", size), attribute.Int("attachments", atts))
+	tracing.End(span, nil)
+
+	// Sort messages based on date, latest first
+	sortMsgs(msgs)
+
+	return msgs, nil
+}
+
+// Runs a single FETCH of a range
+// Every message is parsed in its own span
+func (m *Mail) fetch(ctx context.Context, from, to uint32) ([]Message, error) {
 
 	msgs := make([]Message, to-from+1)
 
@@ -78,41 +185,84 @@ func (m *Mail) Fetch(from, to uint32) []Message {
 	seqset := new(imap.SeqSet)
 	seqset.AddRange(from, to)
 
+	// Fetch the entire body with attachments
+	// Also fetch the message envolope, flags and the extension items supported
+	items := m.fetchItems()
+
 	messages := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
 	go func() {
-		// Fetch the entire body with attachments
-		// Also fetch the message envolope
-		done <- m.con.Fetch(seqset, []imap.FetchItem{imap.FetchItem("BODY.PEEK[]"), imap.FetchEnvelope}, messages)
+		done <- m.con.Fetch(seqset, items, messages)
 	}()
 
 	idx := 0
 	for msg := range messages {
+		if idx >= len(msgs) {
+			continue
+		}
 		// Grab the message Id
 		msgs[idx].Id = msg.Envelope.MessageId
+		msgs[idx].keepTnef = m.KeepTnef
+		msgs[idx].keepAuth = m.KeepAuth
+		msgs[idx].setImap(msg)
 
 		// For each body section
+		_, span := tracing.Start(ctx, "mail.parse", attribute.Int64("bytes", int64(msg.Size)))
 		for _, literal := range msg.Body {
 			// Parse the Message segments
-			msgs[idx].parse(literal)
+			msgs[idx].parse(literal, 0, m.logger())
 		}
+		span.SetAttributes(
+			attribute.Int("attachments", len(msgs[idx].Attachment)),
+			attribute.Int("inline", len(msgs[idx].Inline)),
+			attribute.Int("embedded", len(msgs[idx].Embedded)),
+			attribute.Int("warnings", len(msgs[idx].Warnings)),
+		)
+		tracing.End(span, nil)
 		idx++
 	}
 
 	if err := <-done; err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	// Messages expunged since the range was read are not returned
+	return msgs[:idx], nil
+}
 
-	// Sort messages based on date, latest first
-	sortMsgs(msgs)
+// Replaces the connection with a new one and selects the INBOX folder again
+func (m *Mail) reconnect(ctx context.Context) error {
+	if m.sess != nil {
+		Sessions.put(m.sess, false)
+		m.sess, m.con = nil, nil
+	} else if m.con != nil {
+		m.con.Logout()
+		m.con = nil
+	}
+	return m.Login(ctx)
+}
 
-	return msgs
+// Returns the logger of the context given to Login
+func (m *Mail) logger() *slog.Logger {
+	if m.log == nil {
+		return slog.Default()
+	}
+	return m.log
 }
 
 // Calls the Fetch method until a message with t(date) found
-func (m *Mail) FetchAfter(t time.Time) []Message {
+// exported holds the uids of the messages dated t that were already exported, the other
+// messages of that same second are fetched. With no uids every message dated t is left out
+func (m *Mail) FetchAfter(ctx context.Context, t time.Time, exported []uint32) ([]Message, error) {
+	ctx, span := tracing.Start(ctx, "imap.fetch_after", attribute.String("imap.host", metrics.Host(m.Addr)))
+	msgs, err := m.fetchAfter(ctx, t, exported)
+	span.SetAttributes(attribute.Int("messages", len(msgs)))
+	tracing.End(span, err)
+	return msgs, err
+}
+
+// Fetches 10 messages at a time, latest first, for FetchAfter
+func (m *Mail) fetchAfter(ctx context.Context, t time.Time, exported []uint32) ([]Message, error) {
 
-	since := time.Since(t)
 	found := false
 	// Prepare to and from
 	to := m.numMsgs
@@ -131,9 +281,21 @@ func (m *Mail) FetchAfter(t time.Time) []Message {
 			from = 1
 		}
 		// Call Fetch method
-		for _, msg := range m.Fetch(from, to) {
+		fetched, err := m.Fetch(ctx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range fetched {
+			// Messages dated t are told apart by uid, the exported ones are skipped
+			// and more of them may be in the next window
+			if msg.Date.Equal(t) && len(exported) > 0 {
+				if !slices.Contains(exported, msg.Uid) {
+					msgs = append(msgs, msg)
+				}
+				continue
+			}
 			// If we find a message with date <= t we stop fetching
-			if time.Since(msg.Date) > since {
+			if !msg.Date.After(t) {
 				found = true
 				break
 			}
@@ -149,7 +311,7 @@ func (m *Mail) FetchAfter(t time.Time) []Message {
 	// Sort messages based on date, latest first
 	sortMsgs(msgs)
 
-	return msgs
+	return msgs, nil
 }
 
 // Returns total number of messages in the INBOX folder
@@ -159,7 +321,7 @@ func (m *Mail) NumMsgs() uint32 {
 
 // Sorts messages based on date, latest first
 func sortMsgs(msgs []Message) {
-	sort.Slice(msgs, func(i, j int) bool {
-		return time.Since(msgs[i].Date) < time.Since(msgs[j].Date)
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Date.After(msgs[j].Date)
 	})
 }
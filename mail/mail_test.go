@@ -0,0 +1,270 @@
+package mail_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/mail/mailtest"
+	"github.com/tars47/go-read-mail/retry"
+)
+
+// Date of the last exported message in the FetchAfter tests
+var exported = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+// Logs in to the test server, the session is returned to the pool when the test ends
+func login(t *testing.T, s *mailtest.Server) *mail.Mail {
+	t.Helper()
+	u := s.Mail()
+	if err := u.Login(context.Background()); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	t.Cleanup(u.Logout)
+	return &u
+}
+
+// Returns the subjects of the messages
+func subjects(msgs []mail.Message) []string {
+	s := make([]string, len(msgs))
+	for i, msg := range msgs {
+		s[i] = msg.Subject
+	}
+	return s
+}
+
+// Returns n times the date d
+func repeat(d time.Time, n int) []time.Time {
+	dates := make([]time.Time, n)
+	for i := range dates {
+		dates[i] = d
+	}
+	return dates
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	s := mailtest.NewServer(t)
+	u := s.Mail()
+	u.Pass = "wrong"
+	err := u.Login(context.Background())
+	if err == nil {
+		u.Logout()
+		t.Fatal("Login succeeded with a wrong password")
+	}
+	if c := retry.Classify(err); c != retry.Auth {
+		t.Errorf("Classify = %v, want %v", c, retry.Auth)
+	}
+}
+
+// A pooled session of the account is not reused by a login with another password
+func TestLoginPooledWrongPassword(t *testing.T) {
+	s := mailtest.NewServer(t)
+	u := s.Mail()
+	if err := u.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	u.Logout()
+
+	u.Pass = "wrong"
+	if err := u.Login(context.Background()); err == nil {
+		u.Logout()
+		t.Fatal("Login reused a session with a wrong password")
+	}
+}
+
+// The reconnect of a failed FETCH can not log in again, Logout must not use the dropped connection
+func TestFetchServerGone(t *testing.T) {
+	s := mailtest.NewServer(t, mailtest.Fixture(t, "plain.eml"))
+	u := s.Mail()
+	if err := u.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := u.Fetch(ctx, 1, 1); err == nil {
+		t.Fatal("Fetch succeeded after the server was closed")
+	}
+	u.Logout()
+	u.Logout()
+}
+
+func TestFetch(t *testing.T) {
+	s := mailtest.NewServer(t,
+		mailtest.Fixture(t, "plain.eml"),
+		mailtest.Fixture(t, "attachment.eml"),
+		mailtest.Fixture(t, "inline.eml"),
+	)
+	u := login(t, s)
+	if u.NumMsgs() != 3 {
+		t.Fatalf("NumMsgs = %d, want 3", u.NumMsgs())
+	}
+
+	msgs, err := u.Fetch(context.Background(), 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Newsletter", "Monthly report", "Plain text"}
+	if got := subjects(msgs); !equal(got, want) {
+		t.Fatalf("subjects = %q, want %q", got, want)
+	}
+
+	att := msgs[1]
+	if att.Id != "<attachment@example.org>" || att.Uid != 2 {
+		t.Errorf("Id, Uid = %q, %d", att.Id, att.Uid)
+	}
+	if len(att.Attachment) != 1 || att.Attachment[0].Name != "report.csv" {
+		t.Fatalf("attachments = %+v", att.Attachment)
+	}
+	if got := att.Attachment[0].Buf.String(); got != "name,amount\nalice,10\nbob,20\n" {
+		t.Errorf("attachment content = %q", got)
+	}
+
+	inline := msgs[0]
+	if len(inline.Inline) != 1 || inline.Inline[0].ContentId != "logo@example.org" {
+		t.Errorf("inline = %+v", inline.Inline)
+	}
+}
+
+func TestFetchAfter(t *testing.T) {
+	at := func(d time.Duration) time.Time { return exported.Add(d) }
+
+	tests := []struct {
+		name string
+		// Dates of the messages in mailbox order, the subject is the index
+		dates []time.Time
+		// Uids of the exported messages dated exported, the uid is the index + 1
+		uids []uint32
+		want []string
+	}{
+		{
+			name: "empty mailbox",
+		},
+		{
+			name:  "mailbox smaller than the window",
+			dates: []time.Time{at(-time.Hour), at(time.Hour), at(2 * time.Hour)},
+			want:  []string{"2", "1"},
+		},
+		{
+			name:  "every message new, mailbox smaller than the window",
+			dates: []time.Time{at(time.Minute), at(time.Hour), at(2 * time.Hour)},
+			want:  []string{"2", "1", "0"},
+		},
+		{
+			name:  "nothing new",
+			dates: []time.Time{at(-2 * time.Hour), at(-time.Hour), at(0)},
+		},
+		{
+			// The exported message is not fetched again, new messages sharing a date are all fetched
+			name:  "identical timestamps",
+			dates: []time.Time{at(-time.Hour), at(0), at(time.Minute), at(time.Minute)},
+			want:  []string{"2", "3"},
+		},
+		{
+			// A message received after the export within the same second as the exported one
+			name:  "new message at the exported date",
+			dates: []time.Time{at(-time.Hour), at(0), at(0), at(time.Minute)},
+			uids:  []uint32{2},
+			want:  []string{"3", "2"},
+		},
+		{
+			// Messages of the exported second spread over several windows
+			name:  "exported date across windows",
+			dates: append(append([]time.Time{at(-time.Hour), at(0)}, repeat(at(0), 12)...), at(time.Minute)),
+			uids:  []uint32{2, 3},
+			want:  []string{"14", "5", "6", "7", "8", "9", "10", "11", "12", "13", "3", "4"},
+		},
+		{
+			// Messages received in another order than their dates
+			name:  "out of order dates",
+			dates: []time.Time{at(-time.Hour), at(3 * time.Hour), at(-2 * time.Hour), at(time.Hour), at(2 * time.Hour)},
+			want:  []string{"1", "4", "3"},
+		},
+	}
+
+	// More new messages than a window of 10, read over several FETCH
+	var dates []time.Time
+	var want []string
+	for i := 0; i < 25; i++ {
+		dates = append(dates, at(time.Duration(i-4)*time.Minute))
+		if i > 4 {
+			want = append([]string{fmt.Sprint(i)}, want...)
+		}
+	}
+	tests = append(tests, struct {
+		name  string
+		dates []time.Time
+		uids  []uint32
+		want  []string
+	}{"several windows", dates, nil, want})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mailtest.NewServer(t)
+			for i, d := range tt.dates {
+				s.Append(mailtest.Message(fmt.Sprint("m", i), d, fmt.Sprint(i)))
+			}
+			u := login(t, s)
+
+			msgs, err := u.FetchAfter(context.Background(), exported, tt.uids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := subjects(msgs); !equal(got, tt.want) {
+				t.Errorf("subjects = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	cids := map[string]string{"logo@x": "https://storage.test/logo.png"}
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"cid image", `<img src="cid:logo@x" alt="logo">`, `<img src="https://storage.test/logo.png" alt="logo"/>`},
+		{"unknown cid", `<img src="cid:other@x">`, ``},
+		{"remote image", `<p>hi<img src="https://tracker.example/open.gif?u=1"></p>`, `<p>hi</p>`},
+		{"data image", `<img src="data:image/png;base64,AA==">`, `<img src="data:image/png;base64,AA=="/>`},
+		{"links are kept", `<a href="https://example.org">x</a>`, `<a href="https://example.org">x</a>`},
+		{"remote background", `<table background="https://tracker.example/bg.png"><tr><td>x</td></tr></table>`, `<table><tbody><tr><td>x</td></tr></tbody></table>`},
+		{"style sheets", `<style>body{background:url(https://tracker.example/a)}</style><p>x</p>`, `<p>x</p>`},
+		{"css url", `<div style="color:red;background:url('https://tracker.example/a') no-repeat">x</div>`, `<div style="color:red;background:none no-repeat">x</div>`},
+		{"css cid", `<div style="background-image:url(cid:logo@x)">x</div>`, `<div style="background-image:url(&#34;https://storage.test/logo.png&#34;)">x</div>`},
+		{"css escapes", `<div style="background:\75 rl(https://tracker.example/a)">x</div>`, `<div>x</div>`},
+		{"css image-set", `<div style="background:image-set('https://tracker.example/a' 1x)">x</div>`, `<div>x</div>`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript with a tab", `<a href="java&#x09;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript with a newline", "<a href=\"java\nscript:alert(1)\">x</a>", `<a>x</a>`},
+		{"javascript after a control character", `<a href="&#x01;javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"unknown scheme", `<a href="vbscript:msgbox(1)">x</a>`, `<a>x</a>`},
+		{"data html link", `<a href="data:text/html,<script>x()</script>">x</a>`, `<a>x</a>`},
+		{"mailto link", `<a href="mailto:a@example.org">x</a>`, `<a href="mailto:a@example.org">x</a>`},
+		{"relative link", `<a href="/help?a=b:c">x</a>`, `<a href="/help?a=b:c">x</a>`},
+		{"scripts and handlers", `<p onclick="x()">a<script>x()</script></p>`, `<p>a</p>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := "<html><head></head><body>" + tt.want + "</body></html>"
+			if got := mail.Sanitize(tt.html, cids); got != want {
+				t.Errorf("Sanitize = %s, want %s", got, want)
+			}
+		})
+	}
+}
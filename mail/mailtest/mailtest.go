@@ -0,0 +1,178 @@
+package mailtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"embed"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	rmail "github.com/tars47/go-read-mail/mail"
+)
+
+// Credentials of the test account
+const (
+	User = "username"
+	Pass = "password"
+)
+
+// Messages used by the tests, see Fixture
+//
+//go:embed testdata/*.eml
+var fixtures embed.FS
+
+// IMAP server backed by the go-imap memory backend
+// The INBOX of the test account holds the messages given to NewServer and Append
+type Server struct {
+	// Address of the server, eg: 127.0.0.1:34567
+	Addr string
+
+	srv   *server.Server
+	inbox *memory.Mailbox
+}
+
+// Starts a TLS server on a local port with the given messages in the INBOX
+// mail.TLSConfig trusts the server certificate until the test ends, the server is closed then
+func NewServer(t testing.TB, emls ...[]byte) *Server {
+	t.Helper()
+
+	cert, pool, err := certificate()
+	if err != nil {
+		t.Fatalf("unable to create certificate. err: %v", err)
+	}
+
+	be := memory.New()
+	u, err := be.Login(nil, User, Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{inbox: mbox.(*memory.Mailbox)}
+	// The memory backend starts with a sample message
+	s.inbox.Messages = nil
+	for _, eml := range emls {
+		s.Append(eml)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = l.Addr().String()
+	s.srv = server.New(be)
+	go s.srv.Serve(l)
+
+	prev := rmail.TLSConfig
+	rmail.TLSConfig = &tls.Config{RootCAs: pool}
+	t.Cleanup(func() {
+		rmail.TLSConfig = prev
+		s.srv.Close()
+	})
+	return s
+}
+
+// Returns the test account on the server
+func (s *Server) Mail() rmail.Mail {
+	return rmail.Mail{Addr: s.Addr, User: User, Pass: Pass}
+}
+
+// Appends a message to the INBOX, INTERNALDATE is read from its Date header
+// Must not be called while a client runs a command
+func (s *Server) Append(eml []byte, flags ...string) {
+	date := time.Now()
+	if m, err := mail.ReadMessage(bytes.NewReader(eml)); err == nil {
+		if d, err := m.Header.Date(); err == nil {
+			date = d
+		}
+	}
+
+	var uid uint32 = 1
+	for _, msg := range s.inbox.Messages {
+		if msg.Uid >= uid {
+			uid = msg.Uid + 1
+		}
+	}
+	s.inbox.Messages = append(s.inbox.Messages, &memory.Message{
+		Uid:   uid,
+		Date:  date,
+		Size:  uint32(len(eml)),
+		Flags: flags,
+		Body:  eml,
+	})
+}
+
+// Stops the server and drops its connections, eg: to test a server going away mid-sync
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Returns the number of messages in the INBOX
+func (s *Server) Len() int {
+	return len(s.inbox.Messages)
+}
+
+// Returns a fixture of testdata, eg: attachment.eml
+func Fixture(t testing.TB, name string) []byte {
+	t.Helper()
+	b, err := fixtures.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("unable to read fixture %v. err: %v", name, err)
+	}
+	return b
+}
+
+// Returns a plain text message with the given Message-ID local part, date and subject
+func Message(id string, date time.Time, subject string) []byte {
+	return []byte(fmt.Sprintf("From: Alice <alice@example.org>\r\n"+
+		"To: Bob <bob@example.org>\r\n"+
+		"Subject: %s\r\n"+
+		"Date: %s\r\n"+
+		"Message-ID: <%s@example.org>\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Body of %s\r\n", subject, date.Format(time.RFC1123Z), id, subject))
+}
+
+// Returns a self signed certificate for 127.0.0.1 and a pool trusting it
+func certificate() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool, nil
+}
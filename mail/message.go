@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 )
 
-var addressList = []string{"From", "Sender", "Cc", "Bcc", "Reply-To"}
+// Maximum nesting of attached message/rfc822 emails parsed into Message.Embedded
+// Deeper messages are kept as attachments
+const MaxDepth = 3
+
+var addressList = []string{"From", "To", "Sender", "Cc", "Bcc", "Reply-To"}
 
 type Message struct {
 	Id string
@@ -20,14 +27,57 @@ type Message struct {
 	Subject  string
 	BodyText string
 	BodyHtml string
+	// Link to the sanitized html body
+	BodyUrl string
+	// Set when the html body could not be uploaded
+	BodyError error
 
 	Cc      []string
 	Bcc     []string
 	From    []string
+	To      []string
 	Sender  []string
 	ReplyTo []string
 
+	// Imap attributes, not set on embedded messages
+	Uid          uint32
+	Flags        []string
+	InternalDate time.Time
+	// RFC822.SIZE in bytes
+	Size uint32
+	// Gmail labels and thread id (hex, as used in Gmail urls), empty for other servers
+	Labels   []string
+	ThreadId string
+	// Mod sequence of the last flag change, 0 without CONDSTORE
+	ModSeq uint64
+
 	Attachment []Attachment
+	// Inline parts that are not text, eg: images referenced by cid: in the html body
+	Inline []Attachment
+	// Attached message/rfc822 emails eg: forwarded as attachment
+	Embedded []Message
+	// Id of the message this one is embedded in, set when exported as a child row
+	Parent string
+	// Meetings read from text/calendar parts and .ics attachments
+	Events []Event
+	// Outcome of the DKIM, SPF, DMARC and S/MIME checks, set by Verify
+	Auth Auth
+	// Decoding fallbacks used while parsing, eg: unknown charsets or malformed encoded words
+	Warnings []string
+
+	// Label written to the Tag column, set by rules
+	Tag string
+	// Sheet the message is written to, default sheet if empty
+	Sheet string
+	// Attachments are listed but not uploaded
+	SkipUpload bool
+
+	// winmail.dat attachments are kept after the files they hold, see Mail.KeepTnef
+	keepTnef bool
+	// Keeps the inputs of Verify, see Mail.KeepAuth
+	keepAuth bool
+	// Inputs of the checks run by Verify, nil once verified or if keepAuth is unset
+	pending *authInput
 }
 
 type Attachment struct {
@@ -35,19 +85,50 @@ type Attachment struct {
 	Type string
 	Url  string
 	Buf  bytes.Buffer
+	// Set when the attachment could not be uploaded
+	Error error
+	// Plain text extracted from the attachment, if supported
+	Text string
+	// Content-ID used by cid: references in the html body
+	ContentId string
+
+	// Files of an expanded zip or tar.gz attachment, uploaded under its key
+	Children []Attachment
+	// Set when the archive could not be expanded, or only partly, eg: password protected
+	ArchiveError error
+	// Why the attachment policy kept the attachment from being uploaded, empty if uploaded
+	Filtered string
+	// Threat found by a malware scanner, the attachment is stored under the quarantine prefix without a link
+	Threat string
 }
 
 // Reads the message segments
 // Parses all the fields in Message struct
-func (m *Message) parse(l io.Reader) {
+// depth is the nesting level of embedded messages, 0 for fetched messages
+func (m *Message) parse(l io.Reader, depth int, log *slog.Logger) {
 
-	var err error
+	// The raw message is kept for the signature checks when keepAuth is set
+	raw, err := io.ReadAll(l)
+	if err != nil {
+		log.Warn("failed to read message", "op", "parse", "message", m.Id, "err", err)
+		return
+	}
+	// Detached S/MIME signature, if any
+	var sig []byte
+	// Parts sharing a name, eg: image001.png of two signatures, would share an s3 key
+	defer func() {
+		UniqueNames(m.Attachment)
+		UniqueNames(m.Inline)
+	}()
 
 	// Create a mail reader
-	mr, err := mail.CreateReader(l)
-	if err != nil {
-		log.Printf("failed to create mail reader: %v\n", err)
+	// Unknown charsets and transfer encodings are recorded, the raw content is kept
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		log.Warn("failed to create mail reader", "op", "parse", "message", m.Id, "err", err)
 		return
+	} else if err != nil {
+		m.warn("body: %v", err)
 	}
 
 	// Parse header fields
@@ -55,29 +136,21 @@ func (m *Message) parse(l io.Reader) {
 
 	// Grab the message Date
 	if m.Date, err = h.Date(); err != nil {
-		log.Printf("failed to parse Date header field: %v\n", err)
+		log.Debug("failed to parse Date header field", "op", "parse", "message", m.Id, "err", err)
+		m.warn("Date: %v", err)
 	}
 	// Grab the message Subject
-	if m.Subject, err = h.Text("Subject"); err != nil {
-		log.Printf("failed to parse Subject header field: %v\n", err)
-	}
+	m.Subject = m.headerText(h, "Subject")
 
-	// Parse "From", "Sender", "Cc", "Bcc", "Reply-To"
+	// Parse "From", "To", "Sender", "Cc", "Bcc", "Reply-To"
 	for _, field := range addressList {
-		fval, err := h.AddressList(field)
-		if err != nil {
-			log.Printf("failed to parse To %v header field: %v\n", field, err)
-			continue
-		}
-
-		si := make([]string, 0, len(fval))
-		for _, v := range fval {
-			si = append(si, v.String())
-		}
+		si := m.addressList(h, field)
 
 		switch field {
 		case "From":
 			m.From = si
+		case "To":
+			m.To = si
 		case "Sender":
 			m.Sender = si
 		case "Cc":
@@ -95,43 +168,203 @@ func (m *Message) parse(l io.Reader) {
 		p, err := mr.NextPart()
 		if err == io.EOF {
 			break
-		} else if err != nil {
-			log.Printf("failed to read message part: %v\n", err)
+		} else if err != nil && (p == nil || !isDecodeErr(err)) {
+			log.Warn("failed to read message part", "op", "parse", "message", m.Id, "err", err)
+			m.warn("part: %v", err)
 			return
+		} else if err != nil {
+			// Part is kept undecoded
+			m.warn("part: %v", err)
 		}
 
 		switch h := p.Header.(type) {
 		case *mail.InlineHeader:
 			// This is the message's text (can be plain-text or HTML)
+			// Multiple text parts are concatenated in order
 			b, _ := io.ReadAll(p.Body)
-			ctype, _, _ := h.ContentType()
-			switch ctype {
-			case "text/plain":
-				m.BodyText = string(b)
-			case "text/html":
-				m.BodyHtml = string(b)
+			ctype, params, _ := h.ContentType()
+			switch {
+			case ctype == "text/plain" || ctype == "":
+				m.BodyText = join(m.BodyText, m.bodyText(b, params))
+			case ctype == "text/html":
+				m.BodyHtml = join(m.BodyHtml, m.bodyText(b, params))
+			case isMessage(ctype) && m.embed(b, depth, log):
+			case ctype == "text/calendar":
+				// Invites carry the calendar as an alternative to the text body
+				m.calendar(b)
+			case isTnef(ctype, m.filename(h)):
+				m.tnef(m.filename(h), b)
+			default:
+				// Inline images and other non text parts referenced by cid:
+				var buf bytes.Buffer
+				buf.Write(b)
+
+				cid := strings.Trim(h.Get("Content-Id"), " <>")
+				name := inlineName(m.filename(h), ctype, cid, len(m.Inline))
+				m.Inline = append(m.Inline, Attachment{Name: name, Type: ctype, Buf: buf, ContentId: cid})
 			}
 
 		case *mail.AttachmentHeader:
 			// This is an attachment
-			name, _ := h.Filename()
+			name := m.filename(h)
 			ctype, _, _ := h.ContentType()
 			b, _ := io.ReadAll(p.Body)
 
+			// Attached emails are parsed into Embedded
+			if isMessage(ctype) && m.embed(b, depth, log) {
+				continue
+			}
+
+			// Outlook rich text messages wrap their attachments and body in a winmail.dat
+			if isTnef(ctype, name) {
+				m.tnef(name, b)
+				continue
+			}
+
+			if isSignature(ctype) {
+				sig = b
+			}
+
+			// Invites sent as .ics files are read and kept as attachments
+			if ctype == "text/calendar" || strings.EqualFold(path.Ext(name), ".ics") {
+				m.calendar(b)
+			}
+
 			// Write the attachment bytes to a buffer
 			var buf bytes.Buffer
 			buf.Write(b)
 
-			m.Attachment = append(m.Attachment, Attachment{Name: name, Type: ctype, Buf: buf})
+			// Parts of a multipart/related without a Content-Disposition, referenced by cid:
+			cid := strings.Trim(h.Get("Content-Id"), " <>")
+			if cid != "" && h.Get("Content-Disposition") == "" {
+				name = inlineName(name, ctype, cid, len(m.Inline))
+				m.Inline = append(m.Inline, Attachment{Name: name, Type: ctype, Buf: buf, ContentId: cid})
+				continue
+			}
+			m.Attachment = append(m.Attachment, Attachment{Name: name, Type: ctype, Buf: buf, ContentId: cid})
 		}
 	}
 
+	// Checked by Verify once the fetch is done
+	if m.keepAuth {
+		m.pending = &authInput{raw: raw, h: h, sig: sig}
+	}
+
 	// Convert date to utc
 	m.Date = m.Date.UTC()
 	// Trim spaces
 	m.Subject = strings.TrimSpace(m.Subject)
 	m.BodyText = strings.TrimSpace(m.BodyText)
 	m.BodyHtml = strings.TrimSpace(m.BodyHtml)
+
+	// Html only messages get a text rendering of the html body
+	if m.BodyText == "" && m.BodyHtml != "" {
+		m.BodyText = HtmlToText(m.BodyHtml)
+	}
+}
+
+// Parses an attached email into Embedded
+// Returns false if the depth limit is reached or the email can not be read
+func (m *Message) embed(b []byte, depth int, log *slog.Logger) bool {
+	if depth >= MaxDepth {
+		return false
+	}
+
+	// Use the Message-Id header, falling back to the position in the parent
+	e := Message{keepTnef: m.keepTnef, keepAuth: m.keepAuth}
+	mr, err := mail.CreateReader(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	if id, _ := mr.Header.MessageID(); id != "" {
+		e.Id = "<" + id + ">"
+	} else {
+		e.Id = fmt.Sprintf("%s-embedded-%d", m.Id, len(m.Embedded)+1)
+	}
+	mr.Close()
+
+	e.parse(bytes.NewReader(b), depth+1, log)
+	if e.Date.IsZero() && e.Subject == "" && len(e.From) == 0 {
+		return false
+	}
+
+	m.Embedded = append(m.Embedded, e)
+	return true
+}
+
+// Reads the events of a calendar part into Events
+// Events already read from another part of the message, with the same Uid and Start, are skipped
+func (m *Message) calendar(b []byte) {
+	events, err := ParseCalendar(b)
+	if err != nil {
+		m.warn("calendar: %v", err)
+	}
+	for _, e := range events {
+		dup := false
+		for _, o := range m.Events {
+			if o.Uid == e.Uid && o.Start.Equal(e.Start) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			m.Events = append(m.Events, e)
+		}
+	}
+}
+
+// Returns true for content types of attached emails
+func isMessage(ctype string) bool {
+	return ctype == "message/rfc822" || ctype == "message/global"
+}
+
+// Returns true for errors of parts that can still be read undecoded
+func isDecodeErr(err error) bool {
+	return message.IsUnknownCharset(err) || message.IsUnknownEncoding(err)
+}
+
+// Joins two body parts with a new line
+func join(body, part string) string {
+	if body == "" {
+		return part
+	}
+	return body + "\n" + part
+}
+
+// Returns a file name for an inline part
+// Uses the given file name, falls back to the Content-ID or the part index
+func inlineName(name, ctype string, cid string, idx int) string {
+	if name != "" {
+		return name
+	}
+
+	base := fmt.Sprintf("inline-%d", idx+1)
+	if cid != "" {
+		// Content-IDs look like image001.png@01D9.., keep the local part
+		base = strings.NewReplacer("/", "_", "\\", "_").Replace(strings.SplitN(cid, "@", 2)[0])
+		if path.Ext(base) != "" {
+			return base
+		}
+	}
+	if exts, _ := mime.ExtensionsByType(ctype); len(exts) > 0 {
+		return base + exts[0]
+	}
+	return base
+}
+
+// Renames attachments whose name is already taken by an earlier one, names are used in s3 keys
+// The part index is added before the extension, eg: the second image001.png becomes image001-2.png
+func UniqueNames(atts []Attachment) {
+	seen := make(map[string]bool, len(atts))
+	for i := range atts {
+		name := atts[i].Name
+		ext := path.Ext(name)
+		for n := i + 1; seen[name]; n++ {
+			name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(atts[i].Name, ext), n, ext)
+		}
+		atts[i].Name = name
+		seen[name] = true
+	}
 }
 
 // Method that converts a Message struct into human readable format
@@ -140,6 +373,7 @@ func (m *Message) String() {
 	fmt.Printf("Id:\t%v\n", m.Id)
 
 	fmt.Printf("From:\t%v\n", ToString(m.From))
+	fmt.Printf("To:\t%v\n", ToString(m.To))
 	fmt.Printf("CC:\t%v\n", ToString(m.Cc))
 	fmt.Printf("BCC:\t%v\n", ToString(m.Bcc))
 	fmt.Printf("Sender:\t%v\n", ToString(m.Sender))
@@ -164,6 +398,20 @@ func (m *Message) String() {
 		fmt.Printf("Attachment(%v):\n", i)
 		att.String()
 	}
+
+	for i, att := range m.Inline {
+		fmt.Printf("Inline(%v):\n", i)
+		att.String()
+	}
+
+	for i, e := range m.Events {
+		fmt.Printf("Event(%v):\t%v %v %v\n", i, e.Method, e.Start, e.Summary)
+	}
+
+	for i := range m.Embedded {
+		fmt.Printf("Embedded(%v):\n", i)
+		m.Embedded[i].String()
+	}
 }
 
 // Method that converts a Attachment struct into human readable format
@@ -0,0 +1,184 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Rewrites the golden files of the corpus, eg: go test ./mail -run TestParseCorpus -update
+var update = flag.Bool("update", false, "rewrite the golden files of testdata/corpus")
+
+// Logger discarding the parse logs
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Golden form of a Message, attachment contents are replaced by their size and hash
+type golden struct {
+	Id       string
+	Date     time.Time
+	Subject  string
+	BodyText string
+	BodyHtml string
+
+	From    []string `json:",omitempty"`
+	To      []string `json:",omitempty"`
+	Cc      []string `json:",omitempty"`
+	Bcc     []string `json:",omitempty"`
+	Sender  []string `json:",omitempty"`
+	ReplyTo []string `json:",omitempty"`
+
+	Attachment []goldenFile `json:",omitempty"`
+	Inline     []goldenFile `json:",omitempty"`
+	Embedded   []golden     `json:",omitempty"`
+	Events     []Event      `json:",omitempty"`
+	Auth       Auth
+	Warnings   []string `json:",omitempty"`
+}
+
+// Golden form of an Attachment
+type goldenFile struct {
+	Name      string
+	Type      string
+	ContentId string `json:",omitempty"`
+	Size      int
+	Sha256    string
+}
+
+func toGolden(m Message) golden {
+	g := golden{
+		Id: m.Id, Date: m.Date, Subject: m.Subject, BodyText: m.BodyText, BodyHtml: m.BodyHtml,
+		From: m.From, To: m.To, Cc: m.Cc, Bcc: m.Bcc, Sender: m.Sender, ReplyTo: m.ReplyTo,
+		Events: m.Events, Auth: m.Auth, Warnings: m.Warnings,
+	}
+	for _, a := range m.Attachment {
+		g.Attachment = append(g.Attachment, toGoldenFile(a))
+	}
+	for _, a := range m.Inline {
+		g.Inline = append(g.Inline, toGoldenFile(a))
+	}
+	for _, e := range m.Embedded {
+		g.Embedded = append(g.Embedded, toGolden(e))
+	}
+	return g
+}
+
+func toGoldenFile(a Attachment) goldenFile {
+	sum := sha256.Sum256(a.Buf.Bytes())
+	return goldenFile{Name: a.Name, Type: a.Type, ContentId: a.ContentId, Size: a.Buf.Len(), Sha256: hex.EncodeToString(sum[:])}
+}
+
+// Replaces LookupTXT so DKIM signatures never reach the network
+func noDns(t testing.TB) {
+	prev := LookupTXT
+	LookupTXT = func(ctx context.Context, domain string) ([]string, error) {
+		return nil, errors.New("no dns in tests")
+	}
+	t.Cleanup(func() { LookupTXT = prev })
+}
+
+// Parses every testdata/corpus/*.eml and compares the result with the .json golden file next to it
+func TestParseCorpus(t *testing.T) {
+	noDns(t)
+	files, err := filepath.Glob("testdata/corpus/*.eml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no corpus found. err: %v", err)
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".eml")
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := []Message{{Id: name, keepAuth: true}}
+			msgs[0].parse(bytes.NewReader(b), 0, discard)
+			Verify(context.Background(), msgs)
+			m := msgs[0]
+
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(toGolden(m)); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.Bytes()
+
+			path := strings.TrimSuffix(file, ".eml") + ".json"
+			if *update {
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unable to read golden file, run with -update to create it. err: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("parse result differs from %v, run with -update if the change is expected\ngot:\n%s", path, got)
+			}
+		})
+	}
+}
+
+// Parses arbitrary input, parse must not panic and the result must stay proportional to the input
+func FuzzParse(f *testing.F) {
+	noDns(f)
+	files, _ := filepath.Glob("testdata/corpus/*.eml")
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte("Subject: empty\r\n\r\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m := Message{Id: "fuzz"}
+		m.parse(bytes.NewReader(b), 0, discard)
+		checkBounds(t, m, 0, len(b))
+	})
+}
+
+// Checks the nesting of a parsed message and the size of its content against the input size
+// Decoding never grows content by more than a few times, eg: latin1 to utf-8, html to text
+// or the compressed rtf body of a winmail.dat, at most 8 times its size
+func checkBounds(t *testing.T, m Message, depth, n int) {
+	if depth > MaxDepth {
+		t.Fatalf("embedded depth %d exceeds MaxDepth", depth)
+	}
+	limit := 16*n + 1024
+	size := len(m.Subject) + len(m.BodyText) + len(m.BodyHtml)
+	for _, a := range m.Attachment {
+		size += a.Buf.Len() + len(a.Name)
+	}
+	for _, a := range m.Inline {
+		size += a.Buf.Len() + len(a.Name)
+	}
+	if size > limit {
+		t.Fatalf("parsed content of %d bytes from %d bytes of input", size, n)
+	}
+	if parts := len(m.Attachment) + len(m.Inline) + len(m.Embedded) + len(m.Events); parts > n {
+		t.Fatalf("%d parts from %d bytes of input", parts, n)
+	}
+	if len(m.Warnings) > n+1 {
+		t.Fatalf("%d warnings from %d bytes of input", len(m.Warnings), n)
+	}
+	for _, e := range m.Embedded {
+		checkBounds(t, e, depth+1, n)
+	}
+}
@@ -0,0 +1,386 @@
+package mail
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/metrics"
+	"github.com/tars47/go-read-mail/retry"
+	"github.com/tars47/go-read-mail/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Maximum connections per account by imap host, Gmail allows 15 per account
+var ServerLimits = map[string]int{
+	"imap.gmail.com": 15,
+}
+
+// Maximum connections per account for hosts not in ServerLimits
+var DefaultServerLimit = 10
+
+// TLS config of the imap connections, eg: to trust other roots, the system roots are used if nil
+var TLSConfig *tls.Config
+
+// Pool settings
+var (
+	// Idle sessions are sent a NOOP at this interval so servers do not drop them
+	KeepAlive = 4 * time.Minute
+	// Idle sessions unused for this long are logged out
+	IdleTimeout = 30 * time.Minute
+	// Maximum wait for a free connection when an account reached its limit
+	AcquireTimeout = time.Minute
+)
+
+// Authenticated connections reused by Login
+// Set to nil to dial and log out on every sync
+var Sessions = NewPool()
+
+// Pool of authenticated imap connections keyed by account, the address and user
+// Sessions are only shared by logins with the same password
+type Pool struct {
+	mu   sync.Mutex
+	idle map[string][]*session
+	// Connection slots of every account, removed once no login holds or waits for one
+	slots map[string]*slots
+	done  chan struct{}
+	once  sync.Once
+	// Key of the password hashes
+	secret []byte
+}
+
+// Connection slots of an account, open and idle connections hold one
+type slots struct {
+	c chan struct{}
+	// Sessions and logins waiting for a slot
+	refs int
+}
+
+// An authenticated connection
+type session struct {
+	con  *client.Client
+	key  string
+	pass string
+	// Slots of the account, the session holds one
+	slots *slots
+	used  time.Time
+	// Last NOOP or checkout
+	alive time.Time
+}
+
+// Returns a pool and starts its keepalive loop
+func NewPool() *Pool {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	p := &Pool{
+		idle:   make(map[string][]*session),
+		slots:  make(map[string]*slots),
+		done:   make(chan struct{}),
+		secret: secret,
+	}
+	go p.keepalive()
+	return p
+}
+
+// Returns an authenticated connection of the account
+// Idle connections are checked with a NOOP, dead ones are replaced
+// Waits up to AcquireTimeout when the account reached its server limit
+func (p *Pool) get(ctx context.Context, addr, user, pass string) (*session, error) {
+	key, hash := accountKey(addr, user), p.passHash(pass)
+
+	for {
+		s := p.pop(key, hash)
+		if s == nil {
+			break
+		}
+		if err := s.check(); err != nil {
+			logging.From(ctx).Info("dropping dead session", "op", "login", "err", err)
+			p.discard(s)
+			continue
+		}
+		return s, nil
+	}
+
+	// No idle session, wait for a slot and dial
+	// Once the account is at its limit, idle sessions of another password, eg: the one
+	// before a password change, give their slot up first
+	sl := p.acquire(addr, key)
+	if len(sl.c) == cap(sl.c) {
+		if s := p.pop(key, ""); s != nil {
+			p.discard(s)
+		}
+	}
+	select {
+	case sl.c <- struct{}{}:
+	case <-time.After(AcquireTimeout):
+		p.release(key, sl)
+		return nil, fmt.Errorf("too many connections to %v for %v", addr, user)
+	case <-ctx.Done():
+		p.release(key, sl)
+		return nil, ctx.Err()
+	}
+	con, err := dial(ctx, addr, user, pass)
+	if err != nil {
+		<-sl.c
+		p.release(key, sl)
+		return nil, err
+	}
+	now := time.Now()
+	return &session{con: con, key: key, pass: hash, slots: sl, used: now, alive: now}, nil
+}
+
+// Returns a session to the pool
+// Sessions logged out, or released after an error, are closed
+func (p *Pool) put(s *session, healthy bool) {
+	if !healthy || s.closed() {
+		p.discard(s)
+		return
+	}
+	s.used = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		go p.discard(s)
+		return
+	default:
+	}
+	p.idle[s.key] = append(p.idle[s.key], s)
+}
+
+// Logs out a session and frees its slot
+func (p *Pool) discard(s *session) {
+	if !s.closed() {
+		s.con.Logout()
+	}
+	<-s.slots.c
+	p.release(s.key, s.slots)
+}
+
+// Removes the most recently used idle session of an account logged in with the password hash,
+// nil if none. With an empty hash the least recently used session of any password is removed
+func (p *Pool) pop(key, hash string) *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ss := p.idle[key]
+	for j := range ss {
+		i := len(ss) - 1 - j
+		if hash == "" {
+			i = j
+		} else if subtle.ConstantTimeCompare([]byte(ss[i].pass), []byte(hash)) != 1 {
+			continue
+		}
+		s := ss[i]
+		p.idle[key] = append(ss[:i], ss[i+1:]...)
+		if len(p.idle[key]) == 0 {
+			delete(p.idle, key)
+		}
+		return s
+	}
+	return nil
+}
+
+// Returns the connection slots of an account, sized with the server limit
+// The caller holds a reference until it calls release
+func (p *Pool) acquire(addr, key string) *slots {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sl, ok := p.slots[key]
+	if !ok {
+		sl = &slots{c: make(chan struct{}, serverLimit(addr))}
+		p.slots[key] = sl
+	}
+	sl.refs++
+	return sl
+}
+
+// Drops a reference to the slots of an account, they are removed once unreferenced
+func (p *Pool) release(key string, sl *slots) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sl.refs--
+	if sl.refs == 0 {
+		delete(p.slots, key)
+	}
+}
+
+// Sends a NOOP to idle sessions every KeepAlive and logs out the ones idle for IdleTimeout
+func (p *Pool) keepalive() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		// Sessions are taken out of the pool while checked
+		now := time.Now()
+		var expired, stale []*session
+		p.mu.Lock()
+		for key, ss := range p.idle {
+			kept := ss[:0]
+			for _, s := range ss {
+				switch {
+				case s.closed() || now.Sub(s.used) > IdleTimeout:
+					expired = append(expired, s)
+				case now.Sub(s.alive) > KeepAlive:
+					stale = append(stale, s)
+				default:
+					kept = append(kept, s)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		p.mu.Unlock()
+
+		for _, s := range expired {
+			p.discard(s)
+		}
+		for _, s := range stale {
+			if err := s.noop(); err != nil {
+				p.discard(s)
+				continue
+			}
+			p.put(s, true)
+		}
+	}
+}
+
+// Logs out every idle session and stops the keepalive loop
+// Sessions in use are logged out when released
+func (p *Pool) Close() {
+	p.once.Do(func() {
+		p.mu.Lock()
+		close(p.done)
+		idle := p.idle
+		p.idle = make(map[string][]*session)
+		p.mu.Unlock()
+
+		for _, ss := range idle {
+			for _, s := range ss {
+				p.discard(s)
+			}
+		}
+	})
+}
+
+// Checks a session taken from the pool
+func (s *session) check() error {
+	if s.closed() {
+		return fmt.Errorf("connection closed")
+	}
+	return s.noop()
+}
+
+// Sends a NOOP, failing after 30 seconds
+func (s *session) noop() error {
+	s.con.Timeout = 30 * time.Second
+	defer func() { s.con.Timeout = 0 }()
+	if err := s.con.Noop(); err != nil {
+		return err
+	}
+	s.alive = time.Now()
+	return nil
+}
+
+// Returns true if the server closed the connection or it was logged out
+func (s *session) closed() bool {
+	select {
+	case <-s.con.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+// Connects to the imap server and logs the user in
+// Transient failures are retried, see retry.Connect
+func dial(ctx context.Context, addr, user, pass string) (*client.Client, error) {
+	ctx, span := tracing.Start(ctx, "imap.dial", attribute.String("imap.host", metrics.Host(addr)))
+	start := time.Now()
+	var con *client.Client
+	err := retry.Do(ctx, "login", retry.Connect, func() error {
+		var err error
+		con, err = login(ctx, addr, user, pass)
+		return err
+	})
+	metrics.ObserveImap(addr, "login", start, err)
+	tracing.End(span, err)
+	return con, err
+}
+
+// Makes a single connection and login attempt
+// A rejected LOGIN is an auth error unless the server asks to try again later
+func login(ctx context.Context, addr, user, pass string) (*client.Client, error) {
+	log := logging.From(ctx).With("op", "login", "host", metrics.Host(addr))
+	log.Debug("connecting to server")
+
+	conf := &tls.Config{
+		Rand: rand.Reader,
+	}
+	if TLSConfig != nil {
+		conf = TLSConfig.Clone()
+	}
+
+	// Connect to server
+	con, err := client.DialTLS(addr, conf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %v. err: %w", addr, err)
+	}
+	log.Debug("connected")
+
+	// Login
+	if err := con.Login(user, pass); err != nil {
+		con.Logout()
+		err = fmt.Errorf("unable to login to %v. err: %w", user, err)
+		if retry.Classify(err) != retry.Transient {
+			err = retry.Mark(retry.Auth, err)
+		}
+		return nil, err
+	}
+	log.Info("logged in")
+	return con, nil
+}
+
+// Returns the connection limit per account of an imap server
+func serverLimit(addr string) int {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if n, ok := ServerLimits[host]; ok {
+		return n
+	}
+	return DefaultServerLimit
+}
+
+// Returns the pool key of an account
+func accountKey(addr, user string) string {
+	return addr + "\x00" + user
+}
+
+// Returns the hash of a password kept with its sessions, so a wrong one never reuses a session
+func (p *Pool) passHash(pass string) string {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write([]byte(pass))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package mail
+
+import "testing"
+
+func TestPoolSlotsRemoved(t *testing.T) {
+	p := &Pool{slots: make(map[string]*slots)}
+	key := accountKey("imap.test:993", "u")
+	a := p.acquire("imap.test:993", key)
+	b := p.acquire("imap.test:993", key)
+	if a != b || cap(a.c) != DefaultServerLimit {
+		t.Fatal("logins of an account got different slots")
+	}
+	p.release(key, a)
+	if _, ok := p.slots[key]; !ok {
+		t.Fatal("slots removed while still referenced")
+	}
+	p.release(key, b)
+	if _, ok := p.slots[key]; ok {
+		t.Error("slots kept once unreferenced")
+	}
+}
+
+func TestPoolPopPassword(t *testing.T) {
+	p := &Pool{idle: make(map[string][]*session), secret: []byte("k")}
+	key := accountKey("imap.test:993", "u")
+	old, cur := &session{key: key, pass: p.passHash("old")}, &session{key: key, pass: p.passHash("new")}
+	p.idle[key] = []*session{old, cur}
+
+	if s := p.pop(key, p.passHash("wrong")); s != nil {
+		t.Fatal("session reused with a wrong password")
+	}
+	if s := p.pop(key, p.passHash("old")); s != old {
+		t.Fatal("session of the password not reused")
+	}
+	// Any password, when a slot is needed
+	if s := p.pop(key, ""); s != cur {
+		t.Fatal("idle session not given up")
+	}
+	if _, ok := p.idle[key]; ok {
+		t.Error("idle entry kept once empty")
+	}
+}
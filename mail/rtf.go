@@ -0,0 +1,306 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Compression types of PR_RTF_COMPRESSED
+const (
+	rtfCompressed   = 0x75465A4C // LZFu
+	rtfUncompressed = 0x414C454D // MELA
+)
+
+// Initial dictionary of the compressed rtf format
+const rtfPrebuf = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}{\\f0\\fnil \\froman \\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+
+// Decompresses a PR_RTF_COMPRESSED value
+// The output never exceeds the raw size written in the header
+func decompressRtf(b []byte) ([]byte, error) {
+	if len(b) < 16 {
+		return nil, errors.New("rtf: header too short")
+	}
+	size := binary.LittleEndian.Uint32(b[4:])
+	kind := binary.LittleEndian.Uint32(b[8:])
+	crc := binary.LittleEndian.Uint32(b[12:])
+	data := b[16:]
+
+	switch kind {
+	case rtfUncompressed:
+		if uint32(len(data)) > size {
+			data = data[:size]
+		}
+		return data, nil
+	case rtfCompressed:
+	default:
+		return nil, fmt.Errorf("rtf: unknown compression %#x", kind)
+	}
+	// The crc has no initial or final inversion, unlike crc32.ChecksumIEEE
+	if sum := ^crc32.Update(^uint32(0), crc32.IEEETable, data); sum != crc {
+		return nil, fmt.Errorf("rtf: crc %#x, want %#x", sum, crc)
+	}
+
+	var dict [4096]byte
+	copy(dict[:], rtfPrebuf)
+	pos := len(rtfPrebuf)
+	out := make([]byte, 0, min(int(size), 4*len(data)))
+
+	for i := 0; i < len(data) && len(out) < int(size); {
+		control := data[i]
+		i++
+		for bit := 0; bit < 8 && i < len(data) && len(out) < int(size); bit++ {
+			if control&(1<<bit) == 0 {
+				dict[pos] = data[i]
+				pos = (pos + 1) % len(dict)
+				out = append(out, data[i])
+				i++
+				continue
+			}
+			if i+1 >= len(data) {
+				return out, errors.New("rtf: truncated reference")
+			}
+			ref := int(data[i])<<8 | int(data[i+1])
+			i += 2
+			offset, n := ref>>4, ref&0xF+2
+			// A reference to the write position ends the stream
+			if offset == pos {
+				return out, nil
+			}
+			for j := 0; j < n && len(out) < int(size); j++ {
+				c := dict[(offset+j)%len(dict)]
+				dict[pos] = c
+				pos = (pos + 1) % len(dict)
+				out = append(out, c)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Destinations whose text is not part of the body
+var rtfSkip = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true,
+	"object": true, "header": true, "footer": true, "headerl": true, "headerr": true,
+	"footerl": true, "footerr": true, "listtable": true, "listoverridetable": true,
+	"rsidtbl": true, "generator": true, "xmlnstbl": true, "themedata": true,
+	"colorschememapping": true, "datastore": true, "latentstyles": true, "fldinst": true,
+	"filetbl": true, "revtbl": true,
+}
+
+// Characters written for rtf control words
+var rtfChars = map[string]string{
+	"par": "\n", "line": "\n", "sect": "\n", "row": "\n", "tab": "\t", "cell": "\t",
+	"emdash": "—", "endash": "–", "bullet": "•", "lquote": "‘",
+	"rquote": "’", "ldblquote": "“", "rdblquote": "”",
+}
+
+// State of an rtf group
+type rtfGroup struct {
+	// Text of the group is not written
+	skip bool
+	// Group of an html tag encapsulated by \*\htmltag
+	tag bool
+	// Text between \htmlrtf and \htmlrtf0 is rtf only formatting
+	htmlrtf bool
+	// Number of characters following \u that are skipped, set by \uc
+	uc int
+}
+
+// Reads the body of a rtf document
+// Html encapsulated by Outlook (\fromhtml1) is returned as html, other documents as plain text
+// Returns the body and true for html
+func rtfBody(b []byte) (string, bool) {
+	html := bytes.Contains(b[:min(len(b), 1024)], []byte("\\fromhtml"))
+
+	var out strings.Builder
+	// Bytes of the document code page, converted on flush
+	var pending []byte
+	cs := "windows-1252"
+	flush := func() {
+		if len(pending) > 0 {
+			s, _ := toUtf8(cs, pending)
+			out.WriteString(s)
+			pending = pending[:0]
+		}
+	}
+
+	g := rtfGroup{uc: 1}
+	var stack []rtfGroup
+	// Characters to skip after a \u control word
+	skipChars := 0
+	// A group opened with \* is skipped unless its first control word is known
+	starred := false
+
+	visible := func() bool {
+		if g.skip {
+			return false
+		}
+		if html {
+			return g.tag || !g.htmlrtf
+		}
+		return true
+	}
+	write := func(c byte) {
+		if skipChars > 0 {
+			skipChars--
+			return
+		}
+		if visible() {
+			pending = append(pending, c)
+		}
+	}
+
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '{':
+			stack = append(stack, g)
+			starred = false
+		case '}':
+			if len(stack) > 0 {
+				g = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			starred = false
+		case '\r', '\n':
+		case '\\':
+			if i+1 >= len(b) {
+				break
+			}
+			i++
+			c = b[i]
+			if !isLetter(c) {
+				switch c {
+				case '\\', '{', '}':
+					write(c)
+				case '~':
+					write(0xa0)
+				case '_':
+					write('-')
+				case '*':
+					starred = true
+				case '\'':
+					if i+2 < len(b) {
+						if v, err := strconv.ParseUint(string(b[i+1:i+3]), 16, 8); err == nil {
+							write(byte(v))
+						}
+						i += 2
+					}
+				case '\r', '\n':
+					if visible() && skipChars == 0 {
+						pending = append(pending, '\n')
+					}
+				}
+				break
+			}
+
+			// Control word with an optional signed parameter, a space delimiter is part of it
+			start := i
+			for i < len(b) && isLetter(b[i]) {
+				i++
+			}
+			word := string(b[start:i])
+			pstart := i
+			if i < len(b) && b[i] == '-' {
+				i++
+			}
+			for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+				i++
+			}
+			param, hasParam := 0, i > pstart
+			if hasParam {
+				param, _ = strconv.Atoi(string(b[pstart:i]))
+			}
+			if i >= len(b) || b[i] != ' ' {
+				i--
+			}
+
+			if starred {
+				starred = false
+				if html && word == "htmltag" {
+					g.tag = true
+					continue
+				}
+				g.skip = true
+				continue
+			}
+			if skipChars > 0 && word != "u" {
+				skipChars--
+				continue
+			}
+
+			switch {
+			case rtfSkip[word]:
+				g.skip = true
+			case word == "ansicpg" && hasParam:
+				flush()
+				cs = codepage(param)
+			case word == "htmlrtf":
+				g.htmlrtf = !hasParam || param != 0
+			case word == "uc" && hasParam:
+				g.uc = param
+			case word == "u" && hasParam:
+				if param < 0 {
+					param += 65536
+				}
+				if visible() {
+					flush()
+					out.WriteRune(rune(param))
+				}
+				skipChars = g.uc
+			case word == "bin" && hasParam:
+				i += max(param, 0)
+			case rtfChars[word] != "":
+				if visible() {
+					flush()
+					// Html keeps the line breaks of the original tags
+					if html && word == "par" {
+						out.WriteString("\r\n")
+						continue
+					}
+					out.WriteString(rtfChars[word])
+				}
+			}
+		default:
+			write(c)
+		}
+	}
+	flush()
+
+	s := out.String()
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	return s, html
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Returns the charset of a Windows code page
+func codepage(cp int) string {
+	switch cp {
+	case 932:
+		return "shift_jis"
+	case 936:
+		return "gbk"
+	case 949:
+		return "euc-kr"
+	case 950:
+		return "big5"
+	case 20127:
+		return "us-ascii"
+	case 28591:
+		return "iso-8859-1"
+	case 65001:
+		return "utf-8"
+	}
+	return fmt.Sprintf("windows-%d", cp)
+}
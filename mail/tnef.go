@@ -0,0 +1,357 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// Signature at the start of a TNEF stream
+const tnefSignature = 0x223E9F78
+
+// Levels of TNEF attributes
+const (
+	tnefMessage    = 1
+	tnefAttachment = 2
+)
+
+// TNEF attribute ids, without their type
+const (
+	attBody           = 0x800C
+	attAttachData     = 0x800F
+	attAttachTitle    = 0x8010
+	attAttachRenddata = 0x9002
+	attMsgProps       = 0x9003
+	attAttachment     = 0x9005
+	attOemCodepage    = 0x9007
+)
+
+// MAPI property ids read from attMsgProps and attAttachment
+const (
+	prBody            = 0x1000
+	prRtfCompressed   = 0x1009
+	prHtml            = 0x1013
+	prDisplayName     = 0x3001
+	prAttachDataBin   = 0x3701
+	prAttachFilename  = 0x3704
+	prAttachLongName  = 0x3707
+	prAttachMimeTag   = 0x370E
+	prAttachContentId = 0x3712
+	prAttachLongPath  = 0x370D
+)
+
+// MAPI property types
+const (
+	ptShort    = 0x0002
+	ptLong     = 0x0003
+	ptFloat    = 0x0004
+	ptDouble   = 0x0005
+	ptCurrency = 0x0006
+	ptAppTime  = 0x0007
+	ptError    = 0x000A
+	ptBoolean  = 0x000B
+	ptObject   = 0x000D
+	ptI8       = 0x0014
+	ptString8  = 0x001E
+	ptUnicode  = 0x001F
+	ptSysTime  = 0x0040
+	ptClsid    = 0x0048
+	ptBinary   = 0x0102
+	ptMulti    = 0x1000
+)
+
+// Contents of a winmail.dat
+type tnef struct {
+	// Body of the message, any of them may be empty
+	Text string
+	Html string
+	// Decompressed rtf body
+	Rtf   []byte
+	Files []Attachment
+}
+
+// Returns true for attachments holding a TNEF stream
+func isTnef(ctype, name string) bool {
+	return ctype == "application/ms-tnef" || ctype == "application/vnd.ms-tnef" || strings.EqualFold(name, "winmail.dat")
+}
+
+// Reads the attachments and the body of a winmail.dat
+func decodeTnef(b []byte) (*tnef, error) {
+	r := &tnefReader{b: b}
+	if sig := r.uint32(); sig != tnefSignature || r.err != nil {
+		return nil, errors.New("tnef: missing signature")
+	}
+	// Legacy key
+	r.uint16()
+
+	t := &tnef{}
+	cs := "windows-1252"
+	var att *Attachment
+	// Adds the current attachment to Files
+	done := func() {
+		if att != nil && (att.Name != "" || att.Buf.Len() > 0) {
+			t.Files = append(t.Files, *att)
+		}
+		att = nil
+	}
+
+	for r.err == nil && r.left() > 0 {
+		level := r.byte()
+		id := r.uint32() & 0xFFFF
+		data := r.bytes(int(r.uint32()))
+		// Checksum
+		r.uint16()
+		if r.err != nil {
+			break
+		}
+
+		switch {
+		case level == tnefMessage && id == attOemCodepage && len(data) >= 4:
+			cs = codepage(int(binary.LittleEndian.Uint32(data)))
+		case level == tnefMessage && id == attBody:
+			t.Text, _ = toUtf8(cs, bytes.TrimRight(data, "\x00"))
+		case level == tnefMessage && id == attMsgProps:
+			props, err := mapiProps(data, cs)
+			if err != nil {
+				return t, err
+			}
+			if v, ok := props[prBody].(string); ok && t.Text == "" {
+				t.Text = v
+			}
+			if v, ok := props[prHtml].([]byte); ok {
+				t.Html, _ = toUtf8("utf-8", v)
+			} else if v, ok := props[prHtml].(string); ok {
+				t.Html = v
+			}
+			if v, ok := props[prRtfCompressed].([]byte); ok {
+				if t.Rtf, err = decompressRtf(v); err != nil {
+					return t, err
+				}
+			}
+		case level == tnefAttachment && id == attAttachRenddata:
+			// Every attachment starts with its rendering data
+			done()
+			att = &Attachment{}
+		case level == tnefAttachment && att != nil && id == attAttachTitle:
+			att.Name, _ = toUtf8(cs, bytes.TrimRight(data, "\x00"))
+		case level == tnefAttachment && att != nil && id == attAttachData:
+			att.Buf.Reset()
+			att.Buf.Write(data)
+		case level == tnefAttachment && att != nil && id == attAttachment:
+			props, err := mapiProps(data, cs)
+			if err != nil {
+				return t, err
+			}
+			// The long file name is preferred over the 8.3 title
+			for _, p := range []uint16{prAttachLongName, prAttachLongPath, prDisplayName, prAttachFilename} {
+				if v, ok := props[p].(string); ok && v != "" {
+					att.Name = path.Base(strings.ReplaceAll(v, "\\", "/"))
+					break
+				}
+			}
+			if v, ok := props[prAttachMimeTag].(string); ok {
+				att.Type = v
+			}
+			if v, ok := props[prAttachContentId].(string); ok {
+				att.ContentId = strings.Trim(v, " <>")
+			}
+			if v, ok := props[prAttachDataBin].([]byte); ok && att.Buf.Len() == 0 {
+				att.Buf.Write(v)
+			}
+		}
+	}
+	done()
+	if r.err != nil {
+		return t, r.err
+	}
+
+	for i := range t.Files {
+		f := &t.Files[i]
+		if f.Type == "" {
+			f.Type = mime.TypeByExtension(strings.ToLower(path.Ext(f.Name)))
+		}
+		if mt, _, err := mime.ParseMediaType(f.Type); err == nil {
+			f.Type = mt
+		} else {
+			f.Type = "application/octet-stream"
+		}
+		if f.Name == "" {
+			f.Name = inlineName("", f.Type, f.ContentId, i)
+		}
+	}
+	return t, nil
+}
+
+// Reads a MAPI property list, multi valued properties keep their first value
+// Values are strings, []byte for binary and object properties, nil for the others
+func mapiProps(b []byte, cs string) (map[uint16]interface{}, error) {
+	r := &tnefReader{b: b}
+	props := make(map[uint16]interface{})
+	count := r.uint32()
+	for n := uint32(0); n < count && r.err == nil; n++ {
+		kind := r.uint16()
+		id := r.uint16()
+		if id >= 0x8000 {
+			// Named property: guid, kind, then an id or a name
+			r.bytes(16)
+			if r.uint32() == 0 {
+				r.uint32()
+			} else {
+				r.padded(int(r.uint32()))
+			}
+		}
+
+		values := 1
+		multi := kind&ptMulti != 0
+		kind &^= ptMulti
+		variable := kind == ptString8 || kind == ptUnicode || kind == ptBinary || kind == ptObject
+		if multi || variable {
+			values = int(r.uint32())
+		}
+		for v := 0; v < values && r.err == nil; v++ {
+			var val interface{}
+			switch kind {
+			case ptShort, ptLong, ptFloat, ptError, ptBoolean:
+				r.bytes(4)
+			case ptDouble, ptCurrency, ptAppTime, ptI8, ptSysTime:
+				r.bytes(8)
+			case ptClsid:
+				r.bytes(16)
+			case ptString8:
+				s, _ := toUtf8(cs, bytes.TrimRight(r.padded(int(r.uint32())), "\x00"))
+				val = s
+			case ptUnicode:
+				val = utf16le(r.padded(int(r.uint32())))
+			case ptBinary:
+				val = r.padded(int(r.uint32()))
+			case ptObject:
+				// Objects start with the interface id
+				data := r.padded(int(r.uint32()))
+				if len(data) >= 16 {
+					val = data[16:]
+				}
+			default:
+				return props, fmt.Errorf("tnef: unknown property type %#x", kind)
+			}
+			if _, ok := props[id]; !ok && val != nil {
+				props[id] = val
+			}
+		}
+	}
+	return props, r.err
+}
+
+// Decodes a null terminated utf-16le string
+func utf16le(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// Reads little endian values, the first out of bounds read sets err
+type tnefReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *tnefReader) left() int {
+	return len(r.b) - r.off
+}
+
+func (r *tnefReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.left() {
+		r.err = errors.New("tnef: truncated stream")
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+// Reads n bytes followed by their padding to a multiple of 4
+func (r *tnefReader) padded(n int) []byte {
+	b := r.bytes(n)
+	if pad := (4 - n%4) % 4; pad <= r.left() {
+		r.off += pad
+	}
+	return b
+}
+
+func (r *tnefReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tnefReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tnefReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// Replaces a winmail.dat attachment by the files it holds
+// The body is used when the message has none, html from an rtf body encapsulating it
+// The original is kept after the files when keepTnef is set or it can not be read
+func (m *Message) tnef(name string, b []byte) {
+	t, err := decodeTnef(b)
+	if err != nil {
+		m.warn("%v: %v", name, err)
+	}
+	if t != nil {
+		if t.Html == "" && len(t.Rtf) > 0 {
+			if body, html := rtfBody(t.Rtf); html {
+				t.Html = body
+			} else if t.Text == "" {
+				t.Text = body
+			}
+		}
+		if m.BodyHtml == "" {
+			m.BodyHtml = strings.TrimSpace(t.Html)
+		}
+		if m.BodyText == "" {
+			m.BodyText = strings.TrimSpace(t.Text)
+		}
+
+		for _, f := range t.Files {
+			// Images of the html body are inline parts
+			if f.ContentId != "" && strings.Contains(m.BodyHtml, "cid:"+f.ContentId) {
+				m.Inline = append(m.Inline, f)
+				continue
+			}
+			if f.Type == "text/calendar" || strings.EqualFold(path.Ext(f.Name), ".ics") {
+				m.calendar(f.Buf.Bytes())
+			}
+			m.Attachment = append(m.Attachment, f)
+		}
+	}
+
+	if m.keepTnef || err != nil {
+		var buf bytes.Buffer
+		buf.Write(b)
+		m.Attachment = append(m.Attachment, Attachment{Name: name, Type: "application/ms-tnef", Buf: buf})
+	}
+}
@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDecompressRtf(t *testing.T) {
+	// Example of MS-OXRTFCP, references into the initial dictionary and the output
+	b, err := hex.DecodeString("2d0000002b0000004c5a4675f1c5c7a703000a0072637067313235423" +
+		"20af32068656c090020627705b06c647d0a800fa0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n"
+	if got, err := decompressRtf(b); err != nil || string(got) != want {
+		t.Errorf("decompressRtf = %q, %v, want %q", got, err, want)
+	}
+
+	b[20] ^= 0xff
+	if _, err := decompressRtf(b); err == nil {
+		t.Error("decompressRtf accepted a corrupted stream")
+	}
+}
+
+func TestRtfBody(t *testing.T) {
+	tests := []struct {
+		name string
+		rtf  string
+		want string
+		html bool
+	}{
+		{
+			name: "plain rtf",
+			rtf:  `{\rtf1\ansi\ansicpg1252{\fonttbl{\f0 Arial;}}{\*\generator Riched20;}\pard Caf\'e9\par Line \u8364? two\tab end}`,
+			want: "Café\nLine € two\tend",
+		},
+		{
+			name: "encapsulated html",
+			rtf:  `{\rtf1\ansi\fromhtml1{\*\htmltag64 <p>}\htmlrtf {\b \htmlrtf0 Bold \{x\}\htmlrtf }\htmlrtf0 {\*\htmltag72 </p>}}`,
+			want: "<p>Bold {x}</p>",
+			html: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, html := rtfBody([]byte(tt.rtf))
+			if got != tt.want || html != tt.html {
+				t.Errorf("rtfBody = %q, %v, want %q, %v", got, html, tt.want, tt.html)
+			}
+		})
+	}
+}
+
+func TestTnefKeepOriginal(t *testing.T) {
+	b, err := os.ReadFile("testdata/corpus/winmail-dat.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Message{Id: "keep", keepTnef: true}
+	m.parse(bytes.NewReader(b), 0, discard)
+	var names []string
+	for _, a := range m.Attachment {
+		names = append(names, a.Name)
+	}
+	if got, want := strings.Join(names, ", "), "NOTES.TXT, Quarterly report 2024.csv, winmail.dat"; got != want {
+		t.Errorf("attachments = %v, want %v", got, want)
+	}
+}
+
+func TestTnefCorrupted(t *testing.T) {
+	b, err := os.ReadFile("testdata/corpus/winmail-dat.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Truncates the base64 body of winmail.dat, the first attachment is still complete
+	i := bytes.Index(b, []byte("--tnef--"))
+	b = append(b[:i-120:i-120], []byte("\r\n--tnef--\r\n")...)
+
+	m := Message{Id: "corrupted"}
+	m.parse(bytes.NewReader(b), 0, discard)
+	if n := len(m.Attachment); n == 0 || m.Attachment[n-1].Name != "winmail.dat" {
+		t.Fatalf("attachments = %+v, want winmail.dat kept", m.Attachment)
+	}
+	if len(m.Warnings) == 0 || !strings.Contains(m.Warnings[0], "winmail.dat: tnef: truncated stream") {
+		t.Errorf("warnings = %q", m.Warnings)
+	}
+}
@@ -2,29 +2,216 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
+	"github.com/tars47/go-read-mail/archive"
+	"github.com/tars47/go-read-mail/auth"
 	"github.com/tars47/go-read-mail/awss3"
 	"github.com/tars47/go-read-mail/excel"
+	"github.com/tars47/go-read-mail/extract"
+	"github.com/tars47/go-read-mail/logging"
 	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/metrics"
+	"github.com/tars47/go-read-mail/policy"
+	"github.com/tars47/go-read-mail/rules"
+	"github.com/tars47/go-read-mail/scan"
+	"github.com/tars47/go-read-mail/schedule"
+	"github.com/tars47/go-read-mail/tracing"
+	"github.com/tars47/go-read-mail/workers"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Default name for the excel file
 const DefaultExcel = "data.xlsx"
 
+// Default name for the manifest file used by large workbooks
+const DefaultManifest = "manifest.jsonl"
+
+// Default name for the file holding the Meetings sheet rows of large workbooks
+const DefaultMeetings = "meetings.jsonl"
+
+// Defaults of the upload workers, see UPLOAD_WORKERS and UPLOAD_QUEUE
+const (
+	DefaultUploadWorkers = 16
+	DefaultUploadQueue   = 64
+)
+
+// Workers uploading attachments and bodies, shared by every request
+var uploads = workers.New(DefaultUploadWorkers, DefaultUploadQueue)
+
+// Bounds of the archive expansion, see ARCHIVE_MAX_DEPTH, ARCHIVE_MAX_ENTRIES and ARCHIVE_MAX_SIZE
+var archiveLimits = archive.DefaultLimits
+
+// Default prefix of the keys infected attachments are stored under
+const DefaultQuarantine = "quarantine"
+
+// Scanners run on every attachment before it is stored, see SCAN_HEURISTIC and CLAMD_ADDR
+var scanner scan.Scanner = scan.Heuristic{}
+
+// clamd client checked by readyz, nil if CLAMD_ADDR is not set
+var clamd *scan.Clamd
+
+// Prefix of the keys infected attachments are stored under, see QUARANTINE_PREFIX
+var quarantinePrefix = DefaultQuarantine
+
 func main() {
 
+	// Structured logs on stderr, LOG_LEVEL debug, info, warn or error and LOG_FORMAT text or json
+	if err := logging.Setup(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")); err != nil {
+		fatal("err setting up logging", err)
+	}
+
+	// Spans of every sync stage, TRACE_EXPORTER stdout or otlp-file, written to TRACE_FILE
+	shutdown, err := tracing.Setup(os.Getenv("TRACE_EXPORTER"), os.Getenv("TRACE_FILE"))
+	if err != nil {
+		fatal("err setting up tracing", err)
+	}
+	// Pending spans are flushed on shutdown
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Error("err flushing traces", "err", err)
+		}
+		os.Exit(0)
+	}()
+
+	// Roots trusted for S/MIME signatures, a pem file, defaults to the system roots
+	if path := os.Getenv("SMIME_TRUST_STORE"); path != "" {
+		if err := mail.LoadTrustStore(path); err != nil {
+			fatal("err loading trust store", err)
+		}
+	}
+
+	// Key signing the tokens of the user endpoints, shared by every instance
+	// Tokens are invalid after a restart if not set
+	if key := os.Getenv("AUTH_SECRET"); key != "" {
+		auth.SetSecret(key)
+	} else {
+		slog.Warn("AUTH_SECRET not set, tokens are signed with a random key")
+	}
+
+	// Admin endpoints are disabled while ADMIN_TOKEN is not set
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	// Scheduled syncs, SCHEDULER_CONCURRENCY limits how many run at once
+	// Their sync requests are saved encrypted with SCHEDULE_KEY
+	if key := os.Getenv("SCHEDULE_KEY"); key != "" {
+		schedule.SetKey(key)
+	} else {
+		slog.Warn("SCHEDULE_KEY not set, saved schedules are lost on restart")
+	}
+	scheduler = schedule.New(envInt("SCHEDULER_CONCURRENCY", DefaultConcurrency), runScheduled)
+	if err := scheduler.Start(context.Background()); err != nil {
+		fatal("err starting scheduler", err)
+	}
+
+	// Upload workers shared by every request, UPLOAD_WORKERS uploads run at once
+	// and a request waits once UPLOAD_QUEUE of its uploads are queued
+	if os.Getenv("UPLOAD_WORKERS") != "" || os.Getenv("UPLOAD_QUEUE") != "" {
+		uploads = workers.New(envInt("UPLOAD_WORKERS", DefaultUploadWorkers), envInt("UPLOAD_QUEUE", DefaultUploadQueue))
+	}
+
+	// Levels, files and decompressed bytes of the archives expanded by syncs with expand set
+	archiveLimits = archive.Limits{
+		Depth:   envInt("ARCHIVE_MAX_DEPTH", archive.DefaultLimits.Depth),
+		Entries: envInt("ARCHIVE_MAX_ENTRIES", archive.DefaultLimits.Entries),
+		Size:    int64(envInt("ARCHIVE_MAX_SIZE", int(archive.DefaultLimits.Size))),
+	}
+
+	// Malware scanners, the built-in heuristic unless SCAN_HEURISTIC is false, then clamd at
+	// CLAMD_ADDR, host:port or a unix socket path. Infected attachments go under QUARANTINE_PREFIX
+	var scanners scan.Chain
+	if os.Getenv("SCAN_HEURISTIC") != "false" {
+		scanners = append(scanners, scan.Heuristic{})
+	}
+	if addr := os.Getenv("CLAMD_ADDR"); addr != "" {
+		clamd = scan.NewClamd(addr)
+		scanners = append(scanners, clamd)
+	}
+	scanner = scanners
+	if prefix := os.Getenv("QUARANTINE_PREFIX"); prefix != "" {
+		quarantinePrefix = strings.Trim(prefix, "/")
+	}
+
 	// This handles the request
 	http.HandleFunc("POST /", readMail)
 
+	// Tokens of the user endpoints, issued after logging in to the user imap account
+	http.HandleFunc("POST /users/{user}/token", createToken)
+
+	// Rules evaluated against every message before export
+	http.HandleFunc("GET /users/{user}/rules", authorized(listRules))
+	http.HandleFunc("POST /users/{user}/rules", authorized(createRule))
+	http.HandleFunc("PUT /users/{user}/rules/{id}", authorized(updateRule))
+	http.HandleFunc("DELETE /users/{user}/rules/{id}", authorized(deleteRule))
+	http.HandleFunc("POST /rules/dry-run", dryRunRules)
+
+	// Webhooks notified of sync outcomes and rule matches
+	http.HandleFunc("GET /users/{user}/webhooks", authorized(listWebhooks))
+	http.HandleFunc("POST /users/{user}/webhooks", authorized(createWebhook))
+	http.HandleFunc("DELETE /users/{user}/webhooks/{id}", authorized(deleteWebhook))
+	http.HandleFunc("GET /users/{user}/webhooks/deliveries", authorized(listDeliveries))
+
+	// Periodic syncs with their last and next run
+	http.HandleFunc("GET /schedules", admin(listSchedules))
+	http.HandleFunc("GET /users/{user}/schedule", authorized(getSchedule))
+	http.HandleFunc("PUT /users/{user}/schedule", authorized(putSchedule))
+	http.HandleFunc("DELETE /users/{user}/schedule", authorized(deleteSchedule))
+
+	// Attachment policy deciding which attachments are uploaded
+	http.HandleFunc("GET /users/{user}/policy", authorized(getPolicy))
+	http.HandleFunc("PUT /users/{user}/policy", authorized(putPolicy))
+	http.HandleFunc("DELETE /users/{user}/policy", authorized(deletePolicy))
+
+	// Prometheus metrics, liveness and readiness
+	http.Handle("GET /metrics", metrics.Handler())
+	http.HandleFunc("GET /healthz", healthz)
+	http.HandleFunc("GET /readyz", readyz)
+
+	// Progress of the user uploads
+	http.HandleFunc("GET /users/{user}/uploads", authorized(uploadProgress))
+
 	// Start the server
-	log.Fatal(http.ListenAndServe(":3000", nil))
+	slog.Info("listening", "addr", ":3000")
+	fatal("server stopped", http.ListenAndServe(":3000", nil))
+}
+
+// Request struct sent by the user
+type request struct {
+	mail.Mail
+	// Builds the excel file with a streaming writer
+	// Meant for very large mailboxes, once enabled the manifest is kept up to date
+	Large bool
+	// Adds a column with the beginning of the attachments text
+	Snippet bool
+	// Writes attached emails as child rows below their parent
+	Embedded bool
+	// Adds a column linking a sanitized copy of the html body
+	Body bool
+	// Adds DKIM, SPF, DMARC and S/MIME columns
+	Auth bool
+	// Adds Read, Flags, Received, Size, Labels and Thread columns
+	Imap bool
+	// Expands zip and tar.gz attachments, their files are uploaded under the archive key
+	Expand bool
+	// Changes applied to the exported messages once the excel file is uploaded
+	Actions mail.Actions
 }
 
 // Response struct that will be sent to the user
@@ -32,6 +219,37 @@ type response struct {
 	Status   int    `json:"status"`
 	Message  string `json:"message"`
 	ExcelUrl string `json:"excelUrl"`
+	// Files that could not be uploaded, their cells are marked "(upload failed)"
+	Failed []uploadFailure `json:"failed,omitempty"`
+	// Archives that could not be expanded, or only partly, eg: password protected
+	Unexpanded []archiveFailure `json:"unexpanded,omitempty"`
+	// Attachments found infected, stored under the quarantine prefix
+	Quarantined []quarantinedFile `json:"quarantined,omitempty"`
+	// Payload of the non sync endpoints
+	Data interface{} `json:"data,omitempty"`
+}
+
+// A file of a message that could not be uploaded
+type uploadFailure struct {
+	Message string `json:"message"`
+	Name    string `json:"name"`
+	// Class of the error: transient, auth or permanent
+	Class string `json:"class"`
+	Error string `json:"error"`
+}
+
+// An archive attachment that could not be fully expanded
+type archiveFailure struct {
+	Message string `json:"message"`
+	Name    string `json:"name"`
+	Error   string `json:"error"`
+}
+
+// An attachment found infected by a scanner
+type quarantinedFile struct {
+	Message string `json:"message"`
+	Name    string `json:"name"`
+	Threat  string `json:"threat"`
 }
 
 // Handler function that process the user request
@@ -40,55 +258,122 @@ type response struct {
 // If not present fetches lastest 25 messages and saves it to s3
 func readMail(w http.ResponseWriter, r *http.Request) {
 
-	var u mail.Mail
+	var req request
 	// Decode the user request and validate
-	err := json.NewDecoder(r.Body).Decode(&u)
-	if err != nil || u.Addr == "" || u.User == "" || u.Pass == "" {
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Addr == "" || req.User == "" || req.Pass == "" {
 		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
 		return
 	}
+	ctx := requestContext(w, r, req.User)
+	// The sync writes the user files and fires the user webhooks
+	if !owner(ctx, w, r, req.User, req.Addr) {
+		return
+	}
+	log := logging.From(ctx).With("op", "sync")
+	log.Info("sync started", "large", req.Large)
+	begin := time.Now()
+	rep, status, err := syncUser(ctx, req)
+	if err != nil {
+		log.Error("sync failed", "status", status, "duration", time.Since(begin), "err", err)
+		send(w, response{Status: status, Message: err.Error(), Failed: rep.failed, Unexpanded: rep.unexpanded, Quarantined: rep.quarantined})
+		return
+	}
+	log.Info("sync finished", "duration", time.Since(begin), "fetched", rep.Fetched, "exported", rep.Exported, "failed_uploads", rep.FailedUploads)
+	// Sends the response back to client, response containes excel s3 url
+	send(w, response{Status: http.StatusCreated, Message: "Success", ExcelUrl: rep.url, Failed: rep.failed, Unexpanded: rep.unexpanded, Quarantined: rep.quarantined})
+}
+
+// Syncs the user excel file and notifies the user webhooks of the outcome
+// Returns the report of the sync, and the response status and the error of a failed sync
+func syncUser(ctx context.Context, req request) (*syncReport, int, error) {
+	metrics.ActiveJobs.WithLabelValues("sync").Inc()
+	defer metrics.ActiveJobs.WithLabelValues("sync").Dec()
+
+	ctx, span := tracing.Start(ctx, "sync", attribute.String("account", logging.Account(req.User)), attribute.Bool("large", req.Large))
+	rep := &syncReport{}
+	url, status, err := runSync(ctx, req, rep)
+	rep.url = url
+	span.SetAttributes(
+		attribute.Int("fetched", rep.Fetched),
+		attribute.Int("exported", rep.Exported),
+		attribute.Int("flag_changes", rep.FlagChanges),
+		attribute.Int("failed_uploads", rep.FailedUploads),
+	)
+	tracing.End(span, err)
+	notify(ctx, req.User, rep, url, err)
+	return rep, status, err
+}
+
+// Runs a sync, recording its outcome in rep
+func runSync(ctx context.Context, req request, rep *syncReport) (string, int, error) {
+	u := req.Mail
+	opt := excel.Options{Snippet: req.Snippet, Embedded: req.Embedded, Body: req.Body, Auth: req.Auth, Imap: req.Imap}
+	u.KeepAuth = opt.Auth
 
 	// Connect to the imap address provides
 	// Login the user with user email and password provided
 	// Select the INBOX folder
-	if err := u.Login(); err != nil {
-		send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
-		return
+	if err := u.Login(ctx); err != nil {
+		return "", http.StatusBadRequest, err
 	}
 	defer u.Logout()
 
+	// Flag changes since the last sync are picked up using CONDSTORE
+	st, err := loadState(ctx, u.User)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	st.prepare(u.UidValidity(), req.Actions.Steps())
+	st.report = rep
+	st.expand = req.Expand
+	// Read before fetching so changes made during the sync are picked up next time
+	modseq := u.HighestModSeq()
+	changes := flagChanges(ctx, &u, st)
+	rep.FlagChanges = len(changes)
+
+	// Large workbooks are rebuilt from the manifest instead of prepending rows
+	manifest, err := downloadManifest(ctx, u.User)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if manifest != nil || req.Large {
+		url, err := syncLargeExcel(ctx, &u, st, manifest, opt, changes)
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		updateState(ctx, &u, st, modseq)
+		return url, http.StatusCreated, nil
+	}
+
 	// Check s3 if user email folder already exists format: example@gmail.com/data.xlsx
 	// If present returns bytes buffer
-	s3buf, err := awss3.DownloadFile(fmt.Sprintf("%s/%s", u.User, DefaultExcel))
+	s3buf, err := awss3.DownloadFile(ctx, fmt.Sprintf("%s/%s", u.User, DefaultExcel))
 	if err != nil {
 		// If file not present we assume this is a new user
 		if strings.Contains(err.Error(), awss3.NotFound) {
 			// Fetches recent 25 messages from imap server and creates excel file and uploads to s3
 			// returns the s3 presigned url
-			url, err := createUserExcel(&u)
+			url, err := createUserExcel(ctx, &u, st, opt)
 			if err != nil {
-				send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
-				return
+				return "", http.StatusInternalServerError, err
 			}
-			// Sends the response back to client, response containes excel s3 url
-			send(w, response{Status: http.StatusCreated, Message: "Success", ExcelUrl: url})
-			return
+			updateState(ctx, &u, st, modseq)
+			return url, http.StatusCreated, nil
 		}
-		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
-		return
+		return "", http.StatusInternalServerError, err
 	}
 
 	// Reads the recent message from the buffer and fetches all messages after the recent message
 	// Updates the excel
 	// Replaces the s3 file
 	// Returns presigned s3 url
-	url, err := updateUserExcel(&u, s3buf)
+	url, err := updateUserExcel(ctx, &u, st, s3buf, opt, changes)
 	if err != nil {
-		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
-		return
+		return "", http.StatusInternalServerError, err
 	}
-	// Sends the response back to client, response containes excel s3 url
-	send(w, response{Status: http.StatusCreated, Message: "Success", ExcelUrl: url})
+	updateState(ctx, &u, st, modseq)
+	return url, http.StatusCreated, nil
 }
 
 // Fetches recent 25 messages
@@ -96,7 +381,7 @@ func readMail(w http.ResponseWriter, r *http.Request) {
 // Creates new excel file
 // Uploads the excel file to s3
 // Returns the presigned s3 url
-func createUserExcel(u *mail.Mail) (string, error) {
+func createUserExcel(ctx context.Context, u *mail.Mail, st *syncState, opt excel.Options) (string, error) {
 	// Get total messages in the INBOX folder
 	to := u.NumMsgs()
 	from := to - 25
@@ -105,18 +390,26 @@ func createUserExcel(u *mail.Mail) (string, error) {
 		from = uint32(1)
 	}
 	// Fetches recent 25 messages
-	msgs := u.Fetch(from, to)
+	msgs, err := u.Fetch(ctx, from, to)
+	if err != nil {
+		return "", err
+	}
 
-	// Uploads all the attachments to s3 concurrently
-	uploadAttachments(u, msgs)
+	// Applies the rules and uploads all the attachments to s3
+	msgs, err = processMsgs(ctx, u, st, msgs, &opt)
+	if err != nil {
+		return "", err
+	}
 
 	// Creates new excel file
-	ebuf, err := excel.New(msgs)
+	start := time.Now()
+	ebuf, err := excel.New(ctx, msgs, opt)
+	metrics.ObserveExcel("new", start, len(msgs))
 	if err != nil {
 		return "", fmt.Errorf("unable to create excel file. err: %s", err.Error())
 	}
 	// Uploads the excel file to s3
-	url, err := awss3.UploadFile(fmt.Sprintf("%s/%s", u.User, DefaultExcel), ebuf)
+	url, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", u.User, DefaultExcel), ebuf)
 	if err != nil {
 		return "", fmt.Errorf("unable to upload excel file. err: %s", err.Error())
 	}
@@ -128,33 +421,52 @@ func createUserExcel(u *mail.Mail) (string, error) {
 // Fetches all messages after the last message date
 // Uploads all the attachments to s3 concurrently
 // Prepends the excel with the newly fetched messages
+// Rewrites the flags of the changed messages
 // Replaces the s3 file
 // Returns the presigned s3 url
-func updateUserExcel(u *mail.Mail, buf *bytes.Buffer) (string, error) {
+func updateUserExcel(ctx context.Context, u *mail.Mail, st *syncState, buf *bytes.Buffer, opt excel.Options, changes []mail.Message) (string, error) {
 	// Duplicate the buf received from s3
 	var bufc bytes.Buffer
 	tee := io.TeeReader(buf, &bufc)
 
 	// Reads the recent message date
-	t := excel.GetRecentMsgDate(tee)
+	t := excel.GetRecentMsgDate(ctx, tee)
 
 	// Fetches all the messages after recent message date
-	msgs := u.FetchAfter(t)
-	// If no messages found generate the presigned url and return
-	if len(msgs) == 0 {
-		return awss3.GetFileLink(fmt.Sprintf("%s/%s", u.User, DefaultExcel))
+	msgs, err := u.FetchAfter(ctx, t, st.exportedAt(t))
+	if err != nil {
+		return "", err
 	}
 
-	// Uploads all the attachments to s3 concurrently
-	uploadAttachments(u, msgs)
+	// Applies the rules and uploads all the attachments to s3
+	if len(msgs) > 0 {
+		if msgs, err = processMsgs(ctx, u, st, msgs, &opt); err != nil {
+			return "", err
+		}
+	}
+	// If no messages found, or all skipped by rules, and no flags changed
+	// generate the presigned url and return
+	if len(msgs) == 0 && len(changes) == 0 {
+		return awss3.GetFileLink(ctx, fmt.Sprintf("%s/%s", u.User, DefaultExcel))
+	}
 
 	// Prepends the excel with the newly fetched messages
-	bufp, err := excel.PrependRows(&bufc, msgs)
-	if err != nil {
-		return "", fmt.Errorf("unable to update excel file. err: %s", err.Error())
+	start := time.Now()
+	bufp := &bufc
+	if len(msgs) > 0 {
+		if bufp, err = excel.PrependRows(ctx, &bufc, msgs, opt); err != nil {
+			return "", fmt.Errorf("unable to update excel file. err: %s", err.Error())
+		}
 	}
+	// Rewrites the flags of the messages changed since the last sync
+	if len(changes) > 0 {
+		if bufp, _, err = excel.UpdateFlags(ctx, bufp, changes); err != nil {
+			return "", fmt.Errorf("unable to update excel file. err: %s", err.Error())
+		}
+	}
+	metrics.ObserveExcel("update", start, len(msgs))
 	// Replaces the s3 file and get pre signed s3 url
-	url, err := awss3.UploadFile(fmt.Sprintf("%s/%s", u.User, DefaultExcel), bufp)
+	url, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", u.User, DefaultExcel), bufp)
 	if err != nil {
 		return "", fmt.Errorf("unable to upload excel file. err: %s", err.Error())
 	}
@@ -163,25 +475,412 @@ func updateUserExcel(u *mail.Mail, buf *bytes.Buffer) (string, error) {
 
 }
 
-// Launches a go routine to upload to s3 concurrently
-func uploadAttachments(u *mail.Mail, msgs []mail.Message) {
-	var wg sync.WaitGroup
+// Prepares fetched messages for export
+// Extracts the attachments text, checks the signatures if the auth columns are on,
+// applies the user rules and uploads the attachments
+// Queues the write-back actions of the exported messages in the sync state
+// Enables the Tag column when a rule sets tags
+// Records the rule matches and the exported messages for the webhooks
+// Returns the messages to export
+func processMsgs(ctx context.Context, u *mail.Mail, st *syncState, msgs []mail.Message, opt *excel.Options) ([]mail.Message, error) {
+	ctx, span := tracing.Start(ctx, "sync.process", attribute.Int("messages", len(msgs)))
+	msgs, err := process(ctx, u, st, msgs, opt)
+	span.SetAttributes(attribute.Int("exported", len(msgs)))
+	tracing.End(span, err)
+	return msgs, err
+}
+
+// Runs the stages of processMsgs
+func process(ctx context.Context, u *mail.Mail, st *syncState, msgs []mail.Message, opt *excel.Options) ([]mail.Message, error) {
+	// Signatures are checked while the texts are extracted, both are done before rules reorder msgs
+	verified := make(chan struct{})
+	go func() {
+		defer close(verified)
+		if opt.Auth {
+			vctx, span := tracing.Start(ctx, "mail.verify", attribute.Int("messages", len(msgs)))
+			mail.Verify(vctx, msgs)
+			tracing.End(span, nil)
+		}
+	}()
+	ectx, span := tracing.Start(ctx, "extract.texts", attribute.Int("messages", len(msgs)))
+	extractTexts(ectx, msgs)
+	tracing.End(span, nil)
+	<-verified
+
+	rs, err := rules.Load(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load rules. err: %s", err.Error())
+	}
+	// Apply filters msgs in place, matches are recorded first
+	if st.report != nil {
+		st.report.match(msgs, rules.DryRun(rs, msgs))
+	}
+	msgs = rules.Apply(rs, msgs)
+	if st.report != nil {
+		st.report.export(msgs)
+	}
+	opt.Tag = opt.Tag || rules.HasTags(rs)
+	opt.Warnings = opt.Warnings || hasWarnings(msgs)
+
+	// Actions run once the excel file is uploaded
+	st.queue(msgs)
+	st.export(msgs)
+
+	pol, err := policy.Load(ctx, u.User)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load policy. err: %s", err.Error())
+	}
+
+	// Uploads all the attachments to s3 concurrently
+	uploadAttachments(ctx, u, msgs, uploadOptions{expand: st.expand, policy: &pol})
+
+	// Stores a safe copy of the html bodies, linking the uploaded images
+	if opt.Body {
+		uploadBodies(ctx, u, msgs)
+	}
+
+	// Uploads that failed after retries are reported in the response
+	if st.report != nil {
+		st.report.fail(msgs)
+	}
+
+	return msgs, nil
+}
+
+// Runs the queued write-back actions and saves the sync state after a successful sync
+// Failures are logged, the next sync picks up the same changes again
+func updateState(ctx context.Context, u *mail.Mail, st *syncState, modseq uint64) {
+	runActions(ctx, u, st)
+
+	st.UidValidity = u.UidValidity()
+	st.ModSeq = modseq
+	if err := saveState(ctx, u.User, st); err != nil {
+		logging.From(ctx).Error("err saving state", "op", "state", "err", err)
+	}
+}
+
+// Returns true if any message, or message embedded in it, was parsed with decoding fallbacks
+func hasWarnings(msgs []mail.Message) bool {
 	for _, msg := range msgs {
-		for i := 0; i < len(msg.Attachment); i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				url, err := awss3.UploadFile(fmt.Sprintf("%s/%s/%s", u.User, msg.Id, msg.Attachment[i].Name), &msg.Attachment[i].Buf)
-				if err != nil {
-					fmt.Printf("[uploadAttachments] err uploading attachment %s, user: %s. err: %s\n", msg.Attachment[i].Name, u.User, err.Error())
-					return
+		if len(msg.Warnings) > 0 || hasWarnings(msg.Embedded) {
+			return true
+		}
+	}
+	return false
+}
+
+// Uploads the attachments to s3 on the shared upload workers
+// Extracted text is stored next to the attachment with a .txt suffix
+// Inline parts are stored under the inline/ folder of the message
+// Embedded messages are stored under embedded/<n>/ of their parent
+// With expand set, the files of zip and tar.gz attachments are stored under the attachment key
+// Attachments and inline parts filtered out by the policy are not uploaded, nor expanded
+// Messages with SkipUpload set are left out
+func uploadAttachments(ctx context.Context, u *mail.Mail, msgs []mail.Message, opts uploadOptions) {
+	ctx, span := tracing.Start(ctx, "upload.attachments", attribute.Int("messages", len(msgs)))
+	g := uploads.Group(u.User)
+	for i := range msgs {
+		if msgs[i].SkipUpload {
+			continue
+		}
+		uploadMsg(ctx, g, u, fmt.Sprintf("%s/%s", u.User, msgs[i].Id), &msgs[i], opts)
+	}
+
+	g.Wait()
+	span.End()
+}
+
+// Options of uploadAttachments
+type uploadOptions struct {
+	// Expand zip and tar.gz attachments
+	expand bool
+	// Attachment policy of the user
+	policy *policy.Policy
+}
+
+// Queues the uploads of the attachments and inline parts of a message and its embedded messages under prefix
+// Every task gets its own attachment pointer and key so urls land on the right attachment
+func uploadMsg(ctx context.Context, g *workers.Group, u *mail.Mail, prefix string, msg *mail.Message, opts uploadOptions) {
+	for i := range msg.Attachment {
+		att, key := &msg.Attachment[i], fmt.Sprintf("%s/%s", prefix, msg.Attachment[i].Name)
+		if filterAttachment(ctx, att, opts.policy) {
+			continue
+		}
+		if opts.expand {
+			expandArchive(ctx, att)
+		}
+		if len(att.Children) > 0 {
+			g.Go(func() error { return uploadArchive(ctx, u, key, att, opts.policy) })
+			continue
+		}
+		g.Go(func() error { return uploadAttachment(ctx, u, key, att) })
+	}
+	for i := range msg.Inline {
+		att, key := &msg.Inline[i], fmt.Sprintf("%s/inline/%s", prefix, msg.Inline[i].Name)
+		// Filtered inline parts get no url, so the html body does not reference them
+		if filterAttachment(ctx, att, opts.policy) {
+			continue
+		}
+		g.Go(func() error { return uploadAttachment(ctx, u, key, att) })
+	}
+	for i := range msg.Embedded {
+		uploadMsg(ctx, g, u, fmt.Sprintf("%s/embedded/%d", prefix, i+1), &msg.Embedded[i], opts)
+	}
+}
+
+// Expands a zip or tar.gz attachment into its Children, sets Attachment.ArchiveError on failure
+func expandArchive(ctx context.Context, att *mail.Attachment) {
+	if !archive.Supported(att.Name, att.Type) {
+		return
+	}
+	if err := archive.Expand(att, archiveLimits); err != nil {
+		logging.From(ctx).Warn("err expanding archive", "op", "upload", "attachment", att.Name, "err", err)
+		att.ArchiveError = err
+	}
+}
+
+// Sniffs the attachment content type from its bytes and checks it against the policy
+// Returns true, with Attachment.Filtered set, if the attachment is not to be uploaded
+func filterAttachment(ctx context.Context, att *mail.Attachment, pol *policy.Policy) bool {
+	att.Type = policy.Sniff(att.Name, att.Type, att.Buf.Bytes())
+	if pol == nil {
+		return false
+	}
+	if att.Filtered = pol.Check(att); att.Filtered == "" {
+		return false
+	}
+	logging.From(ctx).Info("attachment filtered", "op", "upload", "attachment", att.Name, "reason", att.Filtered)
+	metrics.AttachmentsFiltered.Inc()
+	return true
+}
+
+// Uploads the files expanded from an archive under the archive key, then the archive
+// Files are uploaded one after the other so their verdicts are known before the archive is stored,
+// a file found infected quarantines the archive too, eg: "Heuristic.Executable in setup.exe"
+func uploadArchive(ctx context.Context, u *mail.Mail, key string, att *mail.Attachment, pol *policy.Policy) error {
+	var errs []error
+	threat := ""
+	for i := range att.Children {
+		c, ckey := &att.Children[i], fmt.Sprintf("%s/%s", key, att.Children[i].Name)
+		if filterAttachment(ctx, c, pol) {
+			continue
+		}
+		var err error
+		if len(c.Children) > 0 {
+			err = uploadArchive(ctx, u, ckey, c, pol)
+		} else {
+			err = uploadAttachment(ctx, u, ckey, c)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if c.Threat != "" && threat == "" {
+			threat = fmt.Sprintf("%s in %s", c.Threat, c.Name)
+		}
+	}
+
+	if threat != "" {
+		errs = append(errs, quarantine(ctx, key, att, scan.Verdict{Threat: threat, Scanner: "archive"}))
+	} else {
+		errs = append(errs, uploadAttachment(ctx, u, key, att))
+	}
+	return errors.Join(errs...)
+}
+
+// Uploads an attachment and its extracted text, sets Attachment.Url, or Attachment.Error on failure
+func uploadAttachment(ctx context.Context, u *mail.Mail, key string, att *mail.Attachment) error {
+	metrics.ActiveJobs.WithLabelValues("upload").Inc()
+	defer metrics.ActiveJobs.WithLabelValues("upload").Dec()
+
+	ctx, span := tracing.Start(ctx, "upload.attachment", attribute.String("type", att.Type), attribute.Int("bytes", att.Buf.Len()))
+	err := storeAttachment(ctx, key, att)
+	tracing.End(span, err)
+	return err
+}
+
+// Uploads the extracted text and the attachment for uploadAttachment
+func storeAttachment(ctx context.Context, key string, att *mail.Attachment) error {
+	if quarantined, err := scanAttachment(ctx, key, att); quarantined || err != nil {
+		return err
+	}
+
+	if att.Text != "" {
+		if _, err := awss3.UploadFile(ctx, key+".txt", strings.NewReader(att.Text)); err != nil {
+			logging.From(ctx).Warn("err uploading attachment text", "op", "upload", "attachment", att.Name, "err", err)
+		}
+	}
+
+	// Attachments already stored with the same content, eg: by a failed sync, are not uploaded again
+	url, deduped, err := awss3.UploadFileOnce(ctx, key, &att.Buf)
+	if err != nil {
+		logging.From(ctx).Error("err uploading attachment", "op", "upload", "attachment", att.Name, "err", err)
+		att.Error = err
+		return err
+	}
+	if deduped {
+		metrics.AttachmentsDeduped.Inc()
+	} else {
+		metrics.AttachmentsUploaded.Inc()
+	}
+	att.Url = url
+	return nil
+}
+
+// Scans the attachment before it is stored, infected attachments are stored under the quarantine
+// prefix, eg: quarantine/<user>/<id>/<name>, and get no link
+// Sets Attachment.Threat and returns true if the attachment was quarantined
+// Attachments that could not be scanned are not stored, Attachment.Error is set
+func scanAttachment(ctx context.Context, key string, att *mail.Attachment) (bool, error) {
+	if scanner == nil {
+		return false, nil
+	}
+	sctx, span := tracing.Start(ctx, "scan.attachment")
+	v, err := scanner.Scan(sctx, att.Name, att.Buf.Bytes())
+	span.SetAttributes(attribute.String("threat", v.Threat))
+	tracing.End(span, err)
+	if err != nil {
+		logging.From(ctx).Error("err scanning attachment", "op", "scan", "attachment", att.Name, "err", err)
+		att.Error = err
+		return false, err
+	}
+	if !v.Infected() {
+		return false, nil
+	}
+
+	return true, quarantine(ctx, key, att, v)
+}
+
+// Stores an infected attachment under the quarantine prefix only and sets Attachment.Threat
+func quarantine(ctx context.Context, key string, att *mail.Attachment, v scan.Verdict) error {
+	logging.From(ctx).Warn("attachment quarantined", "op", "scan", "attachment", att.Name, "threat", v.Threat, "scanner", v.Scanner)
+	metrics.AttachmentsQuarantined.WithLabelValues(v.Scanner).Inc()
+	att.Threat = v.Threat
+	if _, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", quarantinePrefix, key), bytes.NewReader(att.Buf.Bytes())); err != nil {
+		logging.From(ctx).Error("err quarantining attachment", "op", "scan", "attachment", att.Name, "err", err)
+		att.Error = err
+		return err
+	}
+	return nil
+}
+
+// Sanitizes the html body of every message and uploads it next to the attachments
+// cid: references are rewritten to the uploaded attachment urls
+// Sets Message.BodyUrl, or Message.BodyError on failure
+func uploadBodies(ctx context.Context, u *mail.Mail, msgs []mail.Message) {
+	ctx, span := tracing.Start(ctx, "upload.bodies", attribute.Int("messages", len(msgs)))
+	g := uploads.Group(u.User)
+	for i := range msgs {
+		if msgs[i].BodyHtml == "" {
+			continue
+		}
+		msg := &msgs[i]
+		g.Go(func() error {
+			cids := make(map[string]string)
+			for _, atts := range [][]mail.Attachment{msg.Inline, msg.Attachment} {
+				for _, att := range atts {
+					if att.ContentId != "" && att.Url != "" {
+						cids[att.ContentId] = att.Url
+					}
 				}
-				msg.Attachment[i].Url = url
-			}()
+			}
+
+			body := mail.Sanitize(msg.BodyHtml, cids)
+			url, err := awss3.UploadFileType(ctx, fmt.Sprintf("%s/%s.html", u.User, msg.Id), "text/html; charset=utf-8", strings.NewReader(body))
+			if err != nil {
+				logging.From(ctx).Error("err uploading body", "op", "upload", "message", msg.Id, "err", err)
+				msg.BodyError = err
+				return err
+			}
+			msg.BodyUrl = url
+			return nil
+		})
+	}
+
+	g.Wait()
+	span.End()
+}
+
+// Extracts the text of all supported attachments into Attachment.Text
+// Including the attachments of embedded messages
+func extractTexts(ctx context.Context, msgs []mail.Message) {
+	for m := range msgs {
+		msg := &msgs[m]
+		extractTexts(ctx, msg.Embedded)
+		for i := range msg.Attachment {
+			att := &msg.Attachment[i]
+			if !extract.Supported(att.Name, att.Type) {
+				continue
+			}
+			text, err := extract.Text(att.Name, att.Type, att.Buf.Bytes())
+			if err != nil {
+				logging.From(ctx).Warn("err extracting text", "op", "extract", "attachment", att.Name, "err", err)
+				continue
+			}
+			att.Text = text
 		}
 	}
+}
+
+// Returns the progress of the user uploads, 404 once they all finished
+func uploadProgress(w http.ResponseWriter, r *http.Request) {
+	pr, ok := uploads.Progress(r.PathValue("user"))
+	if !ok {
+		send(w, response{Status: http.StatusNotFound, Message: "No uploads"})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: pr})
+}
+
+// Liveness, the server is up
+func healthz(w http.ResponseWriter, r *http.Request) {
+	send(w, response{Status: http.StatusOK, Message: "ok"})
+}
+
+// Readiness, the storage bucket, and clamd when set, are reachable
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := awss3.Ping(ctx); err != nil {
+		send(w, response{Status: http.StatusServiceUnavailable, Message: err.Error()})
+		return
+	}
+	if clamd != nil {
+		if err := clamd.Ping(ctx); err != nil {
+			send(w, response{Status: http.StatusServiceUnavailable, Message: fmt.Sprintf("clamd unreachable. err: %s", err.Error())})
+			return
+		}
+	}
+	send(w, response{Status: http.StatusOK, Message: "ok"})
+}
+
+// Reads an integer environment variable, def if unset
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fatal("invalid "+name, err)
+	}
+	return n
+}
+
+// Returns the request context carrying a logger with the request id and the hashed account
+// The id is read from X-Request-Id, or generated, and echoed back in the response
+func requestContext(w http.ResponseWriter, r *http.Request, user string) context.Context {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" || len(id) > 64 {
+		id = logging.NewId()
+	}
+	w.Header().Set("X-Request-Id", id)
+	return logging.With(r.Context(), "request_id", id, "account", logging.Account(user))
+}
 
-	wg.Wait()
+// Logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
 // Helper function that sends the response back to client
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tars47/go-read-mail/awss3/awss3test"
+	"github.com/tars47/go-read-mail/mail/mailtest"
+	"github.com/xuri/excelize/v2"
+)
+
+// Key of the test account excel file
+var excelKey = fmt.Sprintf("%s/%s", mailtest.User, DefaultExcel)
+
+// Posts a sync of the test account to readMail
+func postSync(t *testing.T, s *mailtest.Server) response {
+	t.Helper()
+	return postSyncWith(t, s, nil)
+}
+
+// Posts a sync of the test account with optional request fields, eg: expand
+func postSyncWith(t *testing.T, s *mailtest.Server, opts map[string]interface{}) response {
+	t.Helper()
+	req := map[string]interface{}{"addr": s.Addr, "user": mailtest.User, "pass": mailtest.Pass}
+	for k, v := range opts {
+		req[k] = v
+	}
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	readMail(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+
+	var res response
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("unable to read response. err: %v", err)
+	}
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, message: %v", w.Code, res.Message)
+	}
+	return res
+}
+
+// A row of the exported excel file
+type row struct {
+	cells map[string]string
+	// Attachment names and their links
+	attachments []string
+	links       []string
+	// Link of the Body cell
+	body string
+}
+
+// Reads the rows of the first sheet of the exported excel file
+func readRows(t *testing.T, b *awss3test.Bucket) []row {
+	t.Helper()
+	o, ok := b.Object(excelKey)
+	if !ok {
+		t.Fatalf("%v not uploaded", excelKey)
+	}
+	f, err := excelize.OpenReader(bytes.NewReader(o.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sheet := f.GetSheetName(0)
+	all, err := f.GetRows(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols := all[0]
+	var rows []row
+	for i, vals := range all[1:] {
+		r := row{cells: make(map[string]string)}
+		for j, v := range vals {
+			cell, _ := excelize.CoordinatesToCellName(j+1, i+2)
+			_, link, _ := f.GetCellHyperLink(sheet, cell)
+			switch {
+			case j >= len(cols)-1:
+				r.attachments = append(r.attachments, v)
+				r.links = append(r.links, link)
+			case cols[j] == "Body":
+				r.body = link
+			default:
+				r.cells[cols[j]] = v
+			}
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// Returns the Subject column of the rows
+func rowSubjects(rows []row) string {
+	s := make([]string, len(rows))
+	for i, r := range rows {
+		s[i] = r.cells["Subject"]
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestReadMailCreate(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t,
+		mailtest.Fixture(t, "plain.eml"),
+		mailtest.Fixture(t, "attachment.eml"),
+		mailtest.Fixture(t, "inline.eml"),
+	)
+
+	res := postSyncWith(t, s, map[string]interface{}{"auth": true})
+	if res.ExcelUrl != awss3test.Link(excelKey) {
+		t.Errorf("excelUrl = %v, want %v", res.ExcelUrl, awss3test.Link(excelKey))
+	}
+	if len(res.Failed) != 0 {
+		t.Errorf("failed = %+v", res.Failed)
+	}
+
+	rows := readRows(t, b)
+	if got, want := rowSubjects(rows), "Newsletter, Monthly report, Plain text"; got != want {
+		t.Fatalf("subjects = %v, want %v", got, want)
+	}
+	// Signatures are checked once fetched, the fixtures are not signed
+	if got := rows[2].cells["DKIM"]; got != "none" {
+		t.Errorf("DKIM = %q, want none", got)
+	}
+	if _, ok := b.Object(mailtest.User + "/" + DefaultState); !ok {
+		t.Error("sync state not saved")
+	}
+}
+
+func TestReadMailUpdate(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t,
+		mailtest.Fixture(t, "plain.eml"),
+		mailtest.Fixture(t, "attachment.eml"),
+	)
+	postSync(t, s)
+
+	s.Append(mailtest.Fixture(t, "update.eml"))
+	postSync(t, s)
+	rows := readRows(t, b)
+	if got, want := rowSubjects(rows), "Meeting notes, Monthly report, Plain text"; got != want {
+		t.Fatalf("subjects = %v, want %v", got, want)
+	}
+
+	// Nothing new, rows are not duplicated
+	postSync(t, s)
+	if got := len(readRows(t, b)); got != 3 {
+		t.Errorf("rows = %d, want 3", got)
+	}
+}
+
+// A message received after the sync within the same second as the last exported one
+func TestReadMailSameSecond(t *testing.T) {
+	b := awss3test.Use(t)
+	at := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	s := mailtest.NewServer(t, mailtest.Message("m1", at, "First"))
+	postSync(t, s)
+
+	s.Append(mailtest.Message("m2", at, "Second"))
+	postSync(t, s)
+	if got := len(readRows(t, b)); got != 2 {
+		t.Fatalf("rows = %d, want 2", got)
+	}
+
+	// Both exported messages are known, rows are not duplicated
+	postSync(t, s)
+	if got := len(readRows(t, b)); got != 2 {
+		t.Errorf("rows = %d, want 2", got)
+	}
+}
+
+func TestReadMailAttachmentUrls(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t,
+		mailtest.Fixture(t, "attachment.eml"),
+		mailtest.Fixture(t, "inline.eml"),
+	)
+	postSyncWith(t, s, map[string]interface{}{"body": true})
+	rows := readRows(t, b)
+
+	// Attachment cells link to the uploaded attachment
+	key := mailtest.User + "/<attachment@example.org>/report.csv"
+	att := rows[1]
+	if len(att.attachments) != 1 || att.attachments[0] != "report.csv" || att.links[0] != awss3test.Link(key) {
+		t.Fatalf("attachments = %q, links = %q", att.attachments, att.links)
+	}
+	o, ok := b.Object(key)
+	if !ok || string(o.Data) != "name,amount\nalice,10\nbob,20\n" {
+		t.Errorf("%v = %q", key, o.Data)
+	}
+	if _, ok := b.Object(key + ".txt"); !ok {
+		t.Errorf("extracted text of %v not uploaded", key)
+	}
+
+	// The html body links the uploaded inline image
+	bodyKey := mailtest.User + "/<inline@example.org>.html"
+	if rows[0].body != awss3test.Link(bodyKey) {
+		t.Errorf("body link = %v, want %v", rows[0].body, awss3test.Link(bodyKey))
+	}
+	body, ok := b.Object(bodyKey)
+	if !ok {
+		t.Fatalf("%v not uploaded", bodyKey)
+	}
+	logo := awss3test.Link(mailtest.User + "/<inline@example.org>/inline/logo.png")
+	if !strings.Contains(string(body.Data), logo) {
+		t.Errorf("body does not link %v: %s", logo, body.Data)
+	}
+	if body.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("body content type = %v", body.ContentType)
+	}
+}
+
+func TestReadMailFailedUpload(t *testing.T) {
+	b := awss3test.Use(t)
+	b.Fail = func(op, key string) error {
+		if op == "put" && strings.HasSuffix(key, "/report.csv") {
+			return errors.New("access denied")
+		}
+		return nil
+	}
+	s := mailtest.NewServer(t, mailtest.Fixture(t, "attachment.eml"))
+
+	res := postSync(t, s)
+	if len(res.Failed) != 1 || res.Failed[0].Name != "report.csv" || res.Failed[0].Message != "<attachment@example.org>" {
+		t.Fatalf("failed = %+v", res.Failed)
+	}
+	rows := readRows(t, b)
+	if got := rows[0].attachments; len(got) != 1 || got[0] != "report.csv (upload failed)" || rows[0].links[0] != "" {
+		t.Errorf("attachments = %q, links = %q", got, rows[0].links)
+	}
+}
+
+func TestReadMailExpandArchives(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t, mailtest.Fixture(t, "archive.eml"))
+
+	res := postSyncWith(t, s, map[string]interface{}{"expand": true})
+	if len(res.Failed) != 0 || len(res.Unexpanded) != 0 {
+		t.Fatalf("failed = %+v, unexpanded = %+v", res.Failed, res.Unexpanded)
+	}
+
+	// The files of the archive are stored under its key and listed after it
+	prefix := mailtest.User + "/<archive@example.org>/invoices.zip"
+	rows := readRows(t, b)
+	want := []string{"invoices.zip", "invoices.zip/march.csv", "invoices.zip/april/april.csv"}
+	if got := rows[0].attachments; strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("attachments = %q, want %q", got, want)
+	}
+	for i, key := range []string{prefix, prefix + "/march.csv", prefix + "/april/april.csv"} {
+		if rows[0].links[i] != awss3test.Link(key) {
+			t.Errorf("link %d = %v, want %v", i, rows[0].links[i], awss3test.Link(key))
+		}
+	}
+	if o, ok := b.Object(prefix + "/march.csv"); !ok || string(o.Data) != "invoice,amount\n1001,250\n" {
+		t.Errorf("%v = %q", prefix+"/march.csv", o.Data)
+	}
+}
+
+func TestReadMailArchivesNotExpanded(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t, mailtest.Fixture(t, "archive.eml"))
+
+	postSync(t, s)
+	if got := readRows(t, b)[0].attachments; len(got) != 1 || got[0] != "invoices.zip" {
+		t.Errorf("attachments = %q", got)
+	}
+}
+
+func TestReadMailAttachmentPolicy(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t, mailtest.Fixture(t, "attachment.eml"))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/users/"+mailtest.User+"/policy", strings.NewReader(`{"denyTypes":["TEXT/CSV"]}`))
+	r.SetPathValue("user", mailtest.User)
+	putPolicy(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %v", w.Code, w.Body)
+	}
+
+	// Filtered attachments are listed without a link and not stored
+	res := postSync(t, s)
+	if len(res.Failed) != 0 {
+		t.Fatalf("failed = %+v", res.Failed)
+	}
+	rows := readRows(t, b)
+	if got := rows[0].attachments; len(got) != 1 || got[0] != "report.csv (not uploaded: type text/csv denied)" || rows[0].links[0] != "" {
+		t.Errorf("attachments = %q, links = %q", got, rows[0].links)
+	}
+	if _, ok := b.Object(mailtest.User + "/<attachment@example.org>/report.csv"); ok {
+		t.Error("filtered attachment was uploaded")
+	}
+}
+
+func TestReadMailInlinePolicy(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t, mailtest.Fixture(t, "inline.eml"))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/users/"+mailtest.User+"/policy", strings.NewReader(`{"denyTypes":["image/png"]}`))
+	r.SetPathValue("user", mailtest.User)
+	putPolicy(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %v", w.Code, w.Body)
+	}
+
+	// Filtered inline parts are not stored and the body does not reference them
+	postSyncWith(t, s, map[string]interface{}{"body": true})
+	logo := mailtest.User + "/<inline@example.org>/inline/logo.png"
+	if _, ok := b.Object(logo); ok {
+		t.Error("filtered inline part was uploaded")
+	}
+	body, ok := b.Object(mailtest.User + "/<inline@example.org>.html")
+	if !ok {
+		t.Fatal("body not uploaded")
+	}
+	if strings.Contains(string(body.Data), "<img") || strings.Contains(string(body.Data), "cid:") {
+		t.Errorf("body references the filtered inline part: %s", body.Data)
+	}
+}
+
+func TestReadMailQuarantine(t *testing.T) {
+	b := awss3test.Use(t)
+	s := mailtest.NewServer(t, mailtest.Fixture(t, "infected.eml"))
+
+	res := postSync(t, s)
+	if len(res.Quarantined) != 1 || res.Quarantined[0].Name != "invoice.pdf.exe" || res.Quarantined[0].Threat != "Heuristic.DoubleExtension" {
+		t.Fatalf("quarantined = %+v", res.Quarantined)
+	}
+
+	// Infected attachments get no link and are stored under the quarantine prefix only
+	key := mailtest.User + "/<infected@example.org>/invoice.pdf.exe"
+	rows := readRows(t, b)
+	want := []string{"invoice.pdf.exe (infected: Heuristic.DoubleExtension, quarantined)", "notes.txt"}
+	if got := rows[0].attachments; strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("attachments = %q, want %q", got, want)
+	}
+	if rows[0].links[0] != "" || rows[0].links[1] == "" {
+		t.Errorf("links = %q", rows[0].links)
+	}
+	if _, ok := b.Object(key); ok {
+		t.Error("infected attachment was stored")
+	}
+	if o, ok := b.Object(DefaultQuarantine + "/" + key); !ok || !bytes.HasPrefix(o.Data, []byte("MZ")) {
+		t.Errorf("%v not quarantined", key)
+	}
+}
+
+func TestReadMailQuarantineArchive(t *testing.T) {
+	key := mailtest.User + "/<infected-archive@example.org>/invoices.zip"
+	tests := []struct {
+		name        string
+		expand      bool
+		quarantined int
+		want        []string
+	}{
+		// The archive is quarantined for the executable it holds, its clean files are still linked
+		{"expanded", true, 2, []string{
+			"invoices.zip (infected: Heuristic.Executable in setup.exe, quarantined)",
+			"invoices.zip/march.csv",
+			"invoices.zip/setup.exe (infected: Heuristic.Executable, quarantined)",
+		}},
+		// The names of the zip entries are checked without expanding it
+		{"not expanded", false, 1, []string{"invoices.zip (infected: Heuristic.Executable, quarantined)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := awss3test.Use(t)
+			s := mailtest.NewServer(t, mailtest.Fixture(t, "infected_archive.eml"))
+
+			res := postSyncWith(t, s, map[string]interface{}{"expand": tt.expand})
+			if len(res.Failed) != 0 || len(res.Quarantined) != tt.quarantined {
+				t.Fatalf("failed = %+v, quarantined = %+v", res.Failed, res.Quarantined)
+			}
+			rows := readRows(t, b)
+			if got := rows[0].attachments; strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Fatalf("attachments = %q, want %q", got, tt.want)
+			}
+			if rows[0].links[0] != "" {
+				t.Errorf("infected archive is linked: %v", rows[0].links[0])
+			}
+			if _, ok := b.Object(key); ok {
+				t.Error("infected archive was stored")
+			}
+			if _, ok := b.Object(DefaultQuarantine + "/" + key); !ok {
+				t.Errorf("%v not quarantined", key)
+			}
+			if tt.expand {
+				if _, ok := b.Object(key + "/march.csv"); !ok || rows[0].links[1] == "" {
+					t.Error("clean file of the archive not uploaded")
+				}
+				if _, ok := b.Object(key + "/setup.exe"); ok {
+					t.Error("infected file of the archive was stored")
+				}
+			}
+		})
+	}
+}
+
+// Requests a token for the test account through the imap server at addr
+func postToken(t *testing.T, addr, pass string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"addr": addr, "pass": pass})
+	r := httptest.NewRequest(http.MethodPost, "/users/"+mailtest.User+"/token", bytes.NewReader(body))
+	r.SetPathValue("user", mailtest.User)
+	w := httptest.NewRecorder()
+	createToken(w, r)
+	return w
+}
+
+func TestAuthorized(t *testing.T) {
+	awss3test.Use(t)
+	s := mailtest.NewServer(t)
+
+	if w := postToken(t, s.Addr, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status = %d", w.Code)
+	}
+	w := postToken(t, s.Addr, mailtest.Pass)
+	var res struct{ Data tokenResponse }
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, err: %v", w.Code, err)
+	}
+	// The first imap server is pinned
+	if w := postToken(t, mailtest.NewServer(t).Addr, mailtest.Pass); w.Code != http.StatusForbidden {
+		t.Errorf("other server: status = %d", w.Code)
+	}
+
+	list := authorized(listRules)
+	for _, tt := range []struct {
+		name   string
+		user   string
+		header string
+		status int
+	}{
+		{"token of the user", mailtest.User, "Bearer " + res.Data.Token, http.StatusOK},
+		{"token of another user", "other@example.org", "Bearer " + res.Data.Token, http.StatusUnauthorized},
+		{"no token", mailtest.User, "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/users/"+tt.user+"/rules", nil)
+		r.SetPathValue("user", tt.user)
+		r.Header.Set("Authorization", tt.header)
+		w := httptest.NewRecorder()
+		list(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%v: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+// Pins the imap server of the test account to s and returns a token of the user
+func pin(t *testing.T, s *mailtest.Server) string {
+	t.Helper()
+	w := postToken(t, s.Addr, mailtest.Pass)
+	var res struct{ Data tokenResponse }
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, err: %v", w.Code, err)
+	}
+	return res.Data.Token
+}
+
+// Posts a dry run of the saved rules through the imap server at addr
+func postDryRun(t *testing.T, addr, header string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"addr": addr, "user": mailtest.User, "pass": mailtest.Pass})
+	r := httptest.NewRequest(http.MethodPost, "/rules/dry-run", bytes.NewReader(body))
+	r.Header.Set("Authorization", header)
+	w := httptest.NewRecorder()
+	dryRunRules(w, r)
+	return w
+}
+
+func TestDryRunOwner(t *testing.T) {
+	awss3test.Use(t)
+	token := pin(t, mailtest.NewServer(t))
+	// Another imap server accepting the same credentials
+	other := mailtest.NewServer(t, mailtest.Fixture(t, "plain.eml"))
+
+	if w := postDryRun(t, other.Addr, ""); w.Code != http.StatusForbidden {
+		t.Errorf("other server: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := postDryRun(t, other.Addr, "Bearer "+token); w.Code != http.StatusOK {
+		t.Errorf("other server with the user token: status = %d, body: %v", w.Code, w.Body)
+	}
+}
+
+// A sync through another imap server than the pinned one would overwrite the user files
+// and fire the user webhooks with forged messages
+func TestReadMailOwner(t *testing.T) {
+	b := awss3test.Use(t)
+	token := pin(t, mailtest.NewServer(t))
+	other := mailtest.NewServer(t, mailtest.Fixture(t, "plain.eml"))
+
+	body, _ := json.Marshal(map[string]string{"addr": other.Addr, "user": mailtest.User, "pass": mailtest.Pass})
+	post := func(header string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		readMail(w, r)
+		return w.Code
+	}
+
+	if code := post(""); code != http.StatusForbidden {
+		t.Fatalf("other server: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if _, ok := b.Object(excelKey); ok {
+		t.Fatal("excel file written by a sync through another server")
+	}
+	if code := post("Bearer " + token); code != http.StatusCreated {
+		t.Errorf("other server with the user token: status = %d", code)
+	}
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prefix of every metric
+const namespace = "readmail"
+
+var (
+	// Duration of imap operations by server host and operation: login, fetch
+	ImapDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "imap_duration_seconds",
+		Help:      "Duration of imap logins and fetches by server host.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"host", "op"})
+
+	// Failed imap operations by server host and operation, after retries
+	ImapErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imap_errors_total",
+		Help:      "Failed imap logins and fetches by server host.",
+	}, []string{"host", "op"})
+
+	// Messages fetched by server host
+	MessagesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_fetched_total",
+		Help:      "Messages fetched by server host.",
+	}, []string{"host"})
+
+	// Bytes fetched by server host, the RFC822.SIZE of the messages
+	BytesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_fetched_total",
+		Help:      "Size of the messages fetched by server host.",
+	}, []string{"host"})
+
+	// Attachments and inline parts uploaded to storage
+	AttachmentsUploaded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attachments_uploaded_total",
+		Help:      "Attachments uploaded to storage.",
+	})
+
+	// Attachments not uploaded as the same content is already stored under their key
+	AttachmentsDeduped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attachments_deduped_total",
+		Help:      "Attachments skipped as already stored.",
+	})
+
+	// Attachments not uploaded as the user attachment policy filtered them out
+	AttachmentsFiltered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attachments_filtered_total",
+		Help:      "Attachments skipped by the attachment policy.",
+	})
+
+	// Attachments a scanner found infected, stored under the quarantine prefix
+	AttachmentsQuarantined = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attachments_quarantined_total",
+		Help:      "Attachments found infected and quarantined.",
+	}, []string{"scanner"})
+
+	// Duration of excel builds by mode: new, update, large
+	ExcelDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "excel_build_duration_seconds",
+		Help:      "Duration of excel builds by mode.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"mode"})
+
+	// Rows written by excel builds by mode
+	ExcelRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "excel_rows_total",
+		Help:      "Rows written by excel builds by mode.",
+	}, []string{"mode"})
+
+	// Duration of storage operations: upload, download, head, link
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_duration_seconds",
+		Help:      "Duration of storage operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	// Failed storage operations, after retries, missing objects are not counted
+	StorageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Failed storage operations.",
+	}, []string{"op"})
+
+	// Jobs running by kind: sync, upload
+	ActiveJobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_jobs",
+		Help:      "Jobs running by kind.",
+	}, []string{"kind"})
+)
+
+// Returns the handler serving the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Returns the host of an imap address, used as the host label
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Records the duration of an imap operation, and its failure
+func ObserveImap(addr, op string, start time.Time, err error) {
+	host := Host(addr)
+	ImapDuration.WithLabelValues(host, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		ImapErrors.WithLabelValues(host, op).Inc()
+	}
+}
+
+// Records the duration of a storage operation, and its failure
+func ObserveStorage(op string, start time.Time, err error) {
+	StorageDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StorageErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// Records the duration and the rows of an excel build
+func ObserveExcel(mode string, start time.Time, rows int) {
+	ExcelDuration.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+	ExcelRows.WithLabelValues(mode).Add(float64(rows))
+}
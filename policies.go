@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/tars47/go-read-mail/policy"
+)
+
+// Serializes policy changes
+var policyMu sync.Mutex
+
+// Returns the user attachment policy, empty if none is set
+func getPolicy(w http.ResponseWriter, r *http.Request) {
+	p, err := policy.Load(r.Context(), r.PathValue("user"))
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: p})
+}
+
+// Replaces the user attachment policy
+func putPolicy(w http.ResponseWriter, r *http.Request) {
+	var p policy.Policy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+	if err := p.Validate(); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	if err := policy.Save(r.Context(), r.PathValue("user"), p); err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: p})
+}
+
+// Removes the user attachment policy, every attachment is uploaded again
+func deletePolicy(w http.ResponseWriter, r *http.Request) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	if err := policy.Save(r.Context(), r.PathValue("user"), policy.Policy{}); err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success"})
+}
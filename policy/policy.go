@@ -0,0 +1,108 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// Attachment policy of an account, attachments it filters out are listed but not uploaded
+// Deny lists win over allow lists, empty allow lists allow everything
+type Policy struct {
+	// Content types eg: "application/pdf", or every subtype eg: "image/*"
+	AllowTypes []string `json:"allowTypes,omitempty"`
+	DenyTypes  []string `json:"denyTypes,omitempty"`
+	// File extensions eg: ".pdf"
+	AllowExtensions []string `json:"allowExtensions,omitempty"`
+	DenyExtensions  []string `json:"denyExtensions,omitempty"`
+	// Size bounds in bytes, 0 for no bound
+	MinSize int64 `json:"minSize,omitempty"`
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
+// Checks the policy and normalizes its lists to lower case, extensions with a leading dot
+func (p *Policy) Validate() error {
+	for _, list := range [][]string{p.AllowTypes, p.DenyTypes} {
+		for i, t := range list {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if typ, sub, ok := strings.Cut(t, "/"); !ok || typ == "" || sub == "" || strings.Contains(sub, "/") {
+				return fmt.Errorf("invalid content type %q", list[i])
+			}
+			list[i] = t
+		}
+	}
+	for _, list := range [][]string{p.AllowExtensions, p.DenyExtensions} {
+		for i, e := range list {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e == "" || e == "." || strings.Contains(e, "/") {
+				return fmt.Errorf("invalid extension %q", list[i])
+			}
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			list[i] = e
+		}
+	}
+	if p.MinSize < 0 || p.MaxSize < 0 {
+		return errors.New("sizes must not be negative")
+	}
+	if p.MaxSize > 0 && p.MinSize > p.MaxSize {
+		return errors.New("minSize is larger than maxSize")
+	}
+	return nil
+}
+
+// Returns true if the policy lets every attachment through
+func (p *Policy) Empty() bool {
+	return len(p.AllowTypes) == 0 && len(p.DenyTypes) == 0 && len(p.AllowExtensions) == 0 &&
+		len(p.DenyExtensions) == 0 && p.MinSize == 0 && p.MaxSize == 0
+}
+
+// Returns why the policy filters out the attachment, empty if it is uploaded
+// att.Type is expected to be sniffed already, see Sniff
+func (p *Policy) Check(att *mail.Attachment) string {
+	ctype := strings.ToLower(att.Type)
+	ext := strings.ToLower(path.Ext(att.Name))
+	size := int64(att.Buf.Len())
+
+	switch {
+	case matchType(p.DenyTypes, ctype):
+		return fmt.Sprintf("type %s denied", ctype)
+	case ext != "" && contains(p.DenyExtensions, ext):
+		return fmt.Sprintf("extension %s denied", ext)
+	case len(p.AllowTypes) > 0 && !matchType(p.AllowTypes, ctype):
+		return fmt.Sprintf("type %s not allowed", ctype)
+	case len(p.AllowExtensions) > 0 && !contains(p.AllowExtensions, ext):
+		if ext == "" {
+			return "no extension, not allowed"
+		}
+		return fmt.Sprintf("extension %s not allowed", ext)
+	case p.MinSize > 0 && size < p.MinSize:
+		return fmt.Sprintf("smaller than %d bytes", p.MinSize)
+	case p.MaxSize > 0 && size > p.MaxSize:
+		return fmt.Sprintf("larger than %d bytes", p.MaxSize)
+	}
+	return ""
+}
+
+// Returns true if ctype matches a pattern of the list, eg: image/* matches image/png
+func matchType(patterns []string, ctype string) bool {
+	for _, p := range patterns {
+		if p == ctype || strings.HasSuffix(p, "/*") && strings.HasPrefix(ctype, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
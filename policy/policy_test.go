@@ -0,0 +1,117 @@
+package policy
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tars47/go-read-mail/mail"
+)
+
+func zipFile(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "mimetype" {
+			w.Write([]byte("application/vnd.oasis.opendocument.text"))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	p := Policy{DenyTypes: []string{" Image/PNG "}, AllowExtensions: []string{"PDF", ".csv"}}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if p.DenyTypes[0] != "image/png" || p.AllowExtensions[0] != ".pdf" || p.AllowExtensions[1] != ".csv" {
+		t.Errorf("policy = %+v", p)
+	}
+
+	for _, bad := range []Policy{
+		{AllowTypes: []string{"image"}},
+		{DenyTypes: []string{"image/png/x"}},
+		{DenyExtensions: []string{"."}},
+		{MinSize: -1},
+		{MinSize: 10, MaxSize: 5},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil", bad)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		file   string
+		ctype  string
+		size   int
+		want   string
+	}{
+		{name: "empty policy", file: "a.mp4", ctype: "video/mp4", size: 10},
+		{name: "denied type", policy: Policy{DenyTypes: []string{"video/*"}}, file: "a.mp4", ctype: "video/mp4", want: "type video/mp4 denied"},
+		{name: "denied extension", policy: Policy{DenyExtensions: []string{".exe"}}, file: "setup.EXE", ctype: "application/x-msdownload", want: "extension .exe denied"},
+		{name: "allowed type", policy: Policy{AllowTypes: []string{"application/pdf"}}, file: "a.pdf", ctype: "application/pdf"},
+		{name: "type not allowed", policy: Policy{AllowTypes: []string{"application/pdf"}}, file: "a.png", ctype: "image/png", want: "type image/png not allowed"},
+		{name: "extension not allowed", policy: Policy{AllowExtensions: []string{".pdf"}}, file: "a.mov", ctype: "video/quicktime", want: "extension .mov not allowed"},
+		{name: "no extension", policy: Policy{AllowExtensions: []string{".pdf"}}, file: "README", ctype: "text/plain", want: "no extension, not allowed"},
+		{name: "deny wins", policy: Policy{AllowTypes: []string{"image/*"}, DenyTypes: []string{"image/gif"}}, file: "a.gif", ctype: "image/gif", want: "type image/gif denied"},
+		{name: "too small", policy: Policy{MinSize: 100}, file: "logo.png", ctype: "image/png", size: 99, want: "smaller than 100 bytes"},
+		{name: "too large", policy: Policy{MaxSize: 100}, file: "a.pdf", ctype: "application/pdf", size: 101, want: "larger than 100 bytes"},
+		{name: "within bounds", policy: Policy{MinSize: 1, MaxSize: 100}, file: "a.pdf", ctype: "application/pdf", size: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			att := &mail.Attachment{Name: tt.file, Type: tt.ctype}
+			att.Buf.WriteString(strings.Repeat("x", tt.size))
+			if got := tt.policy.Check(att); got != tt.want {
+				t.Errorf("Check = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		declared string
+		data     []byte
+		want     string
+	}{
+		{name: "png declared as pdf", file: "logo.pdf", declared: "application/pdf", data: []byte("\x89PNG\r\n\x1a\n0000"), want: "image/png"},
+		{name: "executable declared as pdf", file: "invoice.pdf", declared: "application/pdf", data: []byte("MZ\x90\x00"), want: "application/x-msdownload"},
+		{name: "csv keeps its type", file: "report.csv", declared: "text/csv; charset=utf-8", data: []byte("a,b\n1,2\n"), want: "text/csv"},
+		{name: "text declared as image", file: "a.png", declared: "image/png", data: []byte("hello"), want: "text/plain"},
+		{name: "unknown bytes use the extension", file: "a.pdf", declared: "application/octet-stream", data: []byte{0, 1, 2, 3}, want: "application/pdf"},
+		{name: "legacy word document", file: "a.doc", data: []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), want: "application/msword"},
+		{name: "docx", file: "a.docx", declared: "application/zip", data: zipFile(t, "[Content_Types].xml", "word/document.xml"), want: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{name: "macro enabled workbook", file: "a.xlsx", data: zipFile(t, "xl/workbook.xml", "xl/vbaProject.bin"), want: "application/vnd.ms-excel.sheet.macroenabled.12"},
+		{name: "opendocument", file: "a.odt", data: zipFile(t, "mimetype", "content.xml"), want: "application/vnd.oasis.opendocument.text"},
+		{name: "jar", file: "a.zip", data: zipFile(t, "META-INF/MANIFEST.MF"), want: "application/java-archive"},
+		{name: "zip", file: "a.zip", data: zipFile(t, "a.txt"), want: "application/zip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sniff(tt.file, tt.declared, tt.data); got != tt.want {
+				t.Errorf("Sniff = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
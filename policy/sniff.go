@@ -0,0 +1,134 @@
+package policy
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Content types of executables, not detected by http.DetectContentType
+var executables = []struct {
+	magic string
+	ctype string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+}
+
+// Signature of OLE2 compound files, used by legacy Office documents and Outlook .msg files
+const ole2 = "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"
+
+// Legacy Office content types by extension
+var oleTypes = map[string]string{
+	".doc": "application/msword",
+	".dot": "application/msword",
+	".xls": "application/vnd.ms-excel",
+	".xlt": "application/vnd.ms-excel",
+	".ppt": "application/vnd.ms-powerpoint",
+	".pps": "application/vnd.ms-powerpoint",
+	".msg": "application/vnd.ms-outlook",
+}
+
+// Office Open XML content types by folder of the main part, without and with macros
+var ooxmlTypes = map[string][2]string{
+	"word/": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/vnd.ms-word.document.macroenabled.12"},
+	"xl/":   {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/vnd.ms-excel.sheet.macroenabled.12"},
+	"ppt/":  {"application/vnd.openxmlformats-officedocument.presentationml.presentation", "application/vnd.ms-powerpoint.presentation.macroenabled.12"},
+}
+
+// Returns the content type of an attachment read from its bytes
+// The declared type, or the one of the extension, is kept when the bytes only tell
+// it is some binary or text file, eg: text/csv is not turned into text/plain
+func Sniff(name, declared string, b []byte) string {
+	declared = baseType(declared)
+	if declared == "" || declared == "application/octet-stream" {
+		declared = baseType(mime.TypeByExtension(strings.ToLower(path.Ext(name))))
+	}
+
+	for _, e := range executables {
+		if bytes.HasPrefix(b, []byte(e.magic)) {
+			return e.ctype
+		}
+	}
+	if bytes.HasPrefix(b, []byte(ole2)) {
+		if t, ok := oleTypes[strings.ToLower(path.Ext(name))]; ok {
+			return t
+		}
+		return "application/x-ole-storage"
+	}
+
+	sniffed := baseType(http.DetectContentType(b))
+	switch {
+	case sniffed == "application/zip":
+		return zipType(b)
+	case sniffed == "application/octet-stream" && declared != "":
+		return declared
+	case sniffed == "text/plain" && (strings.HasPrefix(declared, "text/") || isTextApp(declared)):
+		return declared
+	case sniffed == "text/xml" && (strings.HasSuffix(declared, "+xml") || strings.HasSuffix(declared, "/xml")):
+		return declared
+	}
+	return sniffed
+}
+
+// Returns the content type of a zip file, telling apart Office documents, OpenDocument files and jars
+func zipType(b []byte) string {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "application/zip"
+	}
+
+	ooxml, macros := "", false
+	for _, f := range zr.File {
+		switch {
+		case f.Name == "mimetype":
+			// OpenDocument files start with their content type
+			if rc, err := f.Open(); err == nil {
+				t, _ := io.ReadAll(io.LimitReader(rc, 100))
+				rc.Close()
+				if s := strings.TrimSpace(string(t)); strings.HasPrefix(s, "application/") {
+					return s
+				}
+			}
+		case f.Name == "META-INF/MANIFEST.MF":
+			return "application/java-archive"
+		case strings.HasSuffix(f.Name, "vbaProject.bin"):
+			macros = true
+		}
+		for dir := range ooxmlTypes {
+			if strings.HasPrefix(f.Name, dir) {
+				ooxml = dir
+			}
+		}
+	}
+	if ooxml == "" {
+		return "application/zip"
+	}
+	if macros {
+		return ooxmlTypes[ooxml][1]
+	}
+	return ooxmlTypes[ooxml][0]
+}
+
+// Returns true for application types holding text, eg: application/json
+func isTextApp(ctype string) bool {
+	switch ctype {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh", "application/rtf":
+		return true
+	}
+	return strings.HasSuffix(ctype, "+json") || strings.HasSuffix(ctype, "+xml")
+}
+
+// Returns the content type without its parameters, in lower case
+func baseType(ctype string) string {
+	t, _, _ := strings.Cut(ctype, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
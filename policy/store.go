@@ -0,0 +1,47 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tars47/go-read-mail/awss3"
+)
+
+// Name of the policy file stored in the user folder
+const DefaultPolicy = "policy.json"
+
+// Loads the user attachment policy from s3
+// Returns an empty policy if the user has none
+func Load(ctx context.Context, user string) (Policy, error) {
+	var p Policy
+	buf, err := awss3.DownloadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultPolicy))
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return p, nil
+		}
+		return p, err
+	}
+
+	if err := json.NewDecoder(buf).Decode(&p); err != nil {
+		return p, fmt.Errorf("unable to read policy. err: %v", err)
+	}
+	if err := p.Validate(); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// Saves the user attachment policy to s3
+func Save(ctx context.Context, user string, p Policy) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if _, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultPolicy), bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("unable to save policy. err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package retry
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Class of an error, decides whether an operation is retried
+type Class int
+
+const (
+	// Permanent errors are not retried, eg: missing objects, bad requests
+	Permanent Class = iota
+	// Transient errors are retried, eg: timeouts, resets, throttling, 5xx
+	Transient
+	// Auth errors are not retried, eg: wrong password, denied access
+	Auth
+)
+
+func (c Class) String() string {
+	switch c {
+	case Transient:
+		return "transient"
+	case Auth:
+		return "auth"
+	}
+	return "permanent"
+}
+
+// An error with its class
+type Error struct {
+	Class Class
+	Err   error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Returns err with the given class, nil if err is nil
+// Used where the caller knows better than Classify, eg: a rejected LOGIN is an auth error
+func Mark(class Class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Class: class, Err: err}
+}
+
+// Retry policy of an operation
+type Policy struct {
+	// Maximum number of attempts
+	Attempts int
+	// Wait before the second attempt, doubled after every attempt
+	Base time.Duration
+	// Maximum wait between attempts
+	Max time.Duration
+	// Total time the attempts and waits may take, no new attempt starts once spent
+	Budget time.Duration
+}
+
+// Policies of the imap and s3 operations
+var (
+	// Dial and login
+	Connect = Policy{Attempts: 4, Base: time.Second, Max: 15 * time.Second, Budget: time.Minute}
+	// FETCH and other imap commands
+	Imap = Policy{Attempts: 3, Base: time.Second, Max: 10 * time.Second, Budget: 2 * time.Minute}
+	// s3 uploads and downloads
+	Storage = Policy{Attempts: 5, Base: 500 * time.Millisecond, Max: 10 * time.Second, Budget: time.Minute}
+	// Malware scans, eg: by clamd
+	Scan = Policy{Attempts: 3, Base: 500 * time.Millisecond, Max: 5 * time.Second, Budget: 2 * time.Minute}
+)
+
+// Runs f until it succeeds, fails with an error that is not transient,
+// the attempts or the budget of the policy run out, or ctx is done
+// op names the operation in logs
+// Returns the last error, classified
+func Do(ctx context.Context, op string, p Policy, f func() error) error {
+	start := time.Now()
+	var err error
+	for n := 1; ; n++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		class := Classify(err)
+		if class != Transient || n >= p.Attempts {
+			return Mark(class, err)
+		}
+
+		wait := backoff(p, n)
+		if p.Budget > 0 && time.Since(start)+wait > p.Budget {
+			return Mark(class, fmt.Errorf("%w (retry budget of %v spent)", err, p.Budget))
+		}
+		logging.From(ctx).Warn("retrying", "op", op, "attempt", n, "attempts", p.Attempts, "wait", wait.Round(time.Millisecond), "class", class.String(), "err", err)
+		tracing.Event(ctx, "retry",
+			attribute.String("op", logging.Scrub(op)),
+			attribute.Int("attempt", n),
+			attribute.Int64("wait_ms", wait.Milliseconds()),
+			attribute.String("error", logging.Scrub(err.Error())),
+		)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return Mark(class, fmt.Errorf("%w (%v)", err, ctx.Err()))
+		}
+	}
+}
+
+// Returns the wait after attempt n, Base * 2^(n-1) capped to Max, with full jitter over its upper half
+func backoff(p Policy, n int) time.Duration {
+	d := p.Base << (n - 1)
+	if d <= 0 || (p.Max > 0 && d > p.Max) {
+		d = p.Max
+	}
+	if half := int64(d) / 2; half > 0 {
+		r, _ := rand.Int(rand.Reader, big.NewInt(half))
+		d = time.Duration(half + r.Int64())
+	}
+	return d
+}
+
+// Returns the class of an error
+// Errors marked with Mark keep their class
+func Classify(err error) Class {
+	if err == nil {
+		return Permanent
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+
+	// s3 errors carry the http status and the error code
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) {
+		switch code := status.HTTPStatusCode(); {
+		case code == 401 || code == 403:
+			return Auth
+		case code == 408 || code == 429 || code >= 500:
+			return Transient
+		case code > 0:
+			return Permanent
+		}
+	}
+	var api interface{ ErrorCode() string }
+	if errors.As(err, &api) {
+		switch api.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout", "RequestTimeTooSkewed", "InternalError", "ServiceUnavailable":
+			return Transient
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken":
+			return Auth
+		}
+		return Permanent
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return Transient
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return Transient
+	}
+
+	// imap status responses only carry their text
+	msg := strings.ToLower(err.Error())
+	for _, s := range authText {
+		if strings.Contains(msg, s) {
+			return Auth
+		}
+	}
+	for _, s := range transientText {
+		if strings.Contains(msg, s) {
+			return Transient
+		}
+	}
+	return Permanent
+}
+
+// Texts of imap responses and errors that are worth retrying
+var transientText = []string{
+	"connection closed", "connection reset", "broken pipe", "timeout", "timed out",
+	"unavailable", "try again", "temporary", "too many simultaneous connections", "server busy", "throttl",
+}
+
+// Texts of imap responses rejecting the credentials
+var authText = []string{
+	"authenticationfailed", "authentication failed", "invalid credentials", "login failed",
+	"authorizationfailed", "web login required", "application-specific password required",
+}
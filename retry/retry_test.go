@@ -0,0 +1,134 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// s3 error with an http status, as returned by the aws sdk
+type statusError struct{ code int }
+
+func (e statusError) Error() string       { return fmt.Sprintf("http %d", e.code) }
+func (e statusError) HTTPStatusCode() int { return e.code }
+
+// s3 api error with its code, as returned by the aws sdk
+type codeError struct{ code string }
+
+func (e codeError) Error() string     { return e.code }
+func (e codeError) ErrorCode() string { return e.code }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Class
+	}{
+		{"nil", nil, Permanent},
+		{"marked", Mark(Auth, errors.New("timeout")), Auth},
+		{"marked and wrapped", fmt.Errorf("login: %w", Mark(Transient, errors.New("no"))), Transient},
+		{"s3 401", statusError{401}, Auth},
+		{"s3 403", statusError{403}, Auth},
+		{"s3 404", statusError{404}, Permanent},
+		{"s3 408", statusError{408}, Transient},
+		{"s3 429", statusError{429}, Transient},
+		{"s3 500", statusError{500}, Transient},
+		{"s3 503 wrapped", fmt.Errorf("upload: %w", statusError{503}), Transient},
+		{"s3 SlowDown", codeError{"SlowDown"}, Transient},
+		{"s3 RequestTimeout", codeError{"RequestTimeout"}, Transient},
+		{"s3 AccessDenied", codeError{"AccessDenied"}, Auth},
+		{"s3 ExpiredToken", codeError{"ExpiredToken"}, Auth},
+		{"s3 NoSuchKey", codeError{"NoSuchKey"}, Permanent},
+		{"deadline", context.DeadlineExceeded, Transient},
+		{"eof", fmt.Errorf("read: %w", io.EOF), Transient},
+		{"unexpected eof", io.ErrUnexpectedEOF, Transient},
+		{"reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, Transient},
+		{"refused", syscall.ECONNREFUSED, Transient},
+		{"net error", &net.DNSError{Err: "no such host", IsTemporary: true}, Transient},
+		{"imap auth", errors.New("[AUTHENTICATIONFAILED] Invalid credentials (Failure)"), Auth},
+		{"imap app password", errors.New("Application-specific password required"), Auth},
+		{"imap login failed", errors.New("LOGIN failed."), Auth},
+		{"imap throttled", errors.New("[THROTTLED] Account exceeded command or bandwidth limits"), Transient},
+		{"imap unavailable", errors.New("[UNAVAILABLE] Temporary server error, try again later"), Transient},
+		{"imap too many connections", errors.New("Too many simultaneous connections"), Transient},
+		{"imap closed", errors.New("imap: connection closed"), Transient},
+		{"imap bad", errors.New("Error in IMAP command FETCH: Invalid messageset"), Permanent},
+	}
+	for _, tt := range tests {
+		if got := Classify(tt.err); got != tt.want {
+			t.Errorf("%s: Classify(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	fast := Policy{Attempts: 3, Base: time.Millisecond, Max: 2 * time.Millisecond, Budget: time.Second}
+	transient := errors.New("connection reset by peer")
+
+	tests := []struct {
+		name   string
+		policy Policy
+		errs   []error
+		calls  int
+		want   Class
+		ok     bool
+		// Text expected in the error
+		text string
+	}{
+		{"success", fast, nil, 1, Permanent, true, ""},
+		{"transient then success", fast, []error{transient, transient}, 3, Permanent, true, ""},
+		{"attempts run out", fast, []error{transient, transient, transient, transient}, 3, Transient, false, ""},
+		{"permanent not retried", fast, []error{errors.New("no such mailbox")}, 1, Permanent, false, ""},
+		{"auth not retried", fast, []error{errors.New("Invalid credentials")}, 1, Auth, false, ""},
+		// The first wait of at least 500ms would overrun the budget
+		{"budget spent", Policy{Attempts: 10, Base: time.Second, Max: time.Second, Budget: 400 * time.Millisecond}, []error{transient, transient}, 1, Transient, false, "retry budget"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Do(context.Background(), "test", tt.policy, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if calls != tt.calls {
+				t.Errorf("calls = %d, want %d", calls, tt.calls)
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v", err)
+			}
+			if err != nil && Classify(err) != tt.want {
+				t.Errorf("Classify = %v, want %v", Classify(err), tt.want)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.text) {
+				t.Errorf("err = %v, want %q in it", err, tt.text)
+			}
+		})
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := Policy{Attempts: 5, Base: time.Hour, Max: time.Hour}
+	calls := 0
+	start := time.Now()
+	err := Do(ctx, "test", p, func() error {
+		calls++
+		cancel()
+		return errors.New("timed out")
+	})
+	if calls != 1 || time.Since(start) > time.Second {
+		t.Errorf("calls = %d after %v, want 1 without waiting", calls, time.Since(start))
+	}
+	if err == nil || Classify(err) != Transient || !strings.Contains(err.Error(), "context canceled") {
+		t.Errorf("err = %v, want a transient error noting the cancellation", err)
+	}
+}
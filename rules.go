@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/rules"
+)
+
+// Serializes rule changes, rules are read, modified and written back to s3
+var rulesMu sync.Mutex
+
+// Dry run request, rules are evaluated against the recent 25 messages
+type dryRunRequest struct {
+	mail.Mail
+	// Rules to evaluate instead of the saved ones
+	Rules []rules.Rule
+}
+
+// Lists the user rules
+func listRules(w http.ResponseWriter, r *http.Request) {
+	rs, err := rules.Load(r.Context(), r.PathValue("user"))
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	if rs == nil {
+		rs = []rules.Rule{}
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: rs})
+}
+
+// Appends a rule to the user rules
+// Generates the rule id if not given
+func createRule(w http.ResponseWriter, r *http.Request) {
+	var rule rules.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+	if err := rule.Compile(); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	if rule.Id == "" {
+		rule.Id = newId()
+	}
+
+	user := r.PathValue("user")
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	rs, err := rules.Load(r.Context(), user)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	for _, rr := range rs {
+		if rr.Id == rule.Id {
+			send(w, response{Status: http.StatusConflict, Message: "Rule already exists"})
+			return
+		}
+	}
+
+	if err := rules.Save(r.Context(), user, append(rs, rule)); err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusCreated, Message: "Success", Data: rule})
+}
+
+// Replaces the rule with the given id, its position is kept
+func updateRule(w http.ResponseWriter, r *http.Request) {
+	var rule rules.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+	if err := rule.Compile(); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	rule.Id = r.PathValue("id")
+
+	user := r.PathValue("user")
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	rs, err := rules.Load(r.Context(), user)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	found := false
+	for i := range rs {
+		if rs[i].Id == rule.Id {
+			rs[i] = rule
+			found = true
+		}
+	}
+	if !found {
+		send(w, response{Status: http.StatusNotFound, Message: "Rule not found"})
+		return
+	}
+
+	if err := rules.Save(r.Context(), user, rs); err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: rule})
+}
+
+// Deletes the rule with the given id
+func deleteRule(w http.ResponseWriter, r *http.Request) {
+	user, id := r.PathValue("user"), r.PathValue("id")
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	rs, err := rules.Load(r.Context(), user)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	kept := make([]rules.Rule, 0, len(rs))
+	for _, rr := range rs {
+		if rr.Id != id {
+			kept = append(kept, rr)
+		}
+	}
+	if len(kept) == len(rs) {
+		send(w, response{Status: http.StatusNotFound, Message: "Rule not found"})
+		return
+	}
+
+	if err := rules.Save(r.Context(), user, kept); err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success"})
+}
+
+// Evaluates the rules against the recent 25 messages without exporting anything
+// Responds with the rule that matched each message
+// Needs a token of the user, or the imap server pinned for the user, see owner
+func dryRunRules(w http.ResponseWriter, r *http.Request) {
+	var req dryRunRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Addr == "" || req.User == "" || req.Pass == "" {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+
+	ctx := requestContext(w, r, req.User)
+	if !owner(ctx, w, r, req.User, req.Addr) {
+		return
+	}
+	rs := req.Rules
+	if rs != nil {
+		if err := rules.Compile(rs); err != nil {
+			send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+	}
+
+	u := req.Mail
+	if err := u.Login(ctx); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	defer u.Logout()
+
+	// Saved rules are only read once the login proved ownership of the account
+	if rs == nil {
+		if rs, err = rules.Load(ctx, req.User); err != nil {
+			send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+			return
+		}
+	}
+
+	to := u.NumMsgs()
+	from := to - 25
+	if to <= 25 {
+		from = uint32(1)
+	}
+	msgs, err := u.Fetch(ctx, from, to)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	extractTexts(ctx, msgs)
+
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: rules.DryRun(rs, msgs)})
+}
+
+// Returns a random hex id
+func newId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,307 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tars47/go-read-mail/excel"
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// A rule is evaluated against every fetched message before export
+// Rules are evaluated in order, the first matching rule wins
+type Rule struct {
+	Id   string     `json:"id"`
+	Name string     `json:"name"`
+	When Conditions `json:"when"`
+	Then Actions    `json:"then"`
+}
+
+// Conditions of a rule, every condition that is set must match
+// Text conditions are regular expressions
+type Conditions struct {
+	// Matches any of the From addresses
+	From string `json:"from,omitempty"`
+	// Matches any of the To, Cc or Bcc addresses
+	To      string `json:"to,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// Matches the text or html body
+	Body string `json:"body,omitempty"`
+	// Matches the text extracted from any attachment
+	AttachmentText string `json:"attachmentText,omitempty"`
+	// Matches the content type or the file name of any attachment eg: "application/pdf|\\.xlsx$"
+	AttachmentType string `json:"attachmentType,omitempty"`
+	// Message size in bytes, body, attachments and inline parts
+	MinSize int `json:"minSize,omitempty"`
+	MaxSize int `json:"maxSize,omitempty"`
+	// Message date range
+	After  *time.Time `json:"after,omitempty"`
+	Before *time.Time `json:"before,omitempty"`
+
+	// Compiled expressions
+	from, to, subject, body, attText, attType *regexp.Regexp
+}
+
+// Actions of a rule, applied when the rule matches
+type Actions struct {
+	// Message is not exported
+	Skip bool `json:"skip,omitempty"`
+	// Label written to the Tag column
+	Tag string `json:"tag,omitempty"`
+	// Sheet the message is written to
+	Sheet string `json:"sheet,omitempty"`
+	// Template for attachment names, eg: "{{.Date}}-{{.Index}}{{.Ext}}"
+	// Fields: Name, Base, Ext, Index, Id, Date, Subject, From
+	// Names the template gives to several attachments get the part index added, eg: {{.Date}}-2.pdf
+	Rename string `json:"rename,omitempty"`
+	// Attachments are listed in the excel file but not uploaded
+	SkipAttachments bool `json:"skipAttachments,omitempty"`
+
+	rename *template.Template
+}
+
+// Outcome of evaluating the rules against a message
+type Result struct {
+	Id      string    `json:"id"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	// Id of the matching rule, empty if none matched
+	Rule    string   `json:"rule,omitempty"`
+	Actions *Actions `json:"actions,omitempty"`
+}
+
+// Characters not allowed in excel sheet names, which are at most 31 characters long
+var badSheetChars = regexp.MustCompile(`[\[\]:*?/\\]`)
+
+// Compiles the rule expressions and templates
+// Returns an error describing the first invalid field
+func (r *Rule) Compile() error {
+	c := &r.When
+	exprs := []struct {
+		name string
+		src  string
+		dst  **regexp.Regexp
+	}{
+		{"from", c.From, &c.from},
+		{"to", c.To, &c.to},
+		{"subject", c.Subject, &c.subject},
+		{"body", c.Body, &c.body},
+		{"attachmentText", c.AttachmentText, &c.attText},
+		{"attachmentType", c.AttachmentType, &c.attType},
+	}
+	for _, e := range exprs {
+		*e.dst = nil
+		if e.src == "" {
+			continue
+		}
+		re, err := regexp.Compile(e.src)
+		if err != nil {
+			return fmt.Errorf("invalid %v expression. err: %v", e.name, err)
+		}
+		*e.dst = re
+	}
+	if c.MaxSize > 0 && c.MinSize > c.MaxSize {
+		return fmt.Errorf("minSize is greater than maxSize")
+	}
+
+	a := &r.Then
+	if a.Sheet != "" && (utf8.RuneCountInString(a.Sheet) > 31 || badSheetChars.MatchString(a.Sheet)) {
+		return fmt.Errorf("invalid sheet name %q", a.Sheet)
+	}
+	// Sheet names are case insensitive in excel
+	if strings.EqualFold(a.Sheet, excel.Meetings) {
+		return fmt.Errorf("sheet name %q is reserved for calendar events", a.Sheet)
+	}
+	a.rename = nil
+	if a.Rename != "" {
+		t, err := template.New("rename").Option("missingkey=error").Parse(a.Rename)
+		if err != nil {
+			return fmt.Errorf("invalid rename template. err: %v", err)
+		}
+		a.rename = t
+	}
+	return nil
+}
+
+// Compiles all rules, returns the first error
+func Compile(rs []Rule) error {
+	for i := range rs {
+		if err := rs[i].Compile(); err != nil {
+			return fmt.Errorf("rule %q: %v", rs[i].Id, err)
+		}
+	}
+	return nil
+}
+
+// Returns the first rule matching the message, nil if none matches
+// Rules must be compiled
+func Match(rs []Rule, msg *mail.Message) *Rule {
+	for i := range rs {
+		if rs[i].When.match(msg) {
+			return &rs[i]
+		}
+	}
+	return nil
+}
+
+// Evaluates the rules against every message and applies the actions of the matching rule
+// Returns the messages to export, skipped messages are left out
+func Apply(rs []Rule, msgs []mail.Message) []mail.Message {
+	if len(rs) == 0 {
+		return msgs
+	}
+
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		r := Match(rs, &msg)
+		if r == nil {
+			kept = append(kept, msg)
+			continue
+		}
+		if r.Then.Skip {
+			continue
+		}
+		r.Then.apply(&msg)
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+// Evaluates the rules without applying any action
+// Returns the matching rule of every message
+func DryRun(rs []Rule, msgs []mail.Message) []Result {
+	res := make([]Result, len(msgs))
+	for i := range msgs {
+		res[i] = Result{Id: msgs[i].Id, Date: msgs[i].Date, Subject: msgs[i].Subject}
+		if r := Match(rs, &msgs[i]); r != nil {
+			res[i].Rule = r.Id
+			res[i].Actions = &r.Then
+		}
+	}
+	return res
+}
+
+// Returns true if every set condition matches the message
+func (c *Conditions) match(msg *mail.Message) bool {
+	if c.from != nil && !anyMatch(c.from, msg.From) {
+		return false
+	}
+	if c.to != nil && !anyMatch(c.to, msg.To) && !anyMatch(c.to, msg.Cc) && !anyMatch(c.to, msg.Bcc) {
+		return false
+	}
+	if c.subject != nil && !c.subject.MatchString(msg.Subject) {
+		return false
+	}
+	if c.body != nil && !c.body.MatchString(msg.BodyText) && !c.body.MatchString(msg.BodyHtml) {
+		return false
+	}
+	if c.attText != nil {
+		found := false
+		for _, att := range msg.Attachment {
+			if c.attText.MatchString(att.Text) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.attType != nil {
+		found := false
+		for _, att := range msg.Attachment {
+			if c.attType.MatchString(att.Type) || c.attType.MatchString(att.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.MinSize > 0 || c.MaxSize > 0 {
+		size := Size(msg)
+		if size < c.MinSize || (c.MaxSize > 0 && size > c.MaxSize) {
+			return false
+		}
+	}
+	if c.After != nil && !msg.Date.After(*c.After) {
+		return false
+	}
+	if c.Before != nil && !msg.Date.Before(*c.Before) {
+		return false
+	}
+	return true
+}
+
+// Applies the actions to the message
+func (a *Actions) apply(msg *mail.Message) {
+	msg.Tag = a.Tag
+	msg.Sheet = a.Sheet
+	msg.SkipUpload = a.SkipAttachments
+
+	if a.rename == nil {
+		return
+	}
+
+	for i := range msg.Attachment {
+		if name := a.name(msg, i); name != "" {
+			msg.Attachment[i].Name = name
+		}
+	}
+	// A template without {{.Index}} may give attachments the same s3 key
+	mail.UniqueNames(msg.Attachment)
+}
+
+// Returns the new name of the i-th attachment, empty if the template fails
+func (a *Actions) name(msg *mail.Message, i int) string {
+	ext := path.Ext(msg.Attachment[i].Name)
+	data := struct {
+		Name, Base, Ext, Id, Date, Subject, From string
+		Index                                    int
+	}{
+		Name:    msg.Attachment[i].Name,
+		Base:    strings.TrimSuffix(msg.Attachment[i].Name, ext),
+		Ext:     ext,
+		Id:      msg.Id,
+		Date:    msg.Date.Format("2006-01-02"),
+		Subject: msg.Subject,
+		From:    mail.ToString(msg.From),
+		Index:   i + 1,
+	}
+
+	var buf bytes.Buffer
+	if err := a.rename.Execute(&buf, data); err != nil {
+		return ""
+	}
+	// Names are used in s3 keys, keep them flat
+	return strings.TrimSpace(strings.NewReplacer("/", "_", "\\", "_").Replace(buf.String()))
+}
+
+// Returns the message size in bytes, body, attachments and inline parts
+func Size(msg *mail.Message) int {
+	size := len(msg.BodyText) + len(msg.BodyHtml)
+	for _, att := range msg.Attachment {
+		size += att.Buf.Len()
+	}
+	for _, att := range msg.Inline {
+		size += att.Buf.Len()
+	}
+	return size
+}
+
+// Returns true if any of the values matches
+func anyMatch(re *regexp.Regexp, vals []string) bool {
+	for _, v := range vals {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
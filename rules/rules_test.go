@@ -0,0 +1,180 @@
+package rules
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tars47/go-read-mail/mail"
+)
+
+func TestApplyRenameUnique(t *testing.T) {
+	rs := []Rule{{Id: "r", Then: Actions{Rename: "{{.Date}}{{.Ext}}"}}}
+	if err := Compile(rs); err != nil {
+		t.Fatal(err)
+	}
+	msgs := Apply(rs, []mail.Message{{Attachment: []mail.Attachment{{Name: "a.pdf"}, {Name: "b.pdf"}, {Name: "c.csv"}}}})
+
+	want := []string{"0001-01-01.pdf", "0001-01-01-2.pdf", "0001-01-01.csv"}
+	for i, att := range msgs[0].Attachment {
+		if att.Name != want[i] {
+			t.Errorf("attachment %d = %q, want %q", i, att.Name, want[i])
+		}
+	}
+}
+
+func TestCompileSheet(t *testing.T) {
+	for sheet, ok := range map[string]bool{
+		"Invoices": true, "Meetings": false, "meetings": false, "a/b": false,
+		strings.Repeat("a", 31): true, strings.Repeat("a", 32): false,
+		// 31 characters of 2 bytes each
+		strings.Repeat("é", 31): true,
+	} {
+		r := Rule{Id: "r", Then: Actions{Sheet: sheet}}
+		if err := r.Compile(); (err == nil) != ok {
+			t.Errorf("sheet %q: Compile = %v", sheet, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	day := func(d int) *time.Time { t := time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC); return &t }
+	msg := mail.Message{
+		Id:       "m",
+		Date:     *day(10),
+		Subject:  "Invoice 42",
+		From:     []string{"Billing <billing@shop.example>"},
+		To:       []string{"<dev@example.com>"},
+		Cc:       []string{"<boss@example.com>"},
+		BodyText: "Please find the invoice attached",
+		BodyHtml: "<p>Please find the <b>invoice</b> attached</p>",
+		Attachment: []mail.Attachment{
+			{Name: "invoice.pdf", Type: "application/pdf", Text: "Total due: 120 EUR", Buf: *bytes.NewBufferString("0123456789")},
+		},
+	}
+	tests := []struct {
+		name string
+		when Conditions
+		want bool
+	}{
+		{"no condition", Conditions{}, true},
+		{"from", Conditions{From: `@shop\.example`}, true},
+		{"from mismatch", Conditions{From: `@bank\.example`}, false},
+		{"to matches cc", Conditions{To: `boss@`}, true},
+		{"to mismatch", Conditions{To: `ceo@`}, false},
+		{"subject", Conditions{Subject: `^Invoice \d+$`}, true},
+		{"subject is case sensitive", Conditions{Subject: `invoice`}, false},
+		{"body matches html", Conditions{Body: `<b>invoice</b>`}, true},
+		{"attachment text", Conditions{AttachmentText: `Total due: \d+`}, true},
+		{"attachment text mismatch", Conditions{AttachmentText: `USD`}, false},
+		{"attachment type", Conditions{AttachmentType: `application/pdf`}, true},
+		{"attachment name", Conditions{AttachmentType: `\.pdf$`}, true},
+		{"attachment type mismatch", Conditions{AttachmentType: `\.xlsx$`}, false},
+		{"size in range", Conditions{MinSize: 10, MaxSize: 1000}, true},
+		{"too small", Conditions{MinSize: 1000}, false},
+		{"too large", Conditions{MaxSize: 20}, false},
+		{"after", Conditions{After: day(9)}, true},
+		{"after is exclusive", Conditions{After: day(10)}, false},
+		{"before", Conditions{Before: day(11)}, true},
+		{"before is exclusive", Conditions{Before: day(10)}, false},
+		{"every condition must match", Conditions{From: `@shop\.example`, Subject: `Receipt`}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := []Rule{{Id: "r", When: tt.when}}
+			if err := Compile(rs); err != nil {
+				t.Fatal(err)
+			}
+			if got := Match(rs, &msg) != nil; got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	rs := []Rule{
+		{Id: "spam", When: Conditions{Subject: `WIN`}, Then: Actions{Skip: true}},
+		{Id: "invoices", When: Conditions{Subject: `Invoice`}, Then: Actions{Tag: "billing", Sheet: "Invoices", SkipAttachments: true}},
+		{Id: "all", When: Conditions{Subject: `Invoice|Report`}, Then: Actions{Tag: "other"}},
+	}
+	if err := Compile(rs); err != nil {
+		t.Fatal(err)
+	}
+	msgs := Apply(rs, []mail.Message{
+		{Id: "1", Subject: "WIN a prize"},
+		{Id: "2", Subject: "Invoice 42"},
+		{Id: "3", Subject: "Report"},
+		{Id: "4", Subject: "Hello"},
+	})
+
+	tests := []struct {
+		id, tag, sheet string
+		skipUpload     bool
+	}{
+		// The first matching rule wins, skipped messages are left out
+		{"2", "billing", "Invoices", true},
+		{"3", "other", "", false},
+		{"4", "", "", false},
+	}
+	if len(msgs) != len(tests) {
+		t.Fatalf("kept %d messages, want %d", len(msgs), len(tests))
+	}
+	for i, tt := range tests {
+		m := msgs[i]
+		if m.Id != tt.id || m.Tag != tt.tag || m.Sheet != tt.sheet || m.SkipUpload != tt.skipUpload {
+			t.Errorf("message %d = {%v %q %q %v}, want %+v", i, m.Id, m.Tag, m.Sheet, m.SkipUpload, tt)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	rs := []Rule{
+		{Id: "spam", When: Conditions{Subject: `WIN`}, Then: Actions{Skip: true}},
+		{Id: "invoices", When: Conditions{Subject: `Invoice`}, Then: Actions{Tag: "billing"}},
+	}
+	if err := Compile(rs); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	msgs := []mail.Message{
+		{Id: "1", Subject: "WIN a prize", Date: date},
+		{Id: "2", Subject: "Invoice 42", Date: date},
+		{Id: "3", Subject: "Hello", Date: date},
+	}
+	res := DryRun(rs, msgs)
+
+	tests := []struct {
+		id, rule string
+		skip     bool
+		tag      string
+	}{
+		{"1", "spam", true, ""},
+		{"2", "invoices", false, "billing"},
+		{"3", "", false, ""},
+	}
+	if len(res) != len(tests) {
+		t.Fatalf("results = %d, want %d", len(res), len(tests))
+	}
+	for i, tt := range tests {
+		r := res[i]
+		if r.Id != tt.id || r.Rule != tt.rule || r.Subject != msgs[i].Subject || !r.Date.Equal(date) {
+			t.Errorf("result %d = %+v, want id %v and rule %q", i, r, tt.id, tt.rule)
+			continue
+		}
+		if tt.rule == "" {
+			if r.Actions != nil {
+				t.Errorf("result %d has actions without a rule", i)
+			}
+			continue
+		}
+		if r.Actions == nil || r.Actions.Skip != tt.skip || r.Actions.Tag != tt.tag {
+			t.Errorf("result %d actions = %+v, want skip %v and tag %q", i, r.Actions, tt.skip, tt.tag)
+		}
+	}
+	// Nothing is applied, skipped messages are still there
+	if len(msgs) != 3 || msgs[1].Tag != "" {
+		t.Error("DryRun changed the messages")
+	}
+}
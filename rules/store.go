@@ -0,0 +1,61 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tars47/go-read-mail/awss3"
+)
+
+// Name of the rules file stored in the user folder
+const DefaultRules = "rules.json"
+
+// Loads and compiles the user rules from s3
+// Returns no rules if the user has none
+func Load(ctx context.Context, user string) ([]Rule, error) {
+	buf, err := awss3.DownloadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultRules))
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rs []Rule
+	if err := json.NewDecoder(buf).Decode(&rs); err != nil {
+		return nil, fmt.Errorf("unable to read rules. err: %v", err)
+	}
+	if err := Compile(rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Saves the user rules to s3
+func Save(ctx context.Context, user string, rs []Rule) error {
+	if rs == nil {
+		rs = []Rule{}
+	}
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	if _, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultRules), bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("unable to save rules. err: %v", err)
+	}
+	return nil
+}
+
+// Returns true if any rule sets a tag
+// Used to decide whether the excel file needs the Tag column
+func HasTags(rs []Rule) bool {
+	for _, r := range rs {
+		if r.Then.Tag != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tars47/go-read-mail/retry"
+)
+
+// Bytes sent by INSTREAM chunk, clamd rejects chunks above its StreamMaxLength
+const chunkSize = 64 << 10
+
+// Default timeout of a scan, including the connection
+const DefaultTimeout = time.Minute
+
+// Client of the clamd daemon of ClamAV, speaking its INSTREAM protocol
+type Clamd struct {
+	// "tcp" or "unix"
+	Network string
+	// host:port or the socket path
+	Addr string
+	// Timeout of a scan, ctx deadlines still apply
+	Timeout time.Duration
+}
+
+// Returns a clamd client for addr, a unix socket path if it starts with / or unix:, else host:port
+func NewClamd(addr string) *Clamd {
+	c := &Clamd{Network: "tcp", Addr: addr, Timeout: DefaultTimeout}
+	if strings.HasPrefix(addr, "unix:") || strings.HasPrefix(addr, "/") {
+		c.Network, c.Addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return c
+}
+
+// Streams the attachment to clamd, connection failures are retried, see retry.Scan
+func (c *Clamd) Scan(ctx context.Context, name string, b []byte) (Verdict, error) {
+	var v Verdict
+	err := retry.Do(ctx, "clamd scan", retry.Scan, func() error {
+		var err error
+		v, err = c.instream(ctx, b)
+		return err
+	})
+	if err != nil {
+		return Verdict{}, fmt.Errorf("unable to scan %v with clamd. err: %w", name, err)
+	}
+	return v, nil
+}
+
+// Sends b with the INSTREAM command, as chunks prefixed by their big endian length
+// and ended by an empty chunk, then reads the reply, eg: "stream: Eicar-Signature FOUND"
+func (c *Clamd) instream(ctx context.Context, b []byte) (Verdict, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Addr)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if c.Timeout > 0 && (!ok || time.Until(deadline) > c.Timeout) {
+		deadline, ok = time.Now().Add(c.Timeout), true
+	}
+	if ok {
+		conn.SetDeadline(deadline)
+	}
+
+	werr := send(conn, b)
+	// clamd replies and closes the connection when the stream exceeds its limits,
+	// the reply is read even if sending failed
+	reply, rerr := bufio.NewReader(conn).ReadString(0)
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	if reply == "" {
+		if werr != nil {
+			return Verdict{}, werr
+		}
+		if rerr != nil {
+			return Verdict{}, rerr
+		}
+		return Verdict{}, errors.New("empty reply")
+	}
+	return parseReply(reply)
+}
+
+// Writes the INSTREAM command and the chunks of b
+func send(conn net.Conn, b []byte) error {
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(b) > 0 {
+		n := min(len(b), chunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(b[:n])
+		b = b[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	return w.Flush()
+}
+
+// Reads a clamd reply, errors reported by clamd are not retried
+func parseReply(reply string) (Verdict, error) {
+	// The reply is prefixed by the stream name, "stream: "
+	_, result, _ := strings.Cut(reply, ": ")
+	if result == "" {
+		result = reply
+	}
+	switch {
+	case result == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Threat: strings.TrimSuffix(result, " FOUND"), Scanner: "clamd"}, nil
+	case strings.HasSuffix(result, " ERROR"):
+		return Verdict{}, retry.Mark(retry.Permanent, errors.New(strings.TrimSuffix(result, " ERROR")))
+	}
+	return Verdict{}, retry.Mark(retry.Permanent, fmt.Errorf("unexpected reply %q", reply))
+}
+
+// Checks that clamd answers PING
+func (c *Clamd) Ping(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(bytes.TrimRight(reply, "\x00"), []byte("PONG")) {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
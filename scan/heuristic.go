@@ -0,0 +1,117 @@
+package scan
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"path"
+	"strings"
+
+	"github.com/tars47/go-read-mail/policy"
+)
+
+// Threats reported by the Heuristic scanner
+const (
+	ThreatExecutable      = "Heuristic.Executable"
+	ThreatMacro           = "Heuristic.Macro"
+	ThreatDoubleExtension = "Heuristic.DoubleExtension"
+)
+
+// Extensions run by Windows, or by a shell, when opened
+var executableExts = map[string]bool{
+	".exe": true, ".com": true, ".scr": true, ".pif": true, ".bat": true, ".cmd": true,
+	".msi": true, ".dll": true, ".cpl": true, ".vbs": true, ".vbe": true, ".js": true,
+	".jse": true, ".wsf": true, ".wsh": true, ".hta": true, ".ps1": true, ".jar": true,
+	".lnk": true, ".reg": true, ".sh": true, ".app": true,
+}
+
+// Content types of executables, as returned by policy.Sniff
+var executableTypes = map[string]bool{
+	"application/x-msdownload":  true,
+	"application/x-executable":  true,
+	"application/x-mach-binary": true,
+	"application/java-archive":  true,
+}
+
+// Extensions of macro-enabled Office documents
+var macroExts = map[string]bool{
+	".docm": true, ".dotm": true, ".xlsm": true, ".xltm": true, ".xlam": true,
+	".pptm": true, ".potm": true, ".ppsm": true, ".ppam": true,
+}
+
+// Name of the VBA project stream of legacy Office documents, as stored in the UTF-16 OLE2 directory
+var vbaStream = []byte("_\x00V\x00B\x00A\x00_\x00P\x00R\x00O\x00J\x00E\x00C\x00T\x00")
+
+// Scanner flagging executables, macro-enabled Office documents and double extensions
+// eg: invoice.pdf.exe, without any signature database
+type Heuristic struct{}
+
+// Checks the name and the bytes of the attachment, never fails
+func (Heuristic) Scan(ctx context.Context, name string, b []byte) (Verdict, error) {
+	if threat := heuristic(name, b); threat != "" {
+		return Verdict{Threat: threat, Scanner: "heuristic"}, nil
+	}
+	return Verdict{}, nil
+}
+
+// Returns the threat found, empty if none
+func heuristic(name string, b []byte) string {
+	ctype := policy.Sniff(name, "", b)
+	if threat := nameThreat(name, executableTypes[ctype]); threat != "" {
+		return threat
+	}
+	switch {
+	case strings.Contains(ctype, "macroenabled"):
+		return ThreatMacro
+	case bytes.HasPrefix(b, []byte("\xd0\xcf\x11\xe0")) && bytes.Contains(b, vbaStream):
+		return ThreatMacro
+	case bytes.HasPrefix(b, []byte("PK\x03\x04")):
+		return zipThreat(b)
+	}
+	return ""
+}
+
+// Returns the threat told by the name, executable is true if the bytes are an executable
+func nameThreat(name string, executable bool) string {
+	lower := strings.ToLower(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	ext := path.Ext(lower)
+
+	switch {
+	case doubleExtension(lower) && (executableExts[ext] || executable):
+		return ThreatDoubleExtension
+	// The right-to-left override reverses how the end of the name is shown, eg: invoice<U+202E>fdp.exe reads invoiceexe.pdf
+	case strings.ContainsRune(name, '\u202e'):
+		return ThreatDoubleExtension
+	case executableExts[ext] || executable:
+		return ThreatExecutable
+	case macroExts[ext]:
+		return ThreatMacro
+	}
+	return ""
+}
+
+// Returns the threat told by the names of the files in a zip, eg: a zip holding setup.exe or invoice.pdf.exe
+// Only the central directory is read, the files are not decompressed
+func zipThreat(b []byte) string {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return ""
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		if threat := nameThreat(f.Name, false); threat != "" {
+			return threat
+		}
+	}
+	return ""
+}
+
+// Returns true if the name ends with two extensions, the first one hiding the second,
+// eg: photo.jpg.exe or "invoice.pdf      .exe"
+func doubleExtension(name string) bool {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	inner := path.Ext(strings.TrimRight(base, " "))
+	return len(inner) > 1 && len(inner) <= 5 && base != inner
+}
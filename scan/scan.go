@@ -0,0 +1,38 @@
+package scan
+
+import (
+	"context"
+)
+
+// Checks an attachment for malware before it is stored
+// Returns an error when the attachment could not be scanned, it is then not stored
+type Scanner interface {
+	Scan(ctx context.Context, name string, b []byte) (Verdict, error)
+}
+
+// Outcome of a scan
+type Verdict struct {
+	// Name of the threat found, empty if the attachment is clean
+	Threat string
+	// Scanner that found the threat, eg: clamd or heuristic
+	Scanner string
+}
+
+// Returns true if a threat was found
+func (v Verdict) Infected() bool {
+	return v.Threat != ""
+}
+
+// Runs scanners in order, the first one finding a threat gives the verdict
+type Chain []Scanner
+
+// Runs the scanners until one finds a threat or fails
+func (c Chain) Scan(ctx context.Context, name string, b []byte) (Verdict, error) {
+	for _, s := range c {
+		v, err := s.Scan(ctx, name, b)
+		if err != nil || v.Infected() {
+			return v, err
+		}
+	}
+	return Verdict{}, nil
+}
@@ -0,0 +1,215 @@
+package scan
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test string detected by every antivirus
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// Fake clamd answering INSTREAM and PING, streams holding eicar are reported infected
+// Streams larger than limit are rejected like clamd does with StreamMaxLength
+func fakeClamd(t *testing.T, network string, limit int) string {
+	t.Helper()
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(t.TempDir(), "clamd.sock")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, limit)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveClamd(conn net.Conn, limit int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+		return
+	case "zINSTREAM\x00":
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var stream bytes.Buffer
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(&stream, r, int64(n)); err != nil {
+			return
+		}
+		if stream.Len() > limit {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+	}
+	if bytes.Contains(stream.Bytes(), []byte(eicar)) {
+		conn.Write([]byte("stream: Win.Test.EICAR_HDB-1 FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamd(t *testing.T) {
+	tcp := NewClamd(fakeClamd(t, "tcp", 1<<20))
+	unix := NewClamd("unix:" + fakeClamd(t, "unix", 1<<20))
+	small := NewClamd(fakeClamd(t, "tcp", 100))
+
+	tests := []struct {
+		name   string
+		clamd  *Clamd
+		data   []byte
+		threat string
+		err    string
+	}{
+		{name: "clean", clamd: tcp, data: []byte("hello")},
+		{name: "infected", clamd: tcp, data: []byte(eicar), threat: "Win.Test.EICAR_HDB-1"},
+		{name: "infected across chunks", clamd: tcp, data: []byte(strings.Repeat("x", chunkSize-10) + eicar), threat: "Win.Test.EICAR_HDB-1"},
+		{name: "unix socket", clamd: unix, data: []byte(eicar), threat: "Win.Test.EICAR_HDB-1"},
+		{name: "empty", clamd: unix},
+		{name: "size limit", clamd: small, data: bytes.Repeat([]byte("x"), 1000), err: "INSTREAM size limit exceeded."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.clamd.Scan(context.Background(), "file", tt.data)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Threat != tt.threat || v.Infected() != (tt.threat != "") {
+				t.Errorf("verdict = %+v, want %v", v, tt.threat)
+			}
+			if v.Infected() && v.Scanner != "clamd" {
+				t.Errorf("scanner = %v", v.Scanner)
+			}
+		})
+	}
+
+	if err := tcp.Ping(context.Background()); err != nil {
+		t.Errorf("Ping = %v", err)
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := NewClamd(addr).Scan(ctx, "file", []byte("hello")); err == nil {
+		t.Error("Scan = nil, want an error")
+	}
+}
+
+func TestHeuristic(t *testing.T) {
+	var docm bytes.Buffer
+	zw := zip.NewWriter(&docm)
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml", "word/vbaProject.bin"} {
+		zw.Create(name)
+	}
+	zw.Close()
+
+	// Returns a zip holding empty files with the given names
+	zipOf := func(names ...string) []byte {
+		var b bytes.Buffer
+		zw := zip.NewWriter(&b)
+		for _, name := range names {
+			zw.Create(name)
+		}
+		zw.Close()
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		name   string
+		file   string
+		data   []byte
+		threat string
+	}{
+		{name: "pdf", file: "invoice.pdf", data: []byte("%PDF-1.7\n")},
+		{name: "archive with two extensions", file: "logs.tar.gz", data: []byte("\x1f\x8b\x08")},
+		{name: "exe extension", file: "setup.EXE", data: []byte("x"), threat: ThreatExecutable},
+		{name: "script", file: "run.ps1", data: []byte("Write-Host"), threat: ThreatExecutable},
+		{name: "executable bytes", file: "invoice.pdf", data: []byte("MZ\x90\x00\x03"), threat: ThreatExecutable},
+		{name: "double extension", file: "photo.jpg.exe", data: []byte("MZ"), threat: ThreatDoubleExtension},
+		{name: "padded double extension", file: "invoice.pdf        .scr", data: []byte("x"), threat: ThreatDoubleExtension},
+		{name: "right-to-left override", file: "invoice\u202efdp.exe", data: []byte("x"), threat: ThreatDoubleExtension},
+		{name: "macro extension", file: "budget.xlsm", data: []byte("PK"), threat: ThreatMacro},
+		{name: "macros renamed docx", file: "letter.docx", data: docm.Bytes(), threat: ThreatMacro},
+		{name: "legacy document with macros", file: "letter.doc", data: append([]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), vbaStream...), threat: ThreatMacro},
+		{name: "legacy document", file: "letter.doc", data: []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")},
+		{name: "zip of documents", file: "invoices.zip", data: zipOf("march.pdf", "april/april.csv", "april/")},
+		{name: "zip holding an executable", file: "invoices.zip", data: zipOf("march.pdf", "tools/setup.exe"), threat: ThreatExecutable},
+		{name: "zip holding a double extension", file: "invoices.zip", data: zipOf("invoice.pdf.scr"), threat: ThreatDoubleExtension},
+		{name: "zip holding a macro document", file: "budget.zip", data: zipOf("budget.xlsm"), threat: ThreatMacro},
+		{name: "docx is not a suspicious zip", file: "letter.docx", data: zipOf("[Content_Types].xml", "word/document.xml", "word/_rels/document.xml.rels")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := Heuristic{}.Scan(context.Background(), tt.file, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Threat != tt.threat {
+				t.Errorf("threat = %q, want %q", v.Threat, tt.threat)
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	c := Chain{Heuristic{}, NewClamd(fakeClamd(t, "tcp", 1<<20))}
+	v, err := c.Scan(context.Background(), "a.txt", []byte(eicar))
+	if err != nil || v.Threat != "Win.Test.EICAR_HDB-1" {
+		t.Errorf("verdict = %+v, err = %v", v, err)
+	}
+	if v, err = c.Scan(context.Background(), "a.exe", []byte(eicar)); err != nil || v.Scanner != "heuristic" {
+		t.Errorf("verdict = %+v, err = %v", v, err)
+	}
+}
@@ -0,0 +1,195 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A parsed cron expression
+// Either the five standard fields: minute hour day-of-month month day-of-week,
+// a macro: @hourly, @daily, @weekly, @monthly, or a fixed interval: @every 15m
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	// Day of month and day of week restricted, not covering their full range
+	// When both are, a day matching either matches
+	domSet, dowSet bool
+	// Fixed interval of @every
+	every time.Duration
+}
+
+// Bounds of the cron fields
+var fields = []struct{ min, max int }{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are sunday
+}
+
+// Macros and the expression they stand for
+var macros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// Months and days accepted by name, eg: mon-fri, jan
+var names = []map[string]int{
+	nil, nil, nil,
+	{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12},
+	{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6},
+}
+
+// Parses a cron expression
+// Fields accept *, values, ranges a-b, lists a,b and steps */n or a-b/n
+// eg: "*/15 9-17 * * mon-fri" runs every 15 minutes during business hours
+func Parse(expr string) (*Cron, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if d, ok := strings.CutPrefix(expr, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every < time.Minute {
+			return nil, fmt.Errorf("invalid interval %q, expected a duration of at least 1m", d)
+		}
+		return &Cron{every: every}, nil
+	}
+	if m, ok := macros[expr]; ok {
+		expr = m
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("invalid cron expression %q, expected 5 fields", expr)
+	}
+	var bits [5]uint64
+	for i, p := range parts {
+		b, err := parseField(p, i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q. err: %v", expr, err)
+		}
+		bits[i] = b
+	}
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	// Every day of the week is 0-6, 7 being sunday again
+	week := fullMask(0, 6)
+	return &Cron{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domSet: bits[2] != fullMask(fields[2].min, fields[2].max), dowSet: bits[4]&week != week,
+	}, nil
+}
+
+// Returns the bit set of the values from min to max
+func fullMask(min, max int) uint64 {
+	return (1<<(max+1) - 1) &^ (1<<min - 1)
+}
+
+// Parses a field into a bit set of the values it matches
+func parseField(field string, i int) (uint64, error) {
+	min, max := fields[i].min, fields[i].max
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rng, step, hasStep := strings.Cut(item, "/")
+		inc := 1
+		if hasStep {
+			n, err := strconv.Atoi(step)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", item)
+			}
+			inc = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = fieldValue(a, i); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = fieldValue(b, i); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// a/n runs from a to the end of the range
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range %q", item)
+		}
+		for v := lo; v <= hi; v += inc {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Parses a field value, a number or a month or day name
+func fieldValue(s string, i int) (int, error) {
+	if v, ok := names[i][s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// Returns the first run strictly after t, in the location of t
+// Returns the zero time if no run is found within 5 years, eg: "0 0 30 2 *"
+func (c *Cron) Next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every).Truncate(time.Second)
+	}
+
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !c.dayMatch(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc))
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Returns n, or the minute after t when a daylight saving change maps n before t
+func forward(t, n time.Time) time.Time {
+	if n.After(t) {
+		return n
+	}
+	return t.Add(time.Minute)
+}
+
+// Returns true if the day of t matches the day of month and day of week fields
+// As in cron, when both are restricted a day matching either matches
+func (c *Cron) dayMatch(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domSet && c.dowSet {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,123 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{
+		"* * * * *", "*/15 9-17 * * mon-fri", "0 0 1,15 * *", "5/10 * * jan-mar 7",
+		"@hourly", "@daily", "@midnight", "@weekly", "@monthly", "@every 90s", " @EVERY 1h ",
+	}
+	for _, expr := range valid {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("Parse(%q) = %v", expr, err)
+		}
+	}
+
+	invalid := []string{
+		"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "* * * foo *", "@yearly", "@every 30s", "@every x",
+	}
+	for _, expr := range invalid {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	santiago, _ := time.LoadLocation("America/Santiago")
+	saoPaulo, _ := time.LoadLocation("America/Sao_Paulo")
+	utc := func(y int, m time.Month, d, h, min int) time.Time { return time.Date(y, m, d, h, min, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"next minute", "* * * * *", utc(2024, 5, 1, 10, 0).Add(30 * time.Second), utc(2024, 5, 1, 10, 1)},
+		{"strictly after", "0 10 * * *", utc(2024, 5, 1, 10, 0), utc(2024, 5, 2, 10, 0)},
+		{"business hours, friday evening", "*/15 9-17 * * mon-fri", utc(2024, 5, 3, 17, 50), utc(2024, 5, 6, 9, 0)},
+		{"step from a value", "5/20 * * * *", utc(2024, 5, 1, 10, 26), utc(2024, 5, 1, 10, 45)},
+		{"sunday as 7", "0 0 * * 7", utc(2024, 5, 1, 0, 0), utc(2024, 5, 5, 0, 0)},
+		{"day of month or day of week", "0 0 15 * mon", utc(2024, 5, 7, 0, 0), utc(2024, 5, 13, 0, 0)},
+		// Fields covering their full range are not restricted, only the other one applies
+		{"day of week */1", "0 0 15 * */1", utc(2024, 5, 7, 0, 0), utc(2024, 5, 15, 0, 0)},
+		{"day of week 1-7", "0 0 15 * 1-7", utc(2024, 5, 7, 0, 0), utc(2024, 5, 15, 0, 0)},
+		{"day of month */1", "0 0 */1 * mon", utc(2024, 5, 7, 0, 0), utc(2024, 5, 13, 0, 0)},
+		{"day of month 1-31", "0 0 1-31 * mon", utc(2024, 5, 7, 0, 0), utc(2024, 5, 13, 0, 0)},
+		{"next month", "0 0 31 * *", utc(2024, 4, 1, 0, 0), utc(2024, 5, 31, 0, 0)},
+		{"leap day", "0 0 29 2 *", utc(2024, 3, 1, 0, 0), utc(2028, 2, 29, 0, 0)},
+		{"never", "0 0 30 2 *", utc(2024, 1, 1, 0, 0), time.Time{}},
+		{"every", "@every 90s", utc(2024, 5, 1, 10, 0).Add(500 * time.Millisecond), utc(2024, 5, 1, 10, 1).Add(30 * time.Second)},
+		// Clocks go from 02:00 to 03:00, the 02:30 run of that day does not exist
+		{"spring forward, missing run", "30 2 * * *", time.Date(2024, 3, 30, 22, 0, 0, 0, paris), time.Date(2024, 4, 1, 2, 30, 0, 0, paris)},
+		{"spring forward, hourly", "0 * * * *", time.Date(2024, 3, 31, 1, 30, 0, 0, paris), time.Date(2024, 3, 31, 3, 0, 0, 0, paris)},
+		// Clocks go from 00:00 back to 23:00, the 23:00 run happens twice
+		{"fall back, repeated hour", "0 * * * *", utc(2024, 4, 7, 2, 0).In(santiago), utc(2024, 4, 7, 3, 0)},
+		// Clocks went from 00:00 to 01:00, the day had no midnight
+		{"spring forward at midnight", "0 0 * * *", time.Date(2018, 11, 3, 22, 0, 0, 0, saoPaulo), time.Date(2018, 11, 5, 0, 0, 0, 0, saoPaulo)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+// Runs stay strictly increasing and on the expression through daylight saving changes
+func TestNextDaylightSaving(t *testing.T) {
+	days := map[string]time.Time{
+		"Europe/Paris":        time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC),
+		"America/Santiago":    time.Date(2024, 4, 6, 12, 0, 0, 0, time.UTC),
+		"America/Sao_Paulo":   time.Date(2018, 11, 3, 12, 0, 0, 0, time.UTC),
+		"Australia/Lord_Howe": time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC),
+	}
+	for name, day := range days {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skip(err)
+		}
+		for _, expr := range []string{"*/20 * * * *", "0 * * * *", "30 0-3 * * *", "0 0 * * *"} {
+			c, _ := Parse(expr)
+			prev := day.In(loc)
+			for prev.Before(day.Add(48 * time.Hour)) {
+				next := c.Next(prev)
+				if !next.After(prev) {
+					t.Fatalf("%s %q: Next(%v) = %v, not after", name, expr, prev, next)
+				}
+				if c.minute&(1<<uint(next.Minute())) == 0 || c.hour&(1<<uint(next.Hour())) == 0 {
+					t.Fatalf("%s %q: Next(%v) = %v, not on the expression", name, expr, prev, next)
+				}
+				prev = next
+			}
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	if got := forward(t0, t0.Add(time.Hour)); !got.Equal(t0.Add(time.Hour)) {
+		t.Errorf("forward to a later time = %v", got)
+	}
+	// A daylight saving change mapped the next boundary before t
+	if got := forward(t0, t0.Add(-time.Hour)); !got.Equal(t0.Add(time.Minute)) {
+		t.Errorf("forward to an earlier time = %v, want %v", got, t0.Add(time.Minute))
+	}
+	if got := forward(t0, t0); !got.Equal(t0.Add(time.Minute)) {
+		t.Errorf("forward to the same time = %v, want %v", got, t0.Add(time.Minute))
+	}
+}
@@ -0,0 +1,79 @@
+package schedule
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Key encrypting the sync requests of the saved jobs, set with SetKey
+// Defaults to a random key, saved jobs can then not be read after a restart
+var key = randomKey()
+
+func randomKey() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Sets the key encrypting the sync requests, any string is hashed into an AES-256 key
+func SetKey(s string) {
+	k := sha256.Sum256([]byte(s))
+	key = k[:]
+}
+
+// Returns the sync request encrypted with AES-GCM, as a json string of base64(nonce|ciphertext)
+// The request holds the account password, it is never saved in plaintext
+func seal(sync json.RawMessage) (json.RawMessage, error) {
+	if len(sync) == 0 {
+		return sync, nil
+	}
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(gcm.Seal(nonce, nonce, sync, nil))
+}
+
+// Returns the sync request decrypted by seal
+// Requests saved before they were encrypted are returned as they are
+func open(sync json.RawMessage) (json.RawMessage, error) {
+	if len(sync) == 0 || bytes.HasPrefix(sync, []byte("{")) {
+		return sync, nil
+	}
+	var b []byte
+	if err := json.Unmarshal(sync, &b); err != nil {
+		return nil, fmt.Errorf("unable to read sync request. err: %v", err)
+	}
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("unable to decrypt sync request, too short")
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt sync request, was SCHEDULE_KEY changed? err: %v", err)
+	}
+	return plain, nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
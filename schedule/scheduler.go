@@ -0,0 +1,321 @@
+package schedule
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tars47/go-read-mail/logging"
+)
+
+// Outcomes of a run
+const (
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	// The previous run of the job was still running
+	Skipped = "skipped"
+)
+
+// A periodic sync of a user
+type Job struct {
+	User string `json:"user"`
+	// Cron expression, see Parse
+	Cron string `json:"cron"`
+	// IANA time zone the expression is evaluated in, defaults to UTC
+	Timezone string `json:"timezone,omitempty"`
+	// Maximum random delay added to every run, in seconds
+	// Spreads the syncs of users sharing a schedule
+	Jitter int `json:"jitter,omitempty"`
+	// Body of the sync request, POST /
+	Sync json.RawMessage `json:"sync,omitempty"`
+
+	LastRun    time.Time `json:"lastRun,omitempty"`
+	LastStatus string    `json:"lastStatus,omitempty"`
+	LastError  string    `json:"lastError,omitempty"`
+	// Milliseconds taken by the last run
+	LastDuration int64     `json:"lastDuration,omitempty"`
+	NextRun      time.Time `json:"nextRun,omitempty"`
+	Running      bool      `json:"running"`
+}
+
+// Parses the cron expression and time zone of the job
+func (j *Job) schedule() (*Cron, *time.Location, error) {
+	c, err := Parse(j.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc := time.UTC
+	if j.Timezone != "" {
+		if loc, err = time.LoadLocation(j.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("invalid time zone %q", j.Timezone)
+		}
+	}
+	return c, loc, nil
+}
+
+// Checks the cron expression, time zone and jitter of the job
+func (j *Job) Validate() error {
+	if j.Jitter < 0 {
+		return fmt.Errorf("invalid jitter %d", j.Jitter)
+	}
+	_, _, err := j.schedule()
+	return err
+}
+
+// Runs the jobs on their schedules
+// A job is skipped while its previous run is still running
+// At most limit jobs run at once, due jobs wait for a free slot
+type Scheduler struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	cron map[string]*Cron
+	run  func(context.Context, Job) error
+	// Run slots
+	slots chan struct{}
+	// Wakes the loop when the jobs change
+	wake chan struct{}
+}
+
+// Returns a scheduler running at most limit jobs at once with run
+func New(limit int, run func(context.Context, Job) error) *Scheduler {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Scheduler{
+		jobs:  make(map[string]*Job),
+		cron:  make(map[string]*Cron),
+		run:   run,
+		slots: make(chan struct{}, limit),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Loads the saved jobs and starts running them in the background
+// Jobs whose sync request can not be decrypted with the key are dropped
+// Runs missed while the server was down are not caught up, the next run is computed from now
+func (s *Scheduler) Start(ctx context.Context) error {
+	js, err := Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for _, j := range js {
+		j := j
+		c, loc, err := j.schedule()
+		if err == nil {
+			j.Sync, err = open(j.Sync)
+		}
+		if err != nil {
+			logging.From(ctx).Error("err loading schedule", "op", "schedule", "account", logging.Account(j.User), "err", err)
+			continue
+		}
+		j.Running = false
+		j.NextRun = next(c, loc, j.Jitter, now)
+		s.jobs[j.User] = &j
+		s.cron[j.User] = c
+	}
+	s.mu.Unlock()
+
+	go s.loop()
+	return nil
+}
+
+// Adds or replaces the job of a user and saves the jobs
+// The run history of a replaced job is kept
+func (s *Scheduler) Put(ctx context.Context, j Job) (Job, error) {
+	c, loc, err := j.schedule()
+	if err != nil {
+		return Job{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.jobs[j.User]; ok {
+		j.LastRun, j.LastStatus, j.LastError, j.LastDuration = old.LastRun, old.LastStatus, old.LastError, old.LastDuration
+		j.Running = old.Running
+	} else {
+		j.LastRun, j.LastStatus, j.LastError, j.LastDuration, j.Running = time.Time{}, "", "", 0, false
+	}
+	j.NextRun = next(c, loc, j.Jitter, time.Now())
+	s.jobs[j.User] = &j
+	s.cron[j.User] = c
+	if err := s.save(ctx); err != nil {
+		return Job{}, err
+	}
+
+	s.notify()
+	return j, nil
+}
+
+// Removes the job of a user and saves the jobs
+// A running sync is not interrupted
+// Returns false if the user has no job
+func (s *Scheduler) Delete(ctx context.Context, user string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[user]; !ok {
+		return false, nil
+	}
+	delete(s.jobs, user)
+	delete(s.cron, user)
+	if err := s.save(ctx); err != nil {
+		return true, err
+	}
+
+	s.notify()
+	return true, nil
+}
+
+// Returns the job of a user, false if the user has none
+func (s *Scheduler) Get(user string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[user]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Returns every job sorted by next run
+func (s *Scheduler) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	js := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		js = append(js, *j)
+	}
+	sort.Slice(js, func(a, b int) bool { return js[a].NextRun.Before(js[b].NextRun) })
+	return js
+}
+
+// Starts the due jobs and sleeps until the next one is due
+func (s *Scheduler) loop() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		timer.Reset(s.tick(time.Now()))
+	}
+}
+
+// Starts the jobs due at now
+// Returns the wait until the next due job
+func (s *Scheduler) tick(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wait := time.Hour
+	changed := false
+	for user, j := range s.jobs {
+		if !j.NextRun.IsZero() && !j.NextRun.After(now) {
+			c, loc, _ := j.schedule()
+			if j.Running {
+				logging.From(context.Background()).Warn("skipping job, previous run still running", "op", "schedule", "account", logging.Account(user))
+				j.LastStatus = Skipped
+			} else {
+				j.Running = true
+				go s.start(*j)
+			}
+			j.NextRun = next(c, loc, j.Jitter, now)
+			changed = true
+		}
+		if !j.NextRun.IsZero() {
+			wait = min(wait, j.NextRun.Sub(now))
+		}
+	}
+	if changed {
+		if err := s.save(context.Background()); err != nil {
+			logging.From(context.Background()).Error("err saving schedules", "op", "schedule", "err", err)
+		}
+	}
+	return max(wait, time.Second)
+}
+
+// Runs a job once a slot is free and records the outcome
+// Every run gets its own job id, carried by the context logger
+func (s *Scheduler) start(j Job) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	ctx := logging.With(context.Background(), "job_id", logging.NewId(), "account", logging.Account(j.User))
+	log := logging.From(ctx).With("op", "schedule")
+	log.Info("job started")
+	begin := time.Now()
+	err := s.run(ctx, j)
+	if err != nil {
+		log.Error("job failed", "duration", time.Since(begin), "err", err)
+	} else {
+		log.Info("job finished", "duration", time.Since(begin))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.jobs[j.User]
+	if !ok {
+		// Deleted while running
+		return
+	}
+	cur.Running = false
+	cur.LastRun = begin.UTC()
+	cur.LastDuration = time.Since(begin).Milliseconds()
+	cur.LastStatus, cur.LastError = Succeeded, ""
+	if err != nil {
+		cur.LastStatus, cur.LastError = Failed, err.Error()
+	}
+	if err := s.save(ctx); err != nil {
+		log.Error("err saving schedules", "err", err)
+	}
+}
+
+// Saves the jobs with their sync requests encrypted, caller must hold s.mu
+func (s *Scheduler) save(ctx context.Context) error {
+	js := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		sealed, err := seal(j.Sync)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt sync request. err: %v", err)
+		}
+		cp := *j
+		cp.Sync = sealed
+		js = append(js, cp)
+	}
+	sort.Slice(js, func(a, b int) bool { return js[a].User < js[b].User })
+	return Save(ctx, js)
+}
+
+// Wakes the loop to pick up changed jobs
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the next run after now in loc, delayed by up to jitter seconds
+func next(c *Cron, loc *time.Location, jitter int, now time.Time) time.Time {
+	t := c.Next(now.In(loc))
+	if t.IsZero() {
+		return t
+	}
+	if jitter > 0 {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(jitter)+1))
+		t = t.Add(time.Duration(n.Int64()) * time.Second)
+	}
+	return t.UTC()
+}
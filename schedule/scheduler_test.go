@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tars47/go-read-mail/awss3/awss3test"
+)
+
+// Waits until the job of the user is no longer running
+func waitIdle(t *testing.T, s *Scheduler, user string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if j, _ := s.Get(user); !j.Running {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job still running")
+	return Job{}
+}
+
+func TestTickSkipsRunningJob(t *testing.T) {
+	awss3test.Use(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	runs := 0
+	s := New(1, func(ctx context.Context, j Job) error {
+		runs++
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	j, err := s.Put(context.Background(), Job{User: "u", Cron: "@every 1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tick(j.NextRun)
+	<-started
+
+	// Due again while the first run is still running
+	j, _ = s.Get("u")
+	s.tick(j.NextRun)
+	j, _ = s.Get("u")
+	if !j.Running || j.LastStatus != Skipped {
+		t.Errorf("Running, LastStatus = %v, %q, want true, %q", j.Running, j.LastStatus, Skipped)
+	}
+
+	close(release)
+	j = waitIdle(t, s, "u")
+	if runs != 1 || j.LastStatus != Succeeded {
+		t.Errorf("runs, LastStatus = %d, %q, want 1, %q", runs, j.LastStatus, Succeeded)
+	}
+}
+
+func TestSaveEncryptsSync(t *testing.T) {
+	b := awss3test.Use(t)
+	prev := key
+	defer func() { key = prev }()
+	SetKey("first key")
+
+	sync := []byte(`{"addr":"imap.example.org:993","pass":"secret-pass"}`)
+	s := New(1, func(context.Context, Job) error { return nil })
+	if _, err := s.Put(context.Background(), Job{User: "u", Cron: "@daily", Sync: sync}); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := b.Object(DefaultSchedules)
+	if bytes.Contains(o.Data, []byte("secret-pass")) {
+		t.Fatalf("schedules hold the password: %s", o.Data)
+	}
+
+	loaded := New(1, func(context.Context, Job) error { return nil })
+	if err := loaded.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if j, ok := loaded.Get("u"); !ok || !bytes.Equal(j.Sync, sync) {
+		t.Errorf("loaded sync = %s, want %s", j.Sync, sync)
+	}
+
+	// Jobs saved with another key are dropped
+	SetKey("second key")
+	other := New(1, func(context.Context, Job) error { return nil })
+	if err := other.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Get("u"); ok {
+		t.Error("job saved with another key was loaded")
+	}
+}
@@ -0,0 +1,47 @@
+package schedule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tars47/go-read-mail/awss3"
+)
+
+// Key of the schedules file, shared by every user so they can be loaded on start
+const DefaultSchedules = "schedules.json"
+
+// Loads the saved jobs from s3
+// Returns no jobs if none were saved
+func Load(ctx context.Context) ([]Job, error) {
+	buf, err := awss3.DownloadFile(ctx, DefaultSchedules)
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var js []Job
+	if err := json.NewDecoder(buf).Decode(&js); err != nil {
+		return nil, fmt.Errorf("unable to read schedules. err: %v", err)
+	}
+	return js, nil
+}
+
+// Saves the jobs to s3
+func Save(ctx context.Context, js []Job) error {
+	if js == nil {
+		js = []Job{}
+	}
+	b, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	if _, err := awss3.UploadFile(ctx, DefaultSchedules, bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("unable to save schedules. err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/tars47/go-read-mail/schedule"
+)
+
+// Runs the scheduled syncs, set up in main
+var scheduler *schedule.Scheduler
+
+// Default number of scheduled syncs running at once, see SCHEDULER_CONCURRENCY
+const DefaultConcurrency = 4
+
+// Runs a scheduled sync, the job holds the sync request body
+func runScheduled(ctx context.Context, j schedule.Job) error {
+	var req request
+	if err := json.Unmarshal(j.Sync, &req); err != nil {
+		return fmt.Errorf("unable to read sync request. err: %s", err.Error())
+	}
+	_, _, err := syncUser(ctx, req)
+	return err
+}
+
+// Hides the sync request of a job, it holds the account password
+func redactJob(j schedule.Job) schedule.Job {
+	j.Sync = nil
+	return j
+}
+
+// Lists every scheduled job with its last and next run, sorted by next run
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	js := scheduler.List()
+	for i := range js {
+		js[i] = redactJob(js[i])
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: js})
+}
+
+// Returns the user job with its last and next run
+func getSchedule(w http.ResponseWriter, r *http.Request) {
+	j, ok := scheduler.Get(r.PathValue("user"))
+	if !ok {
+		send(w, response{Status: http.StatusNotFound, Message: "Schedule not found"})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: redactJob(j)})
+}
+
+// Creates or replaces the user job
+// The sync field is the body of a sync request, POST /, for the same user
+func putSchedule(w http.ResponseWriter, r *http.Request) {
+	var j schedule.Job
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+	j.User = r.PathValue("user")
+
+	var req request
+	if err := json.Unmarshal(j.Sync, &req); err != nil || req.Addr == "" || req.Pass == "" {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed sync request"})
+		return
+	}
+	if req.User != "" && req.User != j.User {
+		send(w, response{Status: http.StatusBadRequest, Message: "Sync request is for another user"})
+		return
+	}
+	if err := j.Validate(); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+
+	// Stores the normalized request so the user is always set
+	req.User = j.User
+
+	// Checks the credentials now rather than failing every run
+	u := req.Mail
+	if err := u.Login(requestContext(w, r, j.User)); err != nil {
+		send(w, response{Status: http.StatusUnauthorized, Message: err.Error()})
+		return
+	}
+	u.Logout()
+	sync, err := json.Marshal(req)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	j.Sync = sync
+
+	j, err = scheduler.Put(r.Context(), j)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: redactJob(j)})
+}
+
+// Deletes the user job, a running sync is not interrupted
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	found, err := scheduler.Delete(r.Context(), r.PathValue("user"))
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	if !found {
+		send(w, response{Status: http.StatusNotFound, Message: "Schedule not found"})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success"})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tars47/go-read-mail/awss3"
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// Name of the sync state file stored in the user folder
+const DefaultState = "state.json"
+
+// State kept between syncs of a user
+type syncState struct {
+	// UIDVALIDITY of the INBOX when ModSeq was read
+	UidValidity uint32 `json:"uidValidity"`
+	// Highest mod sequence seen by the last sync, flag changes after it are picked up
+	ModSeq uint64 `json:"modSeq"`
+	// Write-back steps of the exported messages by uid, see mail.Actions
+	// Steps done are kept so re-runs do not repeat them
+	Actions map[uint32]*actionState `json:"actions,omitempty"`
+	// Date of the newest exported message and the uids of the exported messages of that date
+	// Messages received later within that same second are told apart by uid
+	Newest     time.Time `json:"newest"`
+	NewestUids []uint32  `json:"newestUids,omitempty"`
+
+	// Steps requested for the messages exported by this sync
+	steps []string
+	// Outcome of this sync reported to the webhooks
+	report *syncReport
+	// Archive attachments are expanded before upload
+	expand bool
+}
+
+// Write-back steps of a message
+type actionState struct {
+	Pending []string `json:"pending,omitempty"`
+	Done    []string `json:"done,omitempty"`
+}
+
+// Maximum number of messages kept in the actions log
+// Messages without pending steps are dropped first, lowest uid first
+const maxActionLog = 10000
+
+// Loads the user sync state from s3
+// Returns an empty state if the user has none
+func loadState(ctx context.Context, user string) (*syncState, error) {
+	st := &syncState{}
+	buf, err := awss3.DownloadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultState))
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.NewDecoder(buf).Decode(st); err != nil {
+		return nil, fmt.Errorf("unable to read sync state. err: %s", err.Error())
+	}
+	return st, nil
+}
+
+// Saves the user sync state to s3
+func saveState(ctx context.Context, user string, st *syncState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if _, err := awss3.UploadFile(ctx, fmt.Sprintf("%s/%s", user, DefaultState), bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("unable to save sync state. err: %s", err.Error())
+	}
+	return nil
+}
+
+// Prepares the state for a sync with the given INBOX UIDVALIDITY and requested steps
+// Steps of a previous UIDVALIDITY are dropped, their uids no longer match
+func (st *syncState) prepare(uidValidity uint32, steps []string) {
+	if st.UidValidity != 0 && st.UidValidity != uidValidity {
+		st.Actions = nil
+		st.NewestUids = nil
+	}
+	st.steps = steps
+}
+
+// Queues the requested steps for the exported messages
+// Steps already pending or done for a message are not queued again
+func (st *syncState) queue(msgs []mail.Message) {
+	if len(st.steps) == 0 {
+		return
+	}
+	if st.Actions == nil {
+		st.Actions = make(map[uint32]*actionState)
+	}
+	for _, msg := range msgs {
+		if msg.Uid == 0 {
+			continue
+		}
+		a := st.Actions[msg.Uid]
+		if a == nil {
+			a = &actionState{}
+			st.Actions[msg.Uid] = a
+		}
+		for _, step := range st.steps {
+			if !slices.Contains(a.Pending, step) && !slices.Contains(a.Done, step) {
+				a.Pending = append(a.Pending, step)
+			}
+		}
+	}
+}
+
+// Records the uids of the exported messages dated the newest exported date
+func (st *syncState) export(msgs []mail.Message) {
+	for _, msg := range msgs {
+		d := msg.Date.Truncate(time.Second)
+		switch {
+		case msg.Uid == 0 || d.Before(st.Newest):
+		case d.After(st.Newest):
+			st.Newest = d
+			st.NewestUids = []uint32{msg.Uid}
+		default:
+			st.NewestUids = append(st.NewestUids, msg.Uid)
+		}
+	}
+}
+
+// Returns the uids of the exported messages dated t, nil if they are not known
+func (st *syncState) exportedAt(t time.Time) []uint32 {
+	if !st.Newest.Equal(t) {
+		return nil
+	}
+	return st.NewestUids
+}
+
+// Runs the pending write-back steps, including the ones left by previous syncs
+// Messages sharing a step are processed in one command, steps run in mail.StepOrder
+// Failed steps stay pending and are retried on the next sync
+func runActions(ctx context.Context, u *mail.Mail, st *syncState) {
+	byStep := make(map[string][]uint32)
+	for uid, a := range st.Actions {
+		for _, step := range a.Pending {
+			byStep[step] = append(byStep[step], uid)
+		}
+	}
+	if len(byStep) == 0 {
+		return
+	}
+
+	steps := make([]string, 0, len(byStep))
+	for step := range byStep {
+		steps = append(steps, step)
+	}
+	sort.Slice(steps, func(i, j int) bool {
+		oi, oj := mail.StepOrder(steps[i]), mail.StepOrder(steps[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return steps[i] < steps[j]
+	})
+
+	// Messages moved out of the INBOX can not run later steps
+	moved := make(map[uint32]bool)
+	for _, step := range steps {
+		var uids []uint32
+		for _, uid := range byStep[step] {
+			if !moved[uid] {
+				uids = append(uids, uid)
+			}
+		}
+		if err := u.RunStep(step, uids); err != nil {
+			logging.From(ctx).Error("err running action", "op", "actions", "step", step, "err", err)
+			continue
+		}
+		for _, uid := range uids {
+			a := st.Actions[uid]
+			a.Pending = slices.DeleteFunc(a.Pending, func(s string) bool { return s == step })
+			a.Done = append(a.Done, step)
+			if strings.HasPrefix(step, "move:") {
+				moved[uid] = true
+			}
+		}
+	}
+	st.trim()
+}
+
+// Drops the oldest messages without pending steps once the log exceeds maxActionLog
+func (st *syncState) trim() {
+	if len(st.Actions) <= maxActionLog {
+		return
+	}
+	uids := make([]uint32, 0, len(st.Actions))
+	for uid, a := range st.Actions {
+		if len(a.Pending) == 0 {
+			uids = append(uids, uid)
+		}
+	}
+	slices.Sort(uids)
+	for _, uid := range uids {
+		if len(st.Actions) <= maxActionLog {
+			break
+		}
+		delete(st.Actions, uid)
+	}
+}
+
+// Returns the messages whose flags changed since the last sync
+// Nothing is returned on the first sync or when the INBOX UIDVALIDITY changed
+func flagChanges(ctx context.Context, u *mail.Mail, st *syncState) []mail.Message {
+	if st.ModSeq == 0 || st.UidValidity != u.UidValidity() {
+		return nil
+	}
+	changes, err := u.FlagChanges(st.ModSeq)
+	if err != nil {
+		logging.From(ctx).Error("err fetching flag changes", "op", "flags", "err", err)
+		return nil
+	}
+	return changes
+}
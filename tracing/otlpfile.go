@@ -0,0 +1,244 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Appends the exported spans to a file in the OTLP json format
+// Every export is written as one ExportTraceServiceRequest per line,
+// the format of the collector file exporter, so the file can be replayed or inspected offline
+type fileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Opens path for appending, the file is created if missing
+func newFileExporter(path string) (*fileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open trace file. err: %s", err.Error())
+	}
+	return &fileExporter{f: f}, nil
+}
+
+// Writes the spans grouped by resource and instrumentation scope
+func (e *fileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	type groupKey struct {
+		res   attribute.Distinct
+		scope string
+	}
+	var req otlpRequest
+	resIdx := make(map[attribute.Distinct]int)
+	scopeIdx := make(map[groupKey]int)
+	for _, s := range spans {
+		res := s.Resource().Equivalent()
+		ri, ok := resIdx[res]
+		if !ok {
+			ri = len(req.ResourceSpans)
+			resIdx[res] = ri
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource:  otlpResource{Attributes: otlpAttributes(s.Resource().Attributes())},
+				SchemaUrl: s.Resource().SchemaURL(),
+			})
+		}
+
+		sc := s.InstrumentationScope()
+		key := groupKey{res, sc.Name + "\x00" + sc.Version}
+		si, ok := scopeIdx[key]
+		rs := &req.ResourceSpans[ri]
+		if !ok {
+			si = len(rs.ScopeSpans)
+			scopeIdx[key] = si
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{
+				Scope:     otlpScope{Name: sc.Name, Version: sc.Version},
+				SchemaUrl: sc.SchemaURL,
+			})
+		}
+		rs.ScopeSpans[si].Spans = append(rs.ScopeSpans[si].Spans, otlpSpanOf(s))
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.f.Write(append(b, '\n'))
+	return err
+}
+
+// Closes the file
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// OTLP json encoding of an ExportTraceServiceRequest
+// Ids are hex strings and 64 bit integers decimal strings, as the OTLP json spec requires
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	SchemaUrl  string           `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope     otlpScope  `json:"scope"`
+	Spans     []otlpSpan `json:"spans"`
+	SchemaUrl string     `json:"schemaUrl,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+// OTLP status codes, they differ from the codes package
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+// Converts a span to its OTLP json encoding
+func otlpSpanOf(s sdktrace.ReadOnlySpan) otlpSpan {
+	sp := otlpSpan{
+		TraceId:           s.SpanContext().TraceID().String(),
+		SpanId:            s.SpanContext().SpanID().String(),
+		Name:              s.Name(),
+		Kind:              int(s.SpanKind()),
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+		Attributes:        otlpAttributes(s.Attributes()),
+	}
+	if s.Parent().HasSpanID() {
+		sp.ParentSpanId = s.Parent().SpanID().String()
+	}
+	for _, ev := range s.Events() {
+		sp.Events = append(sp.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(ev.Time.UnixNano(), 10),
+			Name:         ev.Name,
+			Attributes:   otlpAttributes(ev.Attributes),
+		})
+	}
+	switch s.Status().Code {
+	case codes.Ok:
+		sp.Status.Code = otlpStatusOk
+	case codes.Error:
+		sp.Status.Code = otlpStatusError
+		sp.Status.Message = s.Status().Description
+	}
+	return sp
+}
+
+// Converts attributes to their OTLP json encoding
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kvs = append(kvs, otlpKeyValue{Key: string(a.Key), Value: otlpValue(a.Value)})
+	}
+	return kvs
+}
+
+// Converts an attribute value to its OTLP json encoding
+func otlpValue(v attribute.Value) otlpAnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return otlpAnyValue{BoolValue: &b}
+	case attribute.INT64:
+		n := strconv.FormatInt(v.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &n}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return otlpAnyValue{DoubleValue: &f}
+	case attribute.BOOLSLICE:
+		var vals []otlpAnyValue
+		for _, b := range v.AsBoolSlice() {
+			vals = append(vals, otlpValue(attribute.BoolValue(b)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: vals}}
+	case attribute.INT64SLICE:
+		var vals []otlpAnyValue
+		for _, n := range v.AsInt64Slice() {
+			vals = append(vals, otlpValue(attribute.Int64Value(n)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: vals}}
+	case attribute.FLOAT64SLICE:
+		var vals []otlpAnyValue
+		for _, f := range v.AsFloat64Slice() {
+			vals = append(vals, otlpValue(attribute.Float64Value(f)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: vals}}
+	case attribute.STRINGSLICE:
+		var vals []otlpAnyValue
+		for _, s := range v.AsStringSlice() {
+			vals = append(vals, otlpValue(attribute.StringValue(s)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: vals}}
+	default:
+		s := v.Emit()
+		return otlpAnyValue{StringValue: &s}
+	}
+}
@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tars47/go-read-mail/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Service name of the exported traces
+const Service = "go-read-mail"
+
+// Exporters, see Setup
+const (
+	// Spans written to stdout, one json object per span
+	Stdout = "stdout"
+	// Spans appended to a file in the OTLP json format, one export request per line
+	OtlpFile = "otlp-file"
+)
+
+// Default file written by the otlp-file exporter
+const DefaultFile = "traces.jsonl"
+
+// Tracer of every span, the global provider set by Setup is picked up when spans start
+var tracer = otel.Tracer("github.com/tars47/go-read-mail")
+
+// Sets the global tracer provider exporting to the given exporter, stdout or otlp-file
+// file is the path written by otlp-file, DefaultFile if empty
+// No spans are exported if exporter is empty
+// Returns the function flushing the pending spans and closing the exporter
+func Setup(exporter, file string) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(exporter) {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case Stdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case OtlpFile:
+		if file == "" {
+			file = DefaultFile
+		}
+		exp, err = newFileExporter(file)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q, expected %v or %v", exporter, Stdout, OtlpFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", Service)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Starts a span, child of the span carried by ctx if any
+// Returns the context carrying the new span, the caller must end it, see End
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Ends a span, recording err if not nil
+// Email addresses of the error are replaced with their account hash, see logging.Scrub
+func End(span trace.Span, err error) {
+	if err != nil {
+		msg := logging.Scrub(err.Error())
+		span.RecordError(errors.New(msg))
+		span.SetStatus(codes.Error, msg)
+	}
+	span.End()
+}
+
+// Adds an event to the span carried by ctx, if any
+func Event(ctx context.Context, name string, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).AddEvent(name, trace.WithAttributes(attrs...))
+}
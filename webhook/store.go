@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tars47/go-read-mail/awss3"
+)
+
+// Name of the webhooks file stored in the user folder
+const DefaultHooks = "webhooks.json"
+
+// Name of the delivery log stored in the user folder
+const DefaultLog = "webhook-deliveries.json"
+
+// Number of deliveries kept in the log, oldest are dropped first
+const MaxLog = 200
+
+// Delivery outcomes
+const (
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// A delivery of an event to a hook
+type Delivery struct {
+	Id    string    `json:"id"`
+	Hook  string    `json:"hook"`
+	Event string    `json:"event"`
+	Type  string    `json:"type"`
+	Url   string    `json:"url"`
+	Time  time.Time `json:"time"`
+	// delivered or failed
+	Status   string    `json:"status"`
+	Attempts []Attempt `json:"attempts"`
+}
+
+// A single post of a delivery
+type Attempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// Milliseconds until the response
+	Duration int64 `json:"duration"`
+}
+
+// Serializes delivery log updates, the log is read, modified and written back to s3
+var logMu sync.Mutex
+
+// Loads the user hooks from s3
+// Returns no hooks if the user has none
+func Load(ctx context.Context, user string) ([]Hook, error) {
+	var hs []Hook
+	if err := load(ctx, fmt.Sprintf("%s/%s", user, DefaultHooks), &hs); err != nil {
+		return nil, fmt.Errorf("unable to read webhooks. err: %v", err)
+	}
+	return hs, nil
+}
+
+// Saves the user hooks to s3
+func Save(ctx context.Context, user string, hs []Hook) error {
+	if hs == nil {
+		hs = []Hook{}
+	}
+	if err := save(ctx, fmt.Sprintf("%s/%s", user, DefaultHooks), hs); err != nil {
+		return fmt.Errorf("unable to save webhooks. err: %v", err)
+	}
+	return nil
+}
+
+// Returns the user delivery log, latest first
+func Deliveries(ctx context.Context, user string) ([]Delivery, error) {
+	var ds []Delivery
+	if err := load(ctx, fmt.Sprintf("%s/%s", user, DefaultLog), &ds); err != nil {
+		return nil, fmt.Errorf("unable to read webhook deliveries. err: %v", err)
+	}
+	return ds, nil
+}
+
+// Adds a delivery on top of the user delivery log
+func appendLog(ctx context.Context, user string, d Delivery) error {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	ds, err := Deliveries(ctx, user)
+	if err != nil {
+		return err
+	}
+	ds = append([]Delivery{d}, ds...)
+	if len(ds) > MaxLog {
+		ds = ds[:MaxLog]
+	}
+	return save(ctx, fmt.Sprintf("%s/%s", user, DefaultLog), ds)
+}
+
+// Reads the json object stored at key into v, v is left as is if the key does not exist
+func load(ctx context.Context, key string, v interface{}) error {
+	buf, err := awss3.DownloadFile(ctx, key)
+	if err != nil {
+		if strings.Contains(err.Error(), awss3.NotFound) {
+			return nil
+		}
+		return err
+	}
+	return json.NewDecoder(buf).Decode(v)
+}
+
+// Writes v as json to key
+func save(ctx context.Context, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = awss3.UploadFile(ctx, key, bytes.NewReader(b))
+	return err
+}
@@ -0,0 +1,356 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tars47/go-read-mail/logging"
+	"github.com/tars47/go-read-mail/mail"
+)
+
+// Event types
+const (
+	SyncSucceeded = "sync.succeeded"
+	SyncFailed    = "sync.failed"
+	RuleMatched   = "rule.matched"
+)
+
+// Maximum number of messages listed in an event
+const MaxMessages = 100
+
+// Retry policy of deliveries
+// Attempt n waits BaseDelay * 2^(n-1), capped to MaxDelay, with up to 20% jitter
+var (
+	MaxAttempts = 6
+	BaseDelay   = time.Second
+	MaxDelay    = 5 * time.Minute
+)
+
+// Client used to deliver events
+// Connections to addresses that are not public are refused, also after redirects
+var Client = &http.Client{Timeout: 10 * time.Second, Transport: transport()}
+
+// Resolves the host of the hook urls
+var LookupIP = net.DefaultResolver.LookupIPAddr
+
+// Returned for a hook url whose host is not a public address
+var ErrAddress = errors.New("webhook url must resolve to a public address")
+
+// Returns a transport that only dials public addresses
+// Proxies are not used as the address checked would be the proxy one
+func transport() *http.Transport {
+	d := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// Runs on the resolved address, so hosts resolving to another address after Validate are refused too
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !public(ip) {
+				return ErrAddress
+			}
+			return nil
+		},
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
+
+// Ranges that are not public besides the ones net.IP reports
+var reserved = cidrs(
+	// "This network", shared address space (carrier-grade NAT), IETF protocol assignments,
+	// benchmarking, reserved and broadcast
+	"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4",
+	// NAT64, reaching the IPv4 address embedded in the last 32 bits through the gateway
+	"64:ff9b::/96", "64:ff9b:1::/48",
+)
+
+func cidrs(ss ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(ss))
+	for i, s := range ss {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// Returns false for loopback, private, link-local, unspecified, multicast and reserved addresses
+// IPv4-mapped IPv6 addresses, eg: ::ffff:10.0.0.1, are checked as the IPv4 address they hold
+func public(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range reserved {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// A webhook subscription of a user
+type Hook struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// Key of the HMAC-SHA256 signature sent in the X-Signature header
+	Secret string `json:"secret,omitempty"`
+	// Event types delivered, every type if empty
+	Events []string `json:"events,omitempty"`
+}
+
+// Payload posted to the hooks
+type Event struct {
+	Id       string    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	ExcelUrl string    `json:"excelUrl,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Counts   Counts    `json:"counts"`
+	// New messages, or the messages matching a rule for rule.matched
+	Messages []Summary `json:"messages,omitempty"`
+}
+
+// Message counts of a sync
+type Counts struct {
+	Fetched int `json:"fetched"`
+	// Messages written to the excel file
+	Exported int `json:"exported"`
+	// Messages skipped by rules
+	Skipped int `json:"skipped"`
+	// Exported messages whose flags changed
+	FlagChanges int `json:"flagChanges"`
+	// Attachments and bodies that could not be uploaded
+	FailedUploads int `json:"failedUploads"`
+}
+
+// Summary of a message
+type Summary struct {
+	Id          string    `json:"id"`
+	Date        time.Time `json:"date"`
+	From        string    `json:"from"`
+	Subject     string    `json:"subject"`
+	Tag         string    `json:"tag,omitempty"`
+	Attachments int       `json:"attachments"`
+	// Id of the matching rule, set for rule.matched
+	Rule string `json:"rule,omitempty"`
+}
+
+// Returns the summaries of the messages, at most MaxMessages
+func Summarize(msgs []mail.Message) []Summary {
+	out := make([]Summary, 0, min(len(msgs), MaxMessages))
+	for _, msg := range msgs {
+		if len(out) == MaxMessages {
+			break
+		}
+		out = append(out, Summary{
+			Id:          msg.Id,
+			Date:        msg.Date,
+			From:        mail.ToString(msg.From),
+			Subject:     msg.Subject,
+			Tag:         msg.Tag,
+			Attachments: len(msg.Attachment),
+		})
+	}
+	return out
+}
+
+// Checks the hook url and event types
+// The url host must only resolve to public addresses
+func (h *Hook) Validate(ctx context.Context) error {
+	u, err := url.Parse(h.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("invalid webhook url %q", h.Url)
+	}
+	ips := []net.IPAddr{{IP: net.ParseIP(u.Hostname())}}
+	if ips[0].IP == nil {
+		ips, err = LookupIP(ctx, u.Hostname())
+		if err != nil {
+			return fmt.Errorf("unable to resolve webhook host %q. err: %v", u.Hostname(), err)
+		}
+	}
+	for _, ip := range ips {
+		if !public(ip.IP) {
+			return ErrAddress
+		}
+	}
+	for _, e := range h.Events {
+		if e != SyncSucceeded && e != SyncFailed && e != RuleMatched {
+			return fmt.Errorf("unknown webhook event %q", e)
+		}
+	}
+	return nil
+}
+
+// Returns true if the hook subscribes to the event type
+func (h *Hook) Wants(typ string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the signature of a delivery, hex encoded HMAC-SHA256 of "<timestamp>.<body>"
+// Receivers recompute it with the hook secret and the X-Timestamp header
+func Sign(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delivers the event to every hook of the user subscribing to its type
+// Deliveries run in the background and are recorded in the user delivery log
+func Fire(ctx context.Context, user string, e Event) {
+	log := logging.From(ctx).With("op", "webhook", "event", e.Type)
+	hooks, err := Load(ctx, user)
+	if err != nil {
+		log.Error("err loading hooks", "err", err)
+		return
+	}
+	// Deliveries outlive the request
+	ctx = context.WithoutCancel(ctx)
+
+	if e.Id == "" {
+		e.Id = NewId()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.User = user
+
+	for _, h := range hooks {
+		if !h.Wants(e.Type) {
+			continue
+		}
+		go func(h Hook) {
+			d := Deliver(ctx, h, e)
+			if d.Status == Failed {
+				log.Warn("webhook delivery failed", "hook", h.Id, "attempts", len(d.Attempts))
+			}
+			if err := appendLog(ctx, user, d); err != nil {
+				log.Error("err saving delivery", "hook", h.Id, "err", err)
+			}
+		}(h)
+	}
+}
+
+// Posts the event to the hook, retrying network errors, 429 and 5xx responses
+// Blocks until the event is delivered or the attempts run out
+func Deliver(ctx context.Context, h Hook, e Event) Delivery {
+	d := Delivery{Id: NewId(), Hook: h.Id, Event: e.Id, Type: e.Type, Url: h.Url, Time: time.Now().UTC()}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		d.Status = Failed
+		d.Attempts = append(d.Attempts, Attempt{Time: time.Now().UTC(), Error: err.Error()})
+		return d
+	}
+
+	for n := 1; n <= MaxAttempts; n++ {
+		a, retry := post(ctx, h, e, body)
+		d.Attempts = append(d.Attempts, a)
+		if a.Error == "" && !retry {
+			d.Status = Delivered
+			return d
+		}
+		if !retry || n == MaxAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff(n)):
+		case <-ctx.Done():
+			d.Status = Failed
+			return d
+		}
+	}
+	d.Status = Failed
+	return d
+}
+
+// Makes a single delivery attempt
+// Returns the attempt and whether it should be retried
+func post(ctx context.Context, h Hook, e Event, body []byte) (Attempt, bool) {
+	start := time.Now()
+	a := Attempt{Time: start.UTC()}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Url, bytes.NewReader(body))
+	if err != nil {
+		a.Error = err.Error()
+		return a, false
+	}
+	ts := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-read-mail-webhook")
+	req.Header.Set("X-Event", e.Type)
+	req.Header.Set("X-Event-Id", e.Id)
+	req.Header.Set("X-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Signature", Sign(h.Secret, ts, body))
+
+	res, err := Client.Do(req)
+	a.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		a.Error = err.Error()
+		return a, true
+	}
+	res.Body.Close()
+
+	a.StatusCode = res.StatusCode
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return a, false
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		a.Error = res.Status
+		return a, true
+	default:
+		a.Error = res.Status
+		return a, false
+	}
+}
+
+// Returns the wait before the attempt following attempt n
+func backoff(n int) time.Duration {
+	d := BaseDelay << (n - 1)
+	if d <= 0 || d > MaxDelay {
+		d = MaxDelay
+	}
+	if j := int64(d) / 5; j > 0 {
+		r, _ := rand.Int(rand.Reader, big.NewInt(j))
+		d += time.Duration(r.Int64())
+	}
+	return d
+}
+
+// Returns a random id
+func NewId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
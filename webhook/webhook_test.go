@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	prev := LookupIP
+	defer func() { LookupIP = prev }()
+	LookupIP = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "hooks.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		case "internal.example.com":
+			// One public and one private address, the private one may be dialed
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("10.0.0.5")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"https://hooks.example.com/hook", nil},
+		{"http://93.184.216.34:8080/hook", nil},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/hook", nil},
+		{"https://internal.example.com/hook", ErrAddress},
+		{"http://127.0.0.1/hook", ErrAddress},
+		{"http://[::1]/hook", ErrAddress},
+		{"http://10.1.2.3/hook", ErrAddress},
+		{"http://192.168.1.1/hook", ErrAddress},
+		{"http://169.254.169.254/latest/meta-data", ErrAddress},
+		{"http://[fe80::1]/hook", ErrAddress},
+		{"http://0.0.0.0/hook", ErrAddress},
+		{"http://224.0.0.1/hook", ErrAddress},
+		{"http://[::ffff:127.0.0.1]/hook", ErrAddress},
+	}
+	for _, tt := range tests {
+		h := Hook{Url: tt.url}
+		if err := h.Validate(context.Background()); err != tt.want {
+			t.Errorf("Validate(%q) = %v, want %v", tt.url, err, tt.want)
+		}
+	}
+
+	for _, u := range []string{"ftp://hooks.example.com", "https://", "https://unknown.example.com/hook"} {
+		h := Hook{Url: u}
+		if err := h.Validate(context.Background()); err == nil {
+			t.Errorf("Validate(%q) succeeded", u)
+		}
+	}
+}
+
+func TestPublic(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":                      true,
+		"2606:2800:220:1:248:1893:25c8:1946": true,
+		"100.64.0.1":                         false,
+		"100.127.255.254":                    false,
+		"100.128.0.1":                        true,
+		"0.1.2.3":                            false,
+		"198.18.0.1":                         false,
+		"240.0.0.1":                          false,
+		"255.255.255.255":                    false,
+		"::ffff:10.0.0.1":                    false,
+		"::ffff:169.254.169.254":             false,
+		"::ffff:100.64.0.1":                  false,
+		"::ffff:93.184.216.34":               true,
+		"64:ff9b::a00:1":                     false,
+		"64:ff9b::5db8:d822":                 false,
+		"64:ff9b:1::a00:1":                   false,
+		"fc00::1":                            false,
+	} {
+		if got := public(net.ParseIP(addr)); got != want {
+			t.Errorf("public(%v) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// A hook host resolving to a loopback address after it was validated is never reached
+func TestDeliverLoopback(t *testing.T) {
+	reached := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer srv.Close()
+
+	prev := MaxAttempts
+	MaxAttempts = 1
+	defer func() { MaxAttempts = prev }()
+
+	d := Deliver(context.Background(), Hook{Id: "h", Url: srv.URL}, Event{Id: "e", Type: SyncSucceeded})
+	if d.Status != Failed || len(d.Attempts) != 1 {
+		t.Fatalf("delivery = %+v, want a single failed attempt", d)
+	}
+	if reached {
+		t.Error("loopback server was reached")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/tars47/go-read-mail/mail"
+	"github.com/tars47/go-read-mail/retry"
+	"github.com/tars47/go-read-mail/rules"
+	"github.com/tars47/go-read-mail/webhook"
+)
+
+// Serializes webhook changes, hooks are read, modified and written back to s3
+var hooksMu sync.Mutex
+
+// Lists the user webhooks, secrets are not returned
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	hs, err := webhook.Load(r.Context(), r.PathValue("user"))
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	if hs == nil {
+		hs = []webhook.Hook{}
+	}
+	for i := range hs {
+		hs[i].Secret = ""
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: hs})
+}
+
+// Adds a webhook to the user webhooks
+// Generates the id and the secret if not given, the secret is only returned here
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var h webhook.Hook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: "Malformed request body"})
+		return
+	}
+	if err := h.Validate(r.Context()); err != nil {
+		send(w, response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	if h.Id == "" {
+		h.Id = newId()
+	}
+	if h.Secret == "" {
+		h.Secret = newId() + newId()
+	}
+
+	user := r.PathValue("user")
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	hs, err := webhook.Load(r.Context(), user)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	for _, hh := range hs {
+		if hh.Id == h.Id {
+			send(w, response{Status: http.StatusConflict, Message: "Webhook already exists"})
+			return
+		}
+	}
+
+	if err := webhook.Save(r.Context(), user, append(hs, h)); err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusCreated, Message: "Success", Data: h})
+}
+
+// Deletes the webhook with the given id
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	user, id := r.PathValue("user"), r.PathValue("id")
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	hs, err := webhook.Load(r.Context(), user)
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	kept := make([]webhook.Hook, 0, len(hs))
+	for _, hh := range hs {
+		if hh.Id != id {
+			kept = append(kept, hh)
+		}
+	}
+	if len(kept) == len(hs) {
+		send(w, response{Status: http.StatusNotFound, Message: "Webhook not found"})
+		return
+	}
+
+	if err := webhook.Save(r.Context(), user, kept); err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success"})
+}
+
+// Lists the recent webhook deliveries of the user, latest first
+// Every delivery lists its attempts with the response status or error
+func listDeliveries(w http.ResponseWriter, r *http.Request) {
+	ds, err := webhook.Deliveries(r.Context(), r.PathValue("user"))
+	if err != nil {
+		send(w, response{Status: http.StatusInternalServerError, Message: err.Error()})
+		return
+	}
+	if ds == nil {
+		ds = []webhook.Delivery{}
+	}
+	send(w, response{Status: http.StatusOK, Message: "Success", Data: ds})
+}
+
+// Outcome of a sync reported to the webhooks
+type syncReport struct {
+	webhook.Counts
+	// Messages written to the excel file
+	exported []webhook.Summary
+	// Fetched messages matching a rule
+	matched []webhook.Summary
+	// Presigned url of the excel file
+	url string
+	// Files that could not be uploaded
+	failed []uploadFailure
+	// Archives that could not be fully expanded
+	unexpanded []archiveFailure
+	// Attachments found infected
+	quarantined []quarantinedFile
+}
+
+// Records the fetched messages and their rule matches
+// matched holds the rules.DryRun results of msgs
+func (rep *syncReport) match(msgs []mail.Message, matched []rules.Result) {
+	rep.Fetched += len(msgs)
+	for i, res := range matched {
+		if res.Rule == "" {
+			continue
+		}
+		if res.Actions.Skip {
+			rep.Skipped++
+		}
+		if len(rep.matched) < webhook.MaxMessages {
+			s := webhook.Summarize(msgs[i : i+1])[0]
+			s.Rule, s.Tag = res.Rule, res.Actions.Tag
+			rep.matched = append(rep.matched, s)
+		}
+	}
+}
+
+// Records the messages written to the excel file
+func (rep *syncReport) export(msgs []mail.Message) {
+	rep.Exported += len(msgs)
+	if n := webhook.MaxMessages - len(rep.exported); n > 0 {
+		rep.exported = append(rep.exported, webhook.Summarize(msgs[:min(n, len(msgs))])...)
+	}
+}
+
+// Records the attachments and bodies of the messages, and of their embedded messages,
+// that could not be uploaded, and the archives that could not be expanded
+func (rep *syncReport) fail(msgs []mail.Message) {
+	for _, msg := range msgs {
+		if msg.BodyError != nil {
+			rep.failed = append(rep.failed, newFailure(msg.Id, "body.html", msg.BodyError))
+		}
+		rep.failFiles(msg.Id, "", msg.Attachment)
+		rep.fail(msg.Embedded)
+	}
+	rep.FailedUploads = len(rep.failed)
+}
+
+// Records the failures of attachments and of the files expanded from them
+// Expanded files are named after their archive, eg: invoices.zip/march.pdf
+func (rep *syncReport) failFiles(id, parent string, atts []mail.Attachment) {
+	for _, att := range atts {
+		name := parent + att.Name
+		if att.Error != nil {
+			rep.failed = append(rep.failed, newFailure(id, name, att.Error))
+		}
+		if att.ArchiveError != nil {
+			rep.unexpanded = append(rep.unexpanded, archiveFailure{Message: id, Name: name, Error: att.ArchiveError.Error()})
+		}
+		if att.Threat != "" {
+			rep.quarantined = append(rep.quarantined, quarantinedFile{Message: id, Name: name, Threat: att.Threat})
+		}
+		rep.failFiles(id, name+"/", att.Children)
+	}
+}
+
+// Returns the failure of a file upload
+func newFailure(id, name string, err error) uploadFailure {
+	return uploadFailure{Message: id, Name: name, Class: retry.Classify(err).String(), Error: err.Error()}
+}
+
+// Fires the sync.succeeded or sync.failed event, and rule.matched when messages matched a rule
+func notify(ctx context.Context, user string, rep *syncReport, url string, err error) {
+	e := webhook.Event{Type: webhook.SyncSucceeded, ExcelUrl: url, Counts: rep.Counts}
+	if err != nil {
+		e.Type = webhook.SyncFailed
+		e.Error = err.Error()
+	} else {
+		e.Messages = rep.exported
+	}
+	webhook.Fire(ctx, user, e)
+
+	if len(rep.matched) > 0 {
+		m := webhook.Event{Type: webhook.RuleMatched, ExcelUrl: url, Counts: rep.Counts, Messages: rep.matched}
+		if err != nil {
+			m.Error = err.Error()
+		}
+		webhook.Fire(ctx, user, m)
+	}
+}
@@ -0,0 +1,172 @@
+package workers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pool of workers shared by every request
+// Tasks are queued per user and workers take them from the users in turn,
+// so an account with thousands of tasks does not starve the others
+type Pool struct {
+	mu sync.Mutex
+	// Signalled when a task is queued
+	work *sync.Cond
+	// Signalled when a task is taken from a queue
+	space *sync.Cond
+	// Queued tasks by user
+	queues map[string][]task
+	// Users with queued tasks, in turn order
+	users []string
+	// Maximum queued tasks per user, Go blocks beyond it
+	limit int
+	// Progress by user, removed once the user has no queued or running task
+	progress map[string]*Progress
+}
+
+// A queued task
+type task struct {
+	f func() error
+	g *Group
+}
+
+// Progress of the tasks of a user
+// Counts start over when a task is queued after all the previous ones finished
+type Progress struct {
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+	Done    int `json:"done"`
+	Failed  int `json:"failed"`
+	// Tasks queued since the counts were reset
+	Total   int       `json:"total"`
+	Started time.Time `json:"started"`
+}
+
+// Returns a pool of n workers queuing at most limit tasks per user
+func New(n, limit int) *Pool {
+	if n < 1 {
+		n = 1
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	p := &Pool{
+		queues:   make(map[string][]task),
+		limit:    limit,
+		progress: make(map[string]*Progress),
+	}
+	p.work = sync.NewCond(&p.mu)
+	p.space = sync.NewCond(&p.mu)
+	for i := 0; i < n; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Tasks of a user that are waited for together
+type Group struct {
+	p    *Pool
+	user string
+	wg   sync.WaitGroup
+}
+
+// Returns a group queuing tasks for the user
+func (p *Pool) Group(user string) *Group {
+	return &Group{p: p, user: user}
+}
+
+// Queues a task
+// Blocks while the user has the maximum number of queued tasks, slowing down the caller
+// to the pace of the workers
+func (g *Group) Go(f func() error) {
+	g.wg.Add(1)
+	p := g.p
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queues[g.user]) >= p.limit {
+		p.space.Wait()
+	}
+
+	pr := p.progress[g.user]
+	if pr == nil {
+		pr = &Progress{Started: time.Now().UTC()}
+		p.progress[g.user] = pr
+	}
+	pr.Queued++
+	pr.Total++
+
+	if len(p.queues[g.user]) == 0 {
+		p.users = append(p.users, g.user)
+	}
+	p.queues[g.user] = append(p.queues[g.user], task{f: f, g: g})
+	p.work.Signal()
+}
+
+// Waits for the tasks of the group
+func (g *Group) Wait() {
+	g.wg.Wait()
+}
+
+// Returns the progress of the user tasks, false if the user has no queued or running task
+func (p *Pool) Progress(user string) (Progress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.progress[user]
+	if !ok {
+		return Progress{}, false
+	}
+	return *pr, true
+}
+
+// Runs the queued tasks, taking one from every user in turn
+func (p *Pool) worker() {
+	for {
+		p.mu.Lock()
+		for len(p.users) == 0 {
+			p.work.Wait()
+		}
+		user := p.users[0]
+		q := p.queues[user]
+		t := q[0]
+		p.queues[user] = q[1:]
+		// The user goes to the back of the line, or leaves it when it has no more tasks
+		p.users = p.users[1:]
+		if len(p.queues[user]) > 0 {
+			p.users = append(p.users, user)
+		} else {
+			delete(p.queues, user)
+		}
+		pr := p.progress[user]
+		pr.Queued--
+		pr.Running++
+		p.space.Broadcast()
+		p.mu.Unlock()
+
+		err := run(t.f)
+
+		p.mu.Lock()
+		pr.Running--
+		pr.Done++
+		if err != nil {
+			pr.Failed++
+		}
+		// Entries of finished users are dropped so the map does not grow with every account
+		if pr.Queued+pr.Running == 0 {
+			delete(p.progress, user)
+		}
+		p.mu.Unlock()
+		t.g.wg.Done()
+	}
+}
+
+// Runs a task, a panic is returned as an error so the worker and the group waiting survive it
+func run(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,105 @@
+package workers
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPanicCountsAsFailure(t *testing.T) {
+	p := New(1, 4)
+	g := p.Group("u")
+	release := make(chan struct{})
+	g.Go(func() error { panic("boom") })
+	g.Go(func() error { return errors.New("failed") })
+	g.Go(func() error { <-release; return nil })
+
+	// The last task holds the worker so the counts can be read before the entry is dropped
+	var pr Progress
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if pr, _ = p.Progress("u"); pr.Running == 1 {
+			break
+		}
+	}
+	if pr.Done != 2 || pr.Failed != 2 || pr.Running != 1 || pr.Queued != 0 || pr.Total != 3 {
+		t.Errorf("progress = %+v, want 2 done, 2 failed and 1 running", pr)
+	}
+	close(release)
+	g.Wait()
+
+	if _, ok := p.Progress("u"); ok {
+		t.Error("progress kept after the tasks finished")
+	}
+}
+
+func TestUsersTakeTurns(t *testing.T) {
+	p := New(1, 8)
+	started, release := make(chan struct{}), make(chan struct{})
+	a, b := p.Group("a"), p.Group("b")
+	// Holds the only worker while both users queue their tasks
+	a.Go(func() error { close(started); <-release; return nil })
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	task := func(user string) func() error {
+		return func() error {
+			mu.Lock()
+			order = append(order, user)
+			mu.Unlock()
+			return nil
+		}
+	}
+	for i := 0; i < 3; i++ {
+		a.Go(task("a"))
+	}
+	for i := 0; i < 3; i++ {
+		b.Go(task("b"))
+	}
+	close(release)
+	a.Wait()
+	b.Wait()
+
+	want := []string{"a", "b", "a", "b", "a", "b"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestGoBlocksAtLimit(t *testing.T) {
+	p := New(1, 2)
+	started, release := make(chan struct{}), make(chan struct{})
+	g := p.Group("u")
+	g.Go(func() error { close(started); <-release; return nil })
+	<-started
+	g.Go(func() error { return nil })
+	g.Go(func() error { return nil })
+
+	queued := make(chan struct{})
+	go func() {
+		g.Go(func() error { return nil })
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("Go returned with a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if pr, _ := p.Progress("u"); pr.Queued != 2 {
+		t.Errorf("queued = %d, want 2", pr.Queued)
+	}
+
+	close(release)
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("Go still blocked once the queue drained")
+	}
+	g.Wait()
+}